@@ -1,18 +1,17 @@
 {{define "dsba.credentials.presentation.Employee" -}}
-{{ $now := now | unixEpoch -}}
 {
     "@context": [
         "https://www.w3.org/ns/credentials/v2",
         "https://www.evidenceledger.eu/2022/credentials/employee/v1"
     ],
-    "id": "{{.jti}}",
+    "id": {{ toJson .jti }},
     "type": ["VerifiableCredential", "dsba.credentials.presentation.Employee"],
     "issuer": {
-        "id": "{{.issuerDID}}"
+        "id": {{ toJson .issuerDID }}
     },
-    "issuanceDate": "{{ $now }}",
-    "validFrom": "{{ $now }}",
-    "expirationDate": "{{ add $now 10000 }}",
-    "credentialSubject": {{toPrettyJson .claims}}
+    "issuanceDate": {{ toJson .validFrom }},
+    "validFrom": {{ toJson .validFrom }},
+    "expirationDate": {{ toJson .validUntil }},
+    "credentialSubject": {{ toPrettyJson .claims }}
 }
 {{end}}
@@ -1,18 +1,33 @@
 {{define "LEARCredentialEmployee" -}}
-{{ $now := now | unixEpoch -}}
+{{ $mandate := .claims.mandate -}}
 {
     "@context": [
         "https://www.w3.org/ns/credentials/v2",
         "https://www.evidenceledger.eu/2022/credentials/employee/v1"
     ],
-    "id": "{{.jti}}",
+    "id": {{ toJson .jti }},
     "type": ["VerifiableCredential", "LEARCredentialEmployee"],
     "issuer": {
-        "id": "{{.issuerDID}}"
+        "id": {{ toJson .issuerDID }}
     },
-    "issuanceDate": "{{ $now }}",
-    "validFrom": "{{ $now }}",
-    "expirationDate": "{{ add $now 10000 }}",
-    "credentialSubject": {{toPrettyJson .claims}}
+    "issuanceDate": {{ toJson .validFrom }},
+    "validFrom": {{ toJson .validFrom }},
+    "expirationDate": {{ toJson .validUntil }},
+    "credentialSubject": {
+        "mandate": {
+            "id": {{ uuidv4 | toJson }},
+            "mandator": {{ toJson $mandate.mandator }},
+            "mandatee": {{ toJson $mandate.mandatee }},
+            "power": [
+                {{- range $i, $power := $mandate.power }}{{ if $i }},{{ end }}
+                {{ set $power "id" uuidv4 | toJson }}
+                {{- end }}
+            ],
+            "life_span": {
+                "start_date_time": {{ toJson .validFrom }},
+                "end_date_time": {{ toJson .validUntil }}
+            }
+        }
+    }
 }
 {{end}}
@@ -0,0 +1,33 @@
+{{define "LEARCredentialMachine" -}}
+{{ $mandate := .claims.mandate -}}
+{
+    "@context": [
+        "https://www.w3.org/ns/credentials/v2",
+        "https://www.evidenceledger.eu/2022/credentials/machine/v1"
+    ],
+    "id": {{ toJson .jti }},
+    "type": ["VerifiableCredential", "LEARCredentialMachine"],
+    "issuer": {
+        "id": {{ toJson .issuerDID }}
+    },
+    "issuanceDate": {{ toJson .validFrom }},
+    "validFrom": {{ toJson .validFrom }},
+    "expirationDate": {{ toJson .validUntil }},
+    "credentialSubject": {
+        "mandate": {
+            "id": {{ uuidv4 | toJson }},
+            "mandator": {{ toJson $mandate.mandator }},
+            "mandatee": {{ toJson $mandate.mandatee }},
+            "power": [
+                {{- range $i, $power := $mandate.power }}{{ if $i }},{{ end }}
+                {{ set $power "id" uuidv4 | toJson }}
+                {{- end }}
+            ],
+            "life_span": {
+                "start_date_time": {{ toJson .validFrom }},
+                "end_date_time": {{ toJson .validUntil }}
+            }
+        }
+    }
+}
+{{end}}
@@ -454,48 +454,30 @@ window.MHR.register(
 );
 
 async function storeOfferingInServer(jsonCredential) {
-   const userEmail = jsonCredential.credentialSubject.mandate.mandatee.email;
-   const organizationIdentifier =
-      jsonCredential.credentialSubject.mandate.mandator.organizationIdentifier;
-   const learcred = JSON.stringify(jsonCredential);
+   const mandate = jsonCredential.credentialSubject.mandate;
 
-   var model = pb.authStore.model;
+   // The server seals the credential and creates the record in "offered" status,
+   // where the Mandator is the organization of the signer
+   var data = {
+      type: "LEARCredentialEmployee",
+      claims: { mandate: mandate },
+      email: mandate.mandatee.email,
+   };
 
-   // Sign the credential in the server with the x509 certificate
    try {
-      var result = await pb.send("/apisigner/signcredential", {
+      var result = await pb.send("/apisigner/issuecredential", {
          method: "POST",
-         body: learcred,
+         body: JSON.stringify(data),
          headers: {
             "Content-Type": "application/json",
          },
       });
-      var signedCredential = result.signed;
-      console.log(signedCredential);
+      console.log(result);
    } catch (error) {
       gotoPage("ErrorPage", { title: "Error creating credential", msg: error.message });
       return;
    }
 
-   // Create the record in "tobesigned" status
-   var data = {
-      status: "offered",
-      email: userEmail,
-      organizationIdentifier: organizationIdentifier,
-      type: "jwt_vc",
-      raw: signedCredential,
-      creator_email: model.email,
-      signer_email: model.email,
-   };
-
-   try {
-      var tobesignedRecord = await pb.collection("credentials").create(data);
-      console.log(tobesignedRecord);
-   } catch (error) {
-      gotoPage("ErrorPage", { title: "Error saving credential", msg: error.message });
-      return;
-   }
-
    alert("Credential saved!!");
 
    goHome();
@@ -189,8 +189,17 @@ window.MHR.register(
             this.VCType = result["type"];
             this.VCStatus = result["status"];
 
-            // We only process credentials in 'offered' or 'signed' status
-            if (this.VCStatus == "offered" || this.VCStatus == "signed") {
+            // Offered credentials are only issued with the OpenID4VCI offer, which binds them to the key of the holder.
+            // Here we only process credentials already in 'signed' status.
+            if (this.VCStatus == "offered") {
+               this.showError(
+                  "Credential offer",
+                  "Open the credential offer sent by the Issuer to your email to accept the credential"
+               );
+               return;
+            }
+
+            if (this.VCStatus == "signed") {
                // Get the HTML for the credential
                try {
                   this.renderedVC = this.prerenderCredential(this.VC, this.VCType, this.VCStatus);
@@ -199,27 +208,8 @@ window.MHR.register(
                   return;
                }
 
-               if (this.VCStatus == "offered") {
-                  // The credential has been offered, and the user can authorise its issuance or not
-                  let theHtml = this.html`
-              <ion-card color="warning">
-                <ion-card-content>
-                  <p>
-                    <b>
-                      ${T("You received a proposal for a Verifiable Credential")}.
-                      ${T("You can accept it, or cancel the operation.")}
-                    </b>
-                  </p>
-                </ion-card-content>
-              </ion-card>
-
-              ${this.renderedVC}
-            `;
-                  this.render(theHtml);
-                  return;
-               } else if (this.VCStatus == "signed") {
-                  // The credential is already signed. The user has the option to store it in her wallet
-                  let theHtml = this.html`
+               // The credential is already signed. The user has the option to store it in her wallet
+               let theHtml = this.html`
               <ion-card color="warning">
                 <ion-card-content>
                   <p>
@@ -235,15 +225,14 @@ window.MHR.register(
 
               ${this.renderedVC}
             `;
-                  this.render(theHtml);
-                  return;
-               }
+               this.render(theHtml);
+               return;
             }
 
             // The credential is not in a correct state. Present an error screen
             this.showError(
                "Invalid credential",
-               "The credential is neither in 'offered' nor 'signed' status"
+               "The credential is not in 'signed' status"
             );
          }
       }
@@ -510,31 +499,6 @@ window.MHR.register(
          } else if (this.VCType == "jwt_vc") {
             debugger;
 
-            if (this.VCStatus == "offered") {
-               // We should update the credential offer with the did of the user
-
-               var myDid = await getOrCreateDidKey();
-
-               // Update the credential with the did:key
-               var sendidRequest = {
-                  did: myDid.did,
-               };
-
-               // Send the DID to the Issuer
-               const senddidURL = `${this.OriginServer}/apiuser/senddid/${this.VCId}`;
-               var result = await doPOST(senddidURL, sendidRequest);
-               if (!result) {
-                  return;
-               }
-               console.log("after doPOST sending the DID");
-
-               // We received back the updated credential. Status must be 'tobesigned'
-               this.VC = result["credential"];
-               this.VCId = result["id"];
-               this.VCType = result["type"];
-               this.VCStatus = result["status"];
-            }
-
             // The credential is in JWT format, lets decode it
             const decoded = decodeUnsafeJWT(this.VC);
 
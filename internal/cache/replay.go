@@ -0,0 +1,35 @@
+package cache
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrReplay is returned by ReplayCache.Check when a value has already been seen.
+var ErrReplay = errors.New("value already used")
+
+// ReplayCache remembers single-use values (nonces, token identifiers, fingerprints)
+// for as long as they could be accepted, so a second use can be detected.
+type ReplayCache struct {
+	c *Cache
+}
+
+// NewReplayCache returns a ReplayCache whose expired values are purged every
+// cleanupInterval.
+func NewReplayCache(cleanupInterval time.Duration) *ReplayCache {
+	return &ReplayCache{c: New(NoExpiration, cleanupInterval)}
+}
+
+// Check records the value under the given kind for the duration ttl.
+// It returns ErrReplay if the value was already recorded and has not expired.
+// Checking and recording is atomic, so only one of several concurrent callers
+// with the same value succeeds.
+func (r *ReplayCache) Check(kind string, value string, ttl time.Duration) error {
+	if ttl <= 0 {
+		ttl = time.Second
+	}
+	if err := r.c.Add(kind+":"+value, time.Now(), ttl); err != nil {
+		return ErrReplay
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+// Package did resolves the DID methods used by Wallets for holder binding.
+// Only 'did:key' is supported, which does not require any network access because
+// the public key is encoded in the DID itself.
+package did
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"encoding/binary"
+	"fmt"
+	"strings"
+
+	"github.com/lestrrat-go/jwx/v2/jwk"
+	"github.com/multiformats/go-multibase"
+	"github.com/multiformats/go-multicodec"
+)
+
+const didKeyPrefix = "did:key:"
+
+// PublicKeyFromDIDKey returns the public key encoded in a 'did:key' DID.
+// The supported key types are JWK (jwk_jcs-pub), which is what our Wallet generates,
+// P-256 (compressed) and Ed25519.
+// A DID URL with a fragment (did:key:z...#z...) is also accepted, as used in the 'kid' of JWTs.
+func PublicKeyFromDIDKey(did string) (any, error) {
+
+	if !strings.HasPrefix(did, didKeyPrefix) {
+		return nil, fmt.Errorf("not a did:key: %s", did)
+	}
+
+	// Remove the fragment if present
+	identifier, _, _ := strings.Cut(strings.TrimPrefix(did, didKeyPrefix), "#")
+
+	_, decoded, err := multibase.Decode(identifier)
+	if err != nil {
+		return nil, fmt.Errorf("decoding did:key: %w", err)
+	}
+
+	// The first bytes are the multicodec identifier of the key type, as an unsigned varint
+	codec, n := binary.Uvarint(decoded)
+	if n <= 0 {
+		return nil, fmt.Errorf("invalid multicodec in did:key")
+	}
+	keyBytes := decoded[n:]
+
+	switch multicodec.Code(codec) {
+	case multicodec.Jwk_jcsPub:
+		key, err := jwk.ParseKey(keyBytes)
+		if err != nil {
+			return nil, fmt.Errorf("parsing JWK in did:key: %w", err)
+		}
+		var raw any
+		if err := key.Raw(&raw); err != nil {
+			return nil, err
+		}
+		return raw, nil
+
+	case multicodec.P256Pub:
+		x, y := elliptic.UnmarshalCompressed(elliptic.P256(), keyBytes)
+		if x == nil {
+			return nil, fmt.Errorf("invalid P-256 key in did:key")
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, nil
+
+	case multicodec.Ed25519Pub:
+		if len(keyBytes) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid Ed25519 key in did:key")
+		}
+		return ed25519.PublicKey(keyBytes), nil
+
+	default:
+		return nil, fmt.Errorf("unsupported key type in did:key: %s", multicodec.Code(codec))
+	}
+}
+
+// DIDKeyFromPublicKey returns the 'did:key' DID of a P-256 or Ed25519 public key,
+// for holders which identify their key with a JWK instead of a DID.
+func DIDKeyFromPublicKey(key any) (string, error) {
+	var codec multicodec.Code
+	var keyBytes []byte
+
+	switch k := key.(type) {
+	case *ecdsa.PublicKey:
+		if k.Curve != elliptic.P256() {
+			return "", fmt.Errorf("unsupported curve for did:key: %s", k.Curve.Params().Name)
+		}
+		codec = multicodec.P256Pub
+		keyBytes = elliptic.MarshalCompressed(k.Curve, k.X, k.Y)
+	case ed25519.PublicKey:
+		codec = multicodec.Ed25519Pub
+		keyBytes = k
+	default:
+		return "", fmt.Errorf("unsupported key type for did:key: %T", key)
+	}
+
+	decoded := binary.AppendUvarint(nil, uint64(codec))
+	decoded = append(decoded, keyBytes...)
+
+	identifier, err := multibase.Encode(multibase.Base58BTC, decoded)
+	if err != nil {
+		return "", err
+	}
+	return didKeyPrefix + identifier, nil
+}
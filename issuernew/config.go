@@ -2,25 +2,52 @@ package issuernew
 
 import (
 	"encoding/json"
+	"fmt"
 
 	"github.com/hesusruiz/vcutils/yaml"
 )
 
 type Config struct {
-	ListenAddress          string     `json:"listenAddress,omitempty"`
-	AppName                string     `json:"appName,omitempty"`
-	IssuerURL              string     `json:"issuerURL,omitempty"`
-	IssuerCertificateURL   string     `json:"issuerCertificateURL,omitempty"`
-	SenderName             string     `json:"senderName,omitempty"`
-	SenderAddress          string     `json:"senderAddress,omitempty"`
-	VerifierURL            string     `json:"verifierURL,omitempty"`
-	CallbackPath           string     `json:"callbackPath,omitempty"`
-	Scopes                 string     `json:"scopes,omitempty"`
-	AdminEmail             string     `json:"adminEmail,omitempty"`
-	SMTP                   SMTPConfig `json:"smtp,omitempty"`
-	SamedeviceWallet       string     `json:"samedeviceWallet,omitempty"`
-	CredentialTemplatesDir string     `json:"credentialTemplatesDir,omitempty"`
-	ClientID               string     `json:"clientID,omitempty"`
+	ListenAddress          string           `json:"listenAddress,omitempty"`
+	AppName                string           `json:"appName,omitempty"`
+	IssuerURL              string           `json:"issuerURL,omitempty"`
+	IssuerCertificateURL   string           `json:"issuerCertificateURL,omitempty"`
+	SenderName             string           `json:"senderName,omitempty"`
+	SenderAddress          string           `json:"senderAddress,omitempty"`
+	VerifierURL            string           `json:"verifierURL,omitempty"`
+	CallbackPath           string           `json:"callbackPath,omitempty"`
+	Scopes                 string           `json:"scopes,omitempty"`
+	AdminEmail             string           `json:"adminEmail,omitempty"`
+	SMTP                   SMTPConfig       `json:"smtp,omitempty"`
+	SamedeviceWallet       string           `json:"samedeviceWallet,omitempty"`
+	CredentialTemplatesDir string           `json:"credentialTemplatesDir,omitempty"`
+	ClientID               string           `json:"clientID,omitempty"`
+	SigningKey             SigningKeyConfig `json:"signingKey,omitempty"`
+
+	// OfferMaxAge is the time in seconds a credential offer can be used, and AccessTokenMaxAge the time the access token
+	// to the credential endpoint is valid. When TxCode is true, a PIN is sent by email to accept the offer.
+	OfferMaxAge       int  `json:"offerMaxAge,omitempty"`
+	AccessTokenMaxAge int  `json:"accessTokenMaxAge,omitempty"`
+	TxCode            bool `json:"txCode,omitempty"`
+
+	// DeferredMaxAge is the time in seconds the Wallet can poll for a credential waiting for the signature of the
+	// legal representative. The access token is extended to this time when the issuance is deferred.
+	DeferredMaxAge int `json:"deferredMaxAge,omitempty"`
+}
+
+// SigningKeyConfig specifies the private key and x509 certificate used to sign the credentials
+type SigningKeyConfig struct {
+	// File is a PKCS12 file (.p12 or .pfx) with the key and its certificate chain, or a PEM file with the key
+	File string `json:"file,omitempty"`
+
+	// CertificateFile is a PEM file with the certificate chain, when File is a PEM file without it
+	CertificateFile string `json:"certificateFile,omitempty"`
+
+	// PasswordFile contains the password of the PKCS12 file. If not specified, CERT_PASSWORD is used.
+	PasswordFile string `json:"passwordFile,omitempty"`
+
+	// Algorithm is determined by the key. For RSA keys it can be PS256 instead of the default RS256.
+	Algorithm string `json:"algorithm,omitempty"`
 }
 
 type SMTPConfig struct {
@@ -43,18 +70,37 @@ func ConfigFromMap(cfg *yaml.YAML) (*Config, error) {
 		return nil, err
 	}
 
+	config.SetDefaults()
 	err = config.Validate()
 
 	return config, err
 
 }
 
+// SetDefaults sets the default values of the optional settings not in the configuration
 func (s *Config) SetDefaults() {
-
+	if len(s.CredentialTemplatesDir) == 0 {
+		s.CredentialTemplatesDir = "data/credential_templates"
+	}
+	if s.OfferMaxAge <= 0 {
+		s.OfferMaxAge = 600
+	}
+	if s.AccessTokenMaxAge <= 0 {
+		s.AccessTokenMaxAge = 600
+	}
+	if s.DeferredMaxAge <= 0 {
+		s.DeferredMaxAge = 30 * 24 * 3600
+	}
 }
 
 func (s *Config) Validate() (err error) {
 
+	switch s.SigningKey.Algorithm {
+	case "", "RS256", "PS256", "ES256", "ES384", "ES512", "EdDSA":
+	default:
+		return fmt.Errorf("signingKey: unsupported algorithm %s", s.SigningKey.Algorithm)
+	}
+
 	return nil
 }
 
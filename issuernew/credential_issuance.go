@@ -0,0 +1,130 @@
+package issuernew
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v5"
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/models"
+)
+
+// issueCredentialRequest is the request to offer a credential of any type which can be issued.
+// The claims are validated with the schema of the type, and Email is the address where the offer is sent.
+type issueCredentialRequest struct {
+	Type   string         `json:"type"`
+	Claims map[string]any `json:"claims"`
+	Email  string         `json:"email"`
+}
+
+// issueCredentialBySigner is the route for signers to offer a credential of any type to a holder.
+// The credential is of the organization of the signer.
+func (is *IssuerServer) issueCredentialBySigner(c echo.Context) error {
+
+	signer, err := is.signerFromRequest(c)
+	if err != nil {
+		return err
+	}
+
+	var request issueCredentialRequest
+	if err := c.Bind(&request); err != nil {
+		return apis.NewBadRequestError("invalid request", err)
+	}
+	if len(request.Email) == 0 {
+		return apis.NewBadRequestError("the email of the holder is required", nil)
+	}
+	ct := is.credentialTypes[request.Type]
+	if ct == nil {
+		return apis.NewBadRequestError("unknown credential type '"+request.Type+"'", nil)
+	}
+
+	// The Mandator of the credentials with a mandate is always the organization of the signer
+	if mandate, ok := request.Claims["mandate"].(map[string]any); ok {
+		mandate["mandator"] = signerMandator(signer)
+	}
+
+	actor := credentialActor{role: roleSigner, id: "signer:" + signer.Email()}
+	record, err := is.issueCredential(ct, request.Claims, request.Email, signer.GetString("organizationIdentifier"), actor)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, map[string]any{
+		"id":     record.Id,
+		"type":   ct.ID,
+		"status": record.GetString("status"),
+	})
+}
+
+// signerMandator returns the Mandator of a mandate delegated by the organization of the signer,
+// with the data of the certificate registered for the signer
+func signerMandator(signer *models.Record) map[string]any {
+	mandator := map[string]any{}
+	fields := map[string]string{
+		"organizationIdentifier": signer.GetString("organizationIdentifier"),
+		"organization":           signer.GetString("organization"),
+		"commonName":             signer.GetString("commonName"),
+		"serialNumber":           signer.GetString("serialNumber"),
+		"country":                signer.GetString("country"),
+		"emailAddress":           signer.Email(),
+	}
+	for name, value := range fields {
+		if len(value) > 0 {
+			mandator[name] = value
+		}
+	}
+	return mandator
+}
+
+// issueCredential renders a credential of the type with the claims and offers it to the holder, creating its record
+// in the 'offered' state and sending the offer by email. The credential is sealed by the Issuer until it is bound
+// to the holder.
+func (is *IssuerServer) issueCredential(ct *credentialType, claims map[string]any, email string, organizationIdentifier string, actor credentialActor) (*models.Record, error) {
+
+	credential, err := is.renderCredential(ct, claims)
+	if err != nil {
+		return nil, apis.NewBadRequestError(err.Error(), nil)
+	}
+
+	sealed, err := is.signer.sealCredential(credential, "")
+	if err != nil {
+		return nil, err
+	}
+
+	collection, err := is.App.Dao().FindCollectionByNameOrId("credentials")
+	if err != nil {
+		return nil, err
+	}
+	record := models.NewRecord(collection)
+	record.Set("email", email)
+	record.Set("organizationIdentifier", organizationIdentifier)
+	record.Set("type", "jwt_vc")
+	record.Set("raw", sealed)
+	_, creatorEmail, _ := strings.Cut(actor.id, ":")
+	record.Set("creator_email", creatorEmail)
+
+	if err := is.transitionCredential(record, credentialOffered, actor, ""); err != nil {
+		return nil, err
+	}
+
+	// Send the offer to the holder
+	if err := is.sendLEARCredentialEmail(record.Id); err != nil {
+		log.Printf("error sending the offer of credential %s: %s", record.Id, err.Error())
+	}
+
+	return record, nil
+}
+
+// claimsFromValue returns the claims in a Go value, with the types of values decoded from JSON
+// which are used to validate the claims and render the templates
+func claimsFromValue(v any) (map[string]any, error) {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	claims := map[string]any{}
+	err = json.Unmarshal(raw, &claims)
+	return claims, err
+}
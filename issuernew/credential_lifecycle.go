@@ -0,0 +1,286 @@
+package issuernew
+
+import (
+	"fmt"
+	"log"
+	"slices"
+	"time"
+
+	"github.com/labstack/echo/v5"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/daos"
+	"github.com/pocketbase/pocketbase/models"
+	"github.com/pocketbase/pocketbase/tools/cron"
+)
+
+// The states of the life cycle of a credential, in the 'status' field of the credentials collection:
+//
+//	offered -> holder_bound -> tobesigned -> signed -> revoked / expired
+//
+// A credential is offered when created, and it is bound to a holder when the Wallet proves possession of its key.
+// The Issuer then seals it and it waits for the signature of the legal representative.
+// Credentials can be revoked once they are bound to a holder, and signed credentials expire with their validity.
+const (
+	credentialOffered     = "offered"
+	credentialHolderBound = "holder_bound"
+	credentialToBeSigned  = "tobesigned"
+	credentialSigned      = "signed"
+	credentialRevoked     = "revoked"
+	credentialExpired     = "expired"
+)
+
+// The roles of the actors changing the state of credentials
+const (
+	roleSigner = "signer"
+	roleLEAR   = "lear"
+	roleHolder = "holder"
+	roleIssuer = "issuer"
+)
+
+// The events recorded in the history which are not changes of state
+const (
+	credentialSuspendedEvent   = "suspended"
+	credentialUnsuspendedEvent = "unsuspended"
+)
+
+// The collection with the history of changes of the credentials, which can only be accessed by admins
+const credentialHistoryCollection = "credential_history"
+
+// credentialActor is who changes the state of a credential
+type credentialActor struct {
+	role string
+	id   string
+}
+
+// credentialTransition is a change of state and the roles allowed to make it.
+// An empty 'from' is the creation of the credential.
+type credentialTransition struct {
+	from  string
+	to    string
+	roles []string
+}
+
+var credentialTransitions = []credentialTransition{
+	{"", credentialOffered, []string{roleSigner, roleLEAR}},
+	{credentialOffered, credentialHolderBound, []string{roleHolder}},
+	{credentialHolderBound, credentialToBeSigned, []string{roleIssuer}},
+	{credentialToBeSigned, credentialSigned, []string{roleSigner}},
+	{credentialHolderBound, credentialRevoked, []string{roleSigner, roleLEAR}},
+	{credentialToBeSigned, credentialRevoked, []string{roleSigner, roleLEAR}},
+	{credentialSigned, credentialRevoked, []string{roleSigner, roleLEAR}},
+	{credentialSigned, credentialExpired, []string{roleIssuer}},
+}
+
+// checkCredentialTransition returns an error if the change of state is not allowed to the role
+func checkCredentialTransition(from string, to string, role string) error {
+	for _, t := range credentialTransitions {
+		if t.from != from || t.to != to {
+			continue
+		}
+		if !slices.Contains(t.roles, role) {
+			return apis.NewForbiddenError(fmt.Sprintf("a %s can not change a credential from '%s' to '%s'", role, from, to), nil)
+		}
+		return nil
+	}
+	return apis.NewBadRequestError(fmt.Sprintf("a credential can not change from '%s' to '%s'", from, to), nil)
+}
+
+// transitionCredential changes the state of the credential in the record, saving it with any other change
+// made by the caller and recording the change in the history. The current state is read in the same
+// transaction, so concurrent changes can not skip the checks.
+func (is *IssuerServer) transitionCredential(record *models.Record, to string, actor credentialActor, reason string) error {
+	return is.App.Dao().RunInTransaction(func(txDao *daos.Dao) error {
+		from := ""
+		if !record.IsNew() {
+			current, err := txDao.FindRecordById("credentials", record.Id)
+			if err != nil {
+				return err
+			}
+			from = current.GetString("status")
+		}
+
+		if err := checkCredentialTransition(from, to, actor.role); err != nil {
+			return err
+		}
+
+		record.Set("status", to)
+		if err := txDao.SaveRecord(record); err != nil {
+			return err
+		}
+		return is.addCredentialHistory(txDao, record.Id, from, to, to, actor, reason)
+	})
+}
+
+// addCredentialHistory records an event in the history of the credential
+func (is *IssuerServer) addCredentialHistory(dao *daos.Dao, credentialID string, from string, to string, event string, actor credentialActor, reason string) error {
+	collection, err := dao.FindCollectionByNameOrId(credentialHistoryCollection)
+	if err != nil {
+		return err
+	}
+
+	entry := models.NewRecord(collection)
+	entry.Set("credential", credentialID)
+	entry.Set("from_status", from)
+	entry.Set("to_status", to)
+	entry.Set("event", event)
+	entry.Set("role", actor.role)
+	entry.Set("actor", actor.id)
+	entry.Set("reason", reason)
+
+	return dao.SaveRecord(entry)
+}
+
+// The fields of the credentials which can only be changed by the Issuer, and not with the PocketBase API
+var protectedCredentialFields = []string{
+	"status_list_index", "revoked", "suspended", "status_reason", "status_actor", "status_updated",
+}
+
+// apiCredentialActor returns the actor of a request to the PocketBase API. Only signers and admins can
+// change the credentials with the API, and admins act as signers.
+func apiCredentialActor(c echo.Context) (credentialActor, error) {
+	info := apis.RequestInfo(c)
+	if info.Admin != nil {
+		return credentialActor{role: roleSigner, id: "admin:" + info.Admin.Email}, nil
+	}
+	if info.AuthRecord != nil && info.AuthRecord.Collection().Name == "signers" {
+		return credentialActor{role: roleSigner, id: "signer:" + info.AuthRecord.Email()}, nil
+	}
+	return credentialActor{}, apis.NewForbiddenError("only signers can change credentials", nil)
+}
+
+// addCredentialLifecycleHooks enforces the life cycle of the credentials created or updated with the PocketBase API,
+// recording the changes of state in the history
+func (is *IssuerServer) addCredentialLifecycleHooks() {
+	app := is.App
+
+	app.OnRecordBeforeCreateRequest("credentials").Add(func(e *core.RecordCreateEvent) error {
+		actor, err := apiCredentialActor(e.HttpContext)
+		if err != nil {
+			return err
+		}
+		for _, field := range protectedCredentialFields {
+			if !isZeroValue(e.Record.Get(field)) {
+				return apis.NewBadRequestError("the field "+field+" can not be set", nil)
+			}
+		}
+		return checkCredentialTransition("", e.Record.GetString("status"), actor.role)
+	})
+
+	app.OnRecordAfterCreateRequest("credentials").Add(func(e *core.RecordCreateEvent) error {
+		actor, _ := apiCredentialActor(e.HttpContext)
+		status := e.Record.GetString("status")
+		return is.addCredentialHistory(app.Dao(), e.Record.Id, "", status, status, actor, "")
+	})
+
+	app.OnRecordBeforeUpdateRequest("credentials").Add(func(e *core.RecordUpdateEvent) error {
+		actor, err := apiCredentialActor(e.HttpContext)
+		if err != nil {
+			return err
+		}
+
+		original := e.Record.OriginalCopy()
+		for _, field := range protectedCredentialFields {
+			if fmt.Sprint(original.Get(field)) != fmt.Sprint(e.Record.Get(field)) {
+				return apis.NewBadRequestError("the field "+field+" can not be changed", nil)
+			}
+		}
+
+		from, to := original.GetString("status"), e.Record.GetString("status")
+		if from == to {
+			// Only credentials still waiting for the signature can be modified without a change of state
+			if from != credentialOffered && from != credentialToBeSigned {
+				return apis.NewBadRequestError("a credential in state '"+from+"' can not be modified", nil)
+			}
+			return nil
+		}
+
+		// Revocation requires a reason and updates the status lists, so it is only done with the routes for it
+		if to == credentialRevoked {
+			return apis.NewBadRequestError("credentials can only be revoked with the revocation routes", nil)
+		}
+		return checkCredentialTransition(from, to, actor.role)
+	})
+
+	app.OnRecordAfterUpdateRequest("credentials").Add(func(e *core.RecordUpdateEvent) error {
+		from, to := e.Record.OriginalCopy().GetString("status"), e.Record.GetString("status")
+		if from == to {
+			return nil
+		}
+		actor, _ := apiCredentialActor(e.HttpContext)
+		return is.addCredentialHistory(app.Dao(), e.Record.Id, from, to, to, actor, "")
+	})
+
+	// Credentials can only be deleted before they are bound to a holder
+	app.OnRecordBeforeDeleteRequest("credentials").Add(func(e *core.RecordDeleteEvent) error {
+		if status := e.Record.GetString("status"); status != credentialOffered {
+			return apis.NewBadRequestError("a credential in state '"+status+"' can not be deleted", nil)
+		}
+		return nil
+	})
+}
+
+// isZeroValue reports if a field of a record has the zero value of its type
+func isZeroValue(v any) bool {
+	switch v := v.(type) {
+	case nil:
+		return true
+	case string:
+		return len(v) == 0
+	case bool:
+		return !v
+	case float64:
+		return v == 0
+	case int:
+		return v == 0
+	default:
+		return len(fmt.Sprint(v)) == 0
+	}
+}
+
+// startCredentialExpiration checks every hour the signed credentials which have expired
+func (is *IssuerServer) startCredentialExpiration() {
+	c := cron.New()
+	c.MustAdd("expireCredentials", "0 * * * *", func() {
+		if err := is.expireCredentials(); err != nil {
+			log.Println("expiring credentials:", err)
+		}
+	})
+	c.Start()
+}
+
+// expireCredentials moves to the 'expired' state the signed credentials whose validity has ended
+func (is *IssuerServer) expireCredentials() error {
+	records, err := is.App.Dao().FindRecordsByExpr("credentials", dbx.HashExp{"status": credentialSigned})
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, record := range records {
+		expiration, ok := credentialExpiration(record)
+		if !ok || now.Before(expiration) {
+			continue
+		}
+		if err := is.transitionCredential(record, credentialExpired, credentialActor{role: roleIssuer}, "validity period ended"); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// credentialExpiration returns the end of the validity of the credential in the record, from the
+// 'exp' claim of the JWT
+func credentialExpiration(record *models.Record) (time.Time, bool) {
+	payload, err := credentialPayload(record)
+	if err != nil {
+		return time.Time{}, false
+	}
+	exp, ok := payload["exp"].(float64)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(exp), 0), true
+}
@@ -0,0 +1,105 @@
+package issuernew
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/pocketbase/pocketbase/apis"
+)
+
+func TestCheckCredentialTransition(t *testing.T) {
+	tests := []struct {
+		name       string
+		from       string
+		to         string
+		role       string
+		wantStatus int
+	}{
+		{
+			name: "signer creates a credential",
+			from: "",
+			to:   credentialOffered,
+			role: roleSigner,
+		},
+		{
+			name:       "holder can not create a credential",
+			from:       "",
+			to:         credentialOffered,
+			role:       roleHolder,
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name: "holder binds an offered credential",
+			from: credentialOffered,
+			to:   credentialHolderBound,
+			role: roleHolder,
+		},
+		{
+			name:       "signer can not bind the credential to a holder",
+			from:       credentialOffered,
+			to:         credentialHolderBound,
+			role:       roleSigner,
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name: "signer signs a credential",
+			from: credentialToBeSigned,
+			to:   credentialSigned,
+			role: roleSigner,
+		},
+		{
+			name:       "issuer can not sign a credential",
+			from:       credentialToBeSigned,
+			to:         credentialSigned,
+			role:       roleIssuer,
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name: "LEAR revokes a signed credential",
+			from: credentialSigned,
+			to:   credentialRevoked,
+			role: roleLEAR,
+		},
+		{
+			name:       "offered credential can not be signed",
+			from:       credentialOffered,
+			to:         credentialSigned,
+			role:       roleSigner,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "revoked credential can not be signed again",
+			from:       credentialRevoked,
+			to:         credentialSigned,
+			role:       roleSigner,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "expired credential can not be revoked",
+			from:       credentialExpired,
+			to:         credentialRevoked,
+			role:       roleSigner,
+			wantStatus: http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkCredentialTransition(tt.from, tt.to, tt.role)
+			if tt.wantStatus == 0 {
+				if err != nil {
+					t.Errorf("checkCredentialTransition() error = %v, want nil", err)
+				}
+				return
+			}
+
+			var apiErr *apis.ApiError
+			if !errors.As(err, &apiErr) {
+				t.Fatalf("checkCredentialTransition() error = %v, want an API error", err)
+			}
+			if apiErr.Code != tt.wantStatus {
+				t.Errorf("checkCredentialTransition() status = %v, want %v", apiErr.Code, tt.wantStatus)
+			}
+		})
+	}
+}
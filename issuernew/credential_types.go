@@ -0,0 +1,278 @@
+package issuernew
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	htmltemplate "html/template"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/Masterminds/sprig/v3"
+	"github.com/evidenceledger/vcdemo/types"
+	"github.com/hesusruiz/vcutils/yaml"
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+// The validity of the credentials of a type which does not specify it
+const defaultValidityDays = 365
+
+// The claim with the DID of the holder in the credentials of a type which does not specify it
+const defaultHolderClaim = "credentialSubject.id"
+
+// credentialType is a type of credential that the Issuer can issue. Each type is described by a YAML file
+// in CredentialTemplatesDir, and the credential is rendered with the template named as the type in the
+// '.tpl' file with the same name as the YAML file.
+type credentialType struct {
+	// ID is the identifier of the credential configuration in the metadata of the Issuer
+	ID     string   `json:"id"`
+	Format string   `json:"format"`
+	Type   []string `json:"type"`
+
+	// Display is the information used by the Wallets to display the credential
+	Display []credentialDisplay `json:"display,omitempty"`
+
+	// CredentialSubject has the display information of the claims, using the structure of the credentialSubject
+	CredentialSubject map[string]any `json:"credentialSubject,omitempty"`
+
+	// Schema is the JSON Schema of the claims received to issue a credential, which are passed to the template
+	Schema map[string]any `json:"schema"`
+
+	// ValidityDays is the validity of the credentials, from their issuance
+	ValidityDays int `json:"validityDays,omitempty"`
+
+	// HolderClaim is the path of the claim which is set to the DID of the holder when the credential is bound to it
+	HolderClaim string `json:"holderClaim,omitempty"`
+
+	// templateFile is the file with the template to render the credential, and templateText its contents
+	templateFile string
+	templateText string
+
+	schema *jsonschema.Schema
+}
+
+// credentialDisplay is the display information of a credential in a given locale, as defined in OID4VCI
+type credentialDisplay struct {
+	Name            string `json:"name"`
+	Locale          string `json:"locale,omitempty"`
+	Description     string `json:"description,omitempty"`
+	BackgroundColor string `json:"background_color,omitempty"`
+	TextColor       string `json:"text_color,omitempty"`
+	Logo            *struct {
+		URI     string `json:"uri"`
+		AltText string `json:"alt_text,omitempty"`
+	} `json:"logo,omitempty"`
+}
+
+// The credential formats supported by the Issuer
+var supportedCredentialFormats = []string{"jwt_vc_json"}
+
+// loadCredentialTypes reads the descriptions of the credential types in the directory, checking that
+// each one has a template which can be parsed.
+func loadCredentialTypes(dir string) (map[string]*credentialType, error) {
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.yaml"))
+	if err != nil {
+		return nil, err
+	}
+
+	credentialTypes := map[string]*credentialType{}
+	for _, fileName := range files {
+		ct, err := loadCredentialType(fileName)
+		if err != nil {
+			return nil, fmt.Errorf("credential type %s: %w", fileName, err)
+		}
+		if credentialTypes[ct.ID] != nil {
+			return nil, fmt.Errorf("credential type %s: duplicated id %s", fileName, ct.ID)
+		}
+		credentialTypes[ct.ID] = ct
+	}
+
+	if len(credentialTypes) == 0 {
+		return nil, fmt.Errorf("no credential types found in %s", dir)
+	}
+
+	return credentialTypes, nil
+}
+
+// loadCredentialType reads the description of a credential type and checks its template
+func loadCredentialType(fileName string) (*credentialType, error) {
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	y, err := yaml.ParseYaml(string(data))
+	if err != nil {
+		return nil, err
+	}
+	raw, err := json.Marshal(y.Data())
+	if err != nil {
+		return nil, err
+	}
+	ct := &credentialType{}
+	if err := json.Unmarshal(raw, ct); err != nil {
+		return nil, err
+	}
+
+	if len(ct.ID) == 0 {
+		return nil, fmt.Errorf("id is required")
+	}
+	if len(ct.Format) == 0 {
+		ct.Format = supportedCredentialFormats[0]
+	}
+	if !slices.Contains(supportedCredentialFormats, ct.Format) {
+		return nil, fmt.Errorf("unsupported format %s", ct.Format)
+	}
+	if len(ct.Type) == 0 {
+		ct.Type = []string{"VerifiableCredential", ct.ID}
+	}
+	if ct.ValidityDays == 0 {
+		ct.ValidityDays = defaultValidityDays
+	}
+	if ct.ValidityDays < 0 {
+		return nil, fmt.Errorf("validityDays must be positive")
+	}
+	if len(ct.HolderClaim) == 0 {
+		ct.HolderClaim = defaultHolderClaim
+	}
+
+	// The claims to issue a credential must always be validated
+	if len(ct.Schema) == 0 {
+		return nil, fmt.Errorf("schema is required")
+	}
+	schema, err := json.Marshal(ct.Schema)
+	if err != nil {
+		return nil, err
+	}
+	compiler := jsonschema.NewCompiler()
+	compiler.AssertFormat = true
+	if err := compiler.AddResource(ct.ID+".schema.json", bytes.NewReader(schema)); err != nil {
+		return nil, err
+	}
+	ct.schema, err = compiler.Compile(ct.ID + ".schema.json")
+	if err != nil {
+		return nil, fmt.Errorf("invalid schema: %w", err)
+	}
+
+	// The template must define a template named as the credential type
+	ct.templateFile = strings.TrimSuffix(fileName, filepath.Ext(fileName)) + ".tpl"
+	tpl, err := template.New(filepath.Base(ct.templateFile)).Funcs(sprig.TxtFuncMap()).ParseFiles(ct.templateFile)
+	if err != nil {
+		return nil, err
+	}
+	if tpl.Lookup(ct.ID) == nil {
+		return nil, fmt.Errorf("template %s does not define %s", ct.templateFile, ct.ID)
+	}
+	text, err := os.ReadFile(ct.templateFile)
+	if err != nil {
+		return nil, err
+	}
+	ct.templateText = string(text)
+
+	return ct, nil
+}
+
+// credentialTemplateFuncs replace the JSON functions of sprig in the template registry of the Issuer.
+// The registry escapes the output of the templates as HTML, and the credentials are JSON which must not be escaped.
+var credentialTemplateFuncs = map[string]any{
+	"toJson": func(v any) htmltemplate.HTML {
+		out, _ := json.Marshal(v)
+		return htmltemplate.HTML(out)
+	},
+	"toPrettyJson": func(v any) htmltemplate.HTML {
+		out, _ := json.MarshalIndent(v, "", "  ")
+		return htmltemplate.HTML(out)
+	},
+	"toRawJson": func(v any) htmltemplate.HTML {
+		var buf bytes.Buffer
+		enc := json.NewEncoder(&buf)
+		enc.SetEscapeHTML(false)
+		_ = enc.Encode(v)
+		return htmltemplate.HTML(strings.TrimSuffix(buf.String(), "\n"))
+	},
+}
+
+// validateClaims checks the claims to issue a credential of the type against its schema.
+// The claims must have the types of values decoded from JSON.
+func (ct *credentialType) validateClaims(claims map[string]any) error {
+	if err := ct.schema.Validate(claims); err != nil {
+		return fmt.Errorf("invalid claims for %s: %w", ct.ID, err)
+	}
+	return nil
+}
+
+// renderCredential creates a credential of the type with the claims, rendering the template of the type with the
+// template registry of the Issuer. The template receives the claims, the id of the credential, the DID of the
+// Issuer and the dates of the validity of the credential.
+func (is *IssuerServer) renderCredential(ct *credentialType, claims map[string]any) (map[string]any, error) {
+	if err := ct.validateClaims(claims); err != nil {
+		return nil, err
+	}
+
+	issuerDID, err := types.ELSIDIDFromCertificate(is.signer.certificate)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	data := map[string]any{
+		"jti":        newRandomString(),
+		"issuerDID":  issuerDID,
+		"validFrom":  now.Format(time.RFC3339),
+		"validUntil": now.AddDate(0, 0, ct.ValidityDays).Format(time.RFC3339),
+		"claims":     claims,
+	}
+
+	// The template file only has definitions, so the one of the type is called explicitly
+	text, err := is.treg.LoadString(ct.templateText + `{{template "` + ct.ID + `" .}}`).Render(data)
+	if err != nil {
+		return nil, fmt.Errorf("rendering %s: %w", ct.ID, err)
+	}
+
+	credential := map[string]any{}
+	if err := json.Unmarshal([]byte(text), &credential); err != nil {
+		return nil, fmt.Errorf("the template of %s does not render valid JSON: %w", ct.ID, err)
+	}
+
+	return credential, nil
+}
+
+// credentialHolder returns the DID of the holder in the credential, in the claim of the type for it
+func (ct *credentialType) credentialHolder(credential map[string]any) string {
+	path := strings.Split(ct.HolderClaim, ".")
+	var value any = credential
+	for _, key := range path {
+		m, ok := value.(map[string]any)
+		if !ok {
+			return ""
+		}
+		value = m[key]
+	}
+	holder, _ := value.(string)
+	return holder
+}
+
+// setCredentialHolder sets the DID of the holder in the claim of the type for it, creating the objects
+// in the path which do not exist
+func (ct *credentialType) setCredentialHolder(credential map[string]any, holderDID string) error {
+	path := strings.Split(ct.HolderClaim, ".")
+	m := credential
+	for _, key := range path[:len(path)-1] {
+		next, found := m[key]
+		if !found {
+			next = map[string]any{}
+			m[key] = next
+		}
+		nextMap, ok := next.(map[string]any)
+		if !ok {
+			return fmt.Errorf("the holder claim %s of %s is not an object", ct.HolderClaim, ct.ID)
+		}
+		m = nextMap
+	}
+	m[path[len(path)-1]] = holderDID
+	return nil
+}
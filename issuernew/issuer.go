@@ -5,7 +5,6 @@ import (
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
-	"crypto/rsa"
 	"crypto/x509"
 	"database/sql"
 	"encoding/base64"
@@ -60,6 +59,12 @@ type IssuerServer struct {
 	treg              *pbtemplate.Registry
 	authUser          *types.AuthenticatedUser
 	generalLoginRoute echo.RouteInfo
+
+	// signer is the key and certificate to sign credentials, loaded when the server starts
+	signer *signingKey
+
+	// credentialTypes are the types of credentials which can be issued, described in CredentialTemplatesDir
+	credentialTypes map[string]*credentialType
 }
 
 func New(cfg *my.YAML) *IssuerServer {
@@ -91,10 +96,25 @@ func (is *IssuerServer) Start() error {
 	// Create the HTML templates registry
 	is.treg = pbtemplate.NewRegistry()
 	is.treg.AddFuncs(sprig.FuncMap())
+	is.treg.AddFuncs(credentialTemplateFuncs)
 
 	// Perform initialization of Pocketbase before serving requests
 	app.OnBeforeServe().Add(func(e *core.ServeEvent) error {
 
+		// The Issuer can not work without the key to sign credentials
+		signer, err := loadSigningKey(is.config.SigningKey)
+		if err != nil {
+			return fmt.Errorf("loading the signing key of the Issuer: %w", err)
+		}
+		is.signer = signer
+		issuerDID, _ := types.ELSIDIDFromCertificate(signer.certificate)
+		log.Println("Sealing credentials as", issuerDID, "with", signer.method.Alg(), "and certificate", signer.certificate.Subject)
+
+		is.credentialTypes, err = loadCredentialTypes(is.config.CredentialTemplatesDir)
+		if err != nil {
+			return err
+		}
+
 		dao := e.App.Dao()
 
 		// The configured TCP address for the server to listen
@@ -116,7 +136,7 @@ func (is *IssuerServer) Start() error {
 		pbSettings.Smtp.Username = is.config.SMTP.Username
 
 		// Write the settings to the database
-		err := dao.SaveSettings(pbSettings)
+		err = dao.SaveSettings(pbSettings)
 		if err != nil {
 			return err
 		}
@@ -160,6 +180,15 @@ func (is *IssuerServer) Start() error {
 		// Add routes for the LEAR
 		is.addLearRoutes(e)
 
+		// Add the OID4VCI metadata and endpoints for Wallets
+		is.addOID4VCIRoutes(e)
+
+		// Publish the status lists of the credentials
+		is.addStatusListRoutes(e)
+
+		// Move to the 'expired' state the credentials whose validity has ended
+		is.startCredentialExpiration()
+
 		return nil
 	})
 
@@ -274,6 +303,9 @@ func (is *IssuerServer) Start() error {
 		return nil
 	})
 
+	// Enforce the life cycle of the credentials changed with the PocketBase API
+	is.addCredentialLifecycleHooks()
+
 	// Hook to ensure that creation of credentials requires a client x509 certificate
 	app.OnRecordBeforeCreateRequest("credentials").Add(func(e *core.RecordCreateEvent) error {
 		log.Println("OnRecordBeforeCreateRequest(credentials)")
@@ -292,7 +324,7 @@ func (is *IssuerServer) Start() error {
 		log.Println("OnRecordAfterCreateRequest(credentials)")
 
 		status := e.Record.GetString("status")
-		if status == "offered" {
+		if status == credentialOffered {
 
 			// Send an email to the user
 			return is.sendLEARCredentialEmail(e.Record.Id)
@@ -306,14 +338,6 @@ func (is *IssuerServer) Start() error {
 		log.Println("OnRecordAfterUpdateRequest(credentials)")
 
 		status := e.Record.GetString("status")
-		switch status {
-		case "offered":
-			log.Println("Status is OFFERED")
-		case "tobesigned":
-			log.Println("Status is TOBESIGNED")
-		case "signed":
-			log.Println("Status is SIGNED")
-		}
 
 		// Check if the user already exists, to create a new one if needed
 		user, err := app.Dao().FindAuthRecordByEmail("users", e.Record.Email())
@@ -349,7 +373,7 @@ func (is *IssuerServer) Start() error {
 
 		log.Println(user.Email())
 
-		if status == "signed" {
+		if status == credentialSigned {
 
 			// Send an email to the user
 			return is.sendLEARCredentialEmail(e.Record.Id)
@@ -463,39 +487,6 @@ func RequireAdminOrX509Auth() echo.MiddlewareFunc {
 	}
 }
 
-func getConfigPrivateKey() (any, error) {
-
-	return rsa.GenerateKey(rand.Reader, 2048)
-
-	// userHome, err := os.UserHomeDir()
-	// if err != nil {
-	// 	panic(err)
-	// }
-
-	// certFilePath := LookupEnvOrString("CERT_FILE_PATH", filepath.Join(userHome, ".certs", "testcert.pfx"))
-	// password := LookupEnvOrString("CERT_PASSWORD", "")
-	// if len(password) == 0 {
-	// 	passwordFilePath := LookupEnvOrString("CERT_PASSWORD_FILE", filepath.Join(userHome, ".certs", "pass.txt"))
-	// 	passwordBytes, err := os.ReadFile(passwordFilePath)
-	// 	if err != nil {
-	// 		return nil, err
-	// 	}
-	// 	password = string(bytes.TrimSpace(passwordBytes))
-	// }
-
-	// certBinary, err := os.ReadFile(certFilePath)
-	// if err != nil {
-	// 	return nil, err
-	// }
-
-	// privateKey, _, _, err := pkcs12.DecodeChain(certBinary, password)
-	// if err != nil {
-	// 	return nil, err
-	// }
-
-	// return privateKey, nil
-}
-
 func newRandomString() string {
 	newID, _ := uuid.NewRandom()
 	return newID.String()
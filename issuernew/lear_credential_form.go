@@ -0,0 +1,126 @@
+package issuernew
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/evidenceledger/vcdemo/types"
+	val "github.com/invopop/validation"
+	valis "github.com/invopop/validation/is"
+	"github.com/labstack/echo/v5"
+)
+
+// The domain of the powers which a LEAR can delegate with the form
+const learPowerDomain = "DOME"
+
+// The functions of the powers in the form and their actions, as defined in the power catalog of the Verifier
+var learPowerActions = map[string][]string{
+	"Onboarding":      {"execute"},
+	"ProductOffering": {"create", "update", "delete"},
+}
+
+// The prefixes of the fields of each power in the form
+var learFormPowers = []string{"power1:", "power2:"}
+
+// learCredentialForm is the data posted by a LEAR to offer a LEARCredential to an employee of the organization.
+// The Mandator is not in the form, because it is always the organization of the LEAR.
+type learCredentialForm struct {
+	FirstName   string
+	LastName    string
+	Email       string
+	MobilePhone string
+	Powers      []types.Power
+}
+
+// learCredentialFormFromRequest reads the form posted in the request. The powers without any action selected
+// are not delegated.
+func learCredentialFormFromRequest(c echo.Context) (*learCredentialForm, error) {
+	values, err := c.FormValues()
+	if err != nil {
+		return nil, err
+	}
+
+	form := &learCredentialForm{
+		FirstName:   strings.TrimSpace(values.Get("firstName")),
+		LastName:    strings.TrimSpace(values.Get("lastName")),
+		Email:       strings.TrimSpace(values.Get("email")),
+		MobilePhone: strings.TrimSpace(values.Get("mobile_phone")),
+	}
+
+	for _, prefix := range learFormPowers {
+		actions := values[prefix+"action"]
+		if len(actions) == 0 {
+			continue
+		}
+		form.Powers = append(form.Powers, types.Power{
+			Tmf_type:     "Domain",
+			Tmf_domain:   []string{values.Get(prefix + "tmf_domain")},
+			Tmf_function: values.Get(prefix + "tmf_function"),
+			Tmf_action:   actions,
+		})
+	}
+
+	return form, nil
+}
+
+// Validate checks the Mandatee and that the powers are in the catalog
+func (f *learCredentialForm) Validate() error {
+	return val.ValidateStruct(f,
+		val.Field(&f.FirstName, val.Required, val.Length(1, 100)),
+		val.Field(&f.LastName, val.Required, val.Length(1, 100)),
+		val.Field(&f.Email, val.Required, valis.EmailFormat),
+		val.Field(&f.MobilePhone, val.Length(0, 30)),
+		val.Field(&f.Powers, val.Required.Error("at least one power with an action is required"), val.Each(val.By(validateLEARPower))),
+	)
+}
+
+// validateLEARPower checks that the function of the power is in the catalog, with its domain and actions
+func validateLEARPower(value any) error {
+	power, ok := value.(types.Power)
+	if !ok {
+		return fmt.Errorf("invalid power")
+	}
+
+	actions, found := learPowerActions[power.Tmf_function]
+	if !found {
+		return fmt.Errorf("unknown function '%s'", power.Tmf_function)
+	}
+	if len(power.Tmf_domain) != 1 || power.Tmf_domain[0] != learPowerDomain {
+		return fmt.Errorf("the domain of %s must be %s", power.Tmf_function, learPowerDomain)
+	}
+	for _, action := range power.Tmf_action {
+		if !slices.Contains(actions, action) {
+			return fmt.Errorf("%s does not have the action '%s'", power.Tmf_function, action)
+		}
+	}
+
+	return nil
+}
+
+// mandate returns the Mandate with the data of the form, where the Mandator is the organization of the LEAR
+func (f *learCredentialForm) mandate(authUser *types.AuthenticatedUser) types.Mandate {
+	var mandate types.Mandate
+
+	mandate.Mandator.OrganizationIdentifier = authUser.OrganizationIdentifier
+	mandate.Mandator.Organization = authUser.Organization
+	mandate.Mandator.Country = organizationCountry(authUser.OrganizationIdentifier)
+
+	mandate.Mandatee.FirstName = f.FirstName
+	mandate.Mandatee.LastName = f.LastName
+	mandate.Mandatee.Email = f.Email
+	mandate.Mandatee.Mobile_phone = f.MobilePhone
+
+	mandate.Power = f.Powers
+
+	return mandate
+}
+
+// organizationCountry returns the country of an organizationIdentifier with the semantics of ETSI EN 319 412-1,
+// like VATES-B12345678, or an empty string if it does not have that format
+func organizationCountry(organizationIdentifier string) string {
+	if len(organizationIdentifier) < 6 || organizationIdentifier[5] != '-' {
+		return ""
+	}
+	return organizationIdentifier[3:5]
+}
@@ -144,6 +144,8 @@ var templateLEARCredentialOffer = `
 
                         <p>With your Wallet in your mobile, scan the QR code below and click the button to save it to your Wallet.
                         </p>
+
+                        {{txcode_notice}}
                 
                         <figure class="w3-margin">
                             <img src="{{credentialqrcode}}" alt="QR code">
@@ -166,7 +168,14 @@ var templateLEARCredentialOffer = `
 </html>
 `
 
-func renderLEARCredentialOffer(credentialRecord *models.Record, walletQRcode, credentialQRcode, sameDeviceCredentialHref, samedeviceWallet string) string {
+func renderLEARCredentialOffer(credentialRecord *models.Record, walletQRcode, credentialQRcode, sameDeviceCredentialHref, samedeviceWallet string, txCode bool) string {
+
+	// The offer can be used only once and for a limited time, and may require the PIN sent by email
+	txCodeNotice := "<p>The offer can be used only once, and expires in a few minutes. Reload this page to get a new one.</p>"
+	if txCode {
+		txCodeNotice = "<p>When the Wallet asks for a PIN, enter the one we have just sent to your email. " +
+			"The offer can be used only once, and expires in a few minutes. Reload this page to get a new one.</p>"
+	}
 
 	t := fasttemplate.New(templateLEARCredentialOffer, "{{", "}}")
 	html := t.ExecuteString(map[string]any{
@@ -174,6 +183,7 @@ func renderLEARCredentialOffer(credentialRecord *models.Record, walletQRcode, cr
 		"credentialqrcode":         credentialQRcode,
 		"sameDeviceCredentialHref": sameDeviceCredentialHref,
 		"samedeviceWallet":         samedeviceWallet,
+		"txcode_notice":            txCodeNotice,
 		"creator_email":            credentialRecord.GetString("creator_email"),
 		"status":                   credentialRecord.GetString("status"),
 		"created":                  credentialRecord.GetString("created"),
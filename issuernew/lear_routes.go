@@ -5,7 +5,6 @@ import (
 	"crypto/rand"
 	"encoding/json"
 	"io"
-	"log"
 	"log/slog"
 	"net/http"
 	"os"
@@ -18,7 +17,6 @@ import (
 	"github.com/labstack/echo/v5"
 	"github.com/labstack/echo/v5/middleware"
 	"github.com/pocketbase/dbx"
-	"github.com/pocketbase/pocketbase/apis"
 	"github.com/pocketbase/pocketbase/core"
 	"github.com/pocketbase/pocketbase/forms"
 	"github.com/pocketbase/pocketbase/models"
@@ -247,6 +245,12 @@ func (is *IssuerServer) addLearRoutes(e *core.ServeEvent) {
 	learGroup.GET("/credentialform", is.displayLEARCredentialForm)
 	learGroup.POST("/credentialform", is.processLEARCredentialForm)
 
+	// ***************************************************
+	// Change the status of a credential of the organization of the LEAR
+	learGroup.POST("/revokecredential/:credid", is.changeCredentialStatusByLEAR(statusActionRevoke))
+	learGroup.POST("/suspendcredential/:credid", is.changeCredentialStatusByLEAR(statusActionSuspend))
+	learGroup.POST("/unsuspendcredential/:credid", is.changeCredentialStatusByLEAR(statusActionUnsuspend))
+
 }
 
 // Middleware for the LEAR routes to check authenticated LEAR.
@@ -333,19 +337,29 @@ func (is *IssuerServer) processLEARCredentialForm(c echo.Context) error {
 		return err
 	}
 
-	info := apis.RequestInfo(c)
-
-	// We received the body data in form of a map[string]any
-	data := info.Data
+	form, err := learCredentialFormFromRequest(c)
+	if err != nil {
+		return Render(c, http.StatusBadRequest, usertpl.Error("Invalid form"))
+	}
+	if err := form.Validate(); err != nil {
+		return Render(c, http.StatusBadRequest, usertpl.Error("The form is invalid: "+err.Error()))
+	}
 
-	// Serialize to JSON
-	raw, err := json.MarshalIndent(data, "", "  ")
+	// Offer the LEARCredential to the employee, where the Mandator is the organization of the LEAR
+	mandate, err := claimsFromValue(form.mandate(authUser))
 	if err != nil {
 		return err
 	}
-	log.Println("RAW", string(raw))
+	ct := is.credentialTypes["LEARCredentialEmployee"]
+	if ct == nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "the LEARCredentialEmployee type is not configured")
+	}
+	actor := credentialActor{role: roleLEAR, id: "lear:" + authUser.Email}
+	if _, err := is.issueCredential(ct, map[string]any{"mandate": mandate}, form.Email, authUser.OrganizationIdentifier, actor); err != nil {
+		return err
+	}
 
-	return Render(c, http.StatusOK, usertpl.FormLEARCredential(authUser))
+	return c.Redirect(http.StatusSeeOther, learGroupPrefix+"/learRetrieveAllCredentials")
 
 }
 
@@ -357,9 +371,12 @@ func (is *IssuerServer) learRetrieveAllCredentials(c echo.Context) error {
 		return err
 	}
 
-	// Retrieve all records which can be signed by the user and in the state 'tobesigned'
-	expr1 := dbx.HashExp{"organizationIdentifier": authUser.OrganizationIdentifier, "status": "tobesigned"}
-	records, err := is.App.Dao().FindRecordsByExpr("credentials", expr1)
+	// Retrieve all credentials of the organization of the user, the most recent first
+	records := []*models.Record{}
+	err = is.App.Dao().RecordQuery("credentials").
+		AndWhere(dbx.HashExp{"organizationIdentifier": authUser.OrganizationIdentifier}).
+		OrderBy("created DESC").
+		All(&records)
 	if err != nil {
 		return err
 	}
@@ -425,6 +442,8 @@ func (is *IssuerServer) requireLEAR(c echo.Context) (authUser *types.Authenticat
 		authUser.Type = "lear"
 		authUser.Email = authRecord.Email()
 		authUser.OrganizationIdentifier = authRecord.GetString("organizationIdentifier")
+		authUser.Organization = authRecord.GetString("organization")
+		authUser.Name = strings.TrimSpace(authRecord.GetString("first_name") + " " + authRecord.GetString("last_name"))
 	} else {
 		return nil, echo.NewHTTPError(http.StatusForbidden, "Invalid authenticated user")
 	}
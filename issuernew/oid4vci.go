@@ -0,0 +1,103 @@
+package issuernew
+
+import (
+	"net/http"
+	"slices"
+
+	"github.com/labstack/echo/v5"
+	"github.com/labstack/echo/v5/middleware"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+// The endpoints of the Issuer for OpenID for Verifiable Credential Issuance (OID4VCI).
+// The Issuer is also the OAuth Authorization Server issuing the access tokens for the credential endpoint.
+const (
+	credentialIssuerMetadataPath    = "/.well-known/openid-credential-issuer"
+	authorizationServerMetadataPath = "/.well-known/oauth-authorization-server"
+	tokenEndpointPath               = "/token"
+	credentialEndpointPath          = "/credential"
+	deferredCredentialEndpointPath  = "/deferred_credential"
+)
+
+// The grant type of the pre-authorized code flow
+const preAuthorizedCodeGrantType = "urn:ietf:params:oauth:grant-type:pre-authorized_code"
+
+// The algorithms accepted in the proofs of possession of the holders, which use did:key
+var proofSigningAlgorithms = []string{"ES256", "EdDSA"}
+
+// addOID4VCIRoutes adds the metadata and endpoints of OID4VCI. They are used by Wallets from other origins,
+// so they allow CORS.
+func (is *IssuerServer) addOID4VCIRoutes(e *core.ServeEvent) {
+	oid4vci := e.Router.Group("", middleware.CORS())
+
+	oid4vci.GET(credentialIssuerMetadataPath, is.credentialIssuerMetadata)
+	oid4vci.GET(authorizationServerMetadataPath, is.authorizationServerMetadata)
+	oid4vci.GET(credentialOfferPath+":offerid", is.credentialOffer)
+	oid4vci.POST(tokenEndpointPath, is.tokenEndpoint)
+	oid4vci.POST(credentialEndpointPath, is.credentialEndpoint)
+	oid4vci.POST(deferredCredentialEndpointPath, is.deferredCredentialEndpoint)
+}
+
+// credentialConfigurationIDs returns the identifiers of the credential configurations, which are also their scopes
+func (is *IssuerServer) credentialConfigurationIDs() []string {
+	ids := make([]string, 0, len(is.credentialTypes))
+	for id := range is.credentialTypes {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+	return ids
+}
+
+// credentialIssuerMetadata returns the metadata of the Credential Issuer, with the credential
+// configurations generated from the credential types in CredentialTemplatesDir
+func (is *IssuerServer) credentialIssuerMetadata(c echo.Context) error {
+	issuerURL := is.config.IssuerURL
+
+	configurations := map[string]any{}
+	for id, ct := range is.credentialTypes {
+		configurations[id] = map[string]any{
+			"format": ct.Format,
+			"scope":  id,
+			"cryptographic_binding_methods_supported": []string{"did:key"},
+			"credential_signing_alg_values_supported": []string{is.signer.method.Alg()},
+			"proof_types_supported": map[string]any{
+				"jwt": map[string]any{
+					"proof_signing_alg_values_supported": proofSigningAlgorithms,
+				},
+			},
+			"credential_definition": map[string]any{
+				"type":              ct.Type,
+				"credentialSubject": ct.CredentialSubject,
+			},
+			"display": ct.Display,
+		}
+	}
+
+	c.Response().Header().Set("Cache-Control", "public, max-age=3600")
+	return c.JSON(http.StatusOK, map[string]any{
+		"credential_issuer":            issuerURL,
+		"credential_endpoint":          issuerURL + credentialEndpointPath,
+		"deferred_credential_endpoint": issuerURL + deferredCredentialEndpointPath,
+		"display": []map[string]any{
+			{"name": is.config.AppName, "locale": "en"},
+		},
+		"credential_configurations_supported": configurations,
+	})
+}
+
+// authorizationServerMetadata returns the OAuth Authorization Server metadata (RFC 8414).
+// Only the pre-authorized code flow is supported, and Wallets do not need to authenticate to the token endpoint.
+func (is *IssuerServer) authorizationServerMetadata(c echo.Context) error {
+	issuerURL := is.config.IssuerURL
+
+	c.Response().Header().Set("Cache-Control", "public, max-age=3600")
+	return c.JSON(http.StatusOK, map[string]any{
+		"issuer":                                          issuerURL,
+		"token_endpoint":                                  issuerURL + tokenEndpointPath,
+		"grant_types_supported":                           []string{preAuthorizedCodeGrantType},
+		"response_types_supported":                        []string{},
+		"scopes_supported":                                is.credentialConfigurationIDs(),
+		"token_endpoint_auth_methods_supported":           []string{"none"},
+		"pre-authorized_grant_anonymous_access_supported": true,
+	})
+}
@@ -0,0 +1,380 @@
+package issuernew
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/evidenceledger/vcdemo/internal/did"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/labstack/echo/v5"
+	"github.com/lestrrat-go/jwx/v2/jwk"
+	"github.com/pocketbase/pocketbase/daos"
+	"github.com/pocketbase/pocketbase/models"
+)
+
+// The type of the JWT proving possession of the key of the holder in a credential request
+const proofJWTType = "openid4vci-proof+jwt"
+
+// The clock skew tolerated when checking the 'iat' of the proofs
+const proofMaxClockSkew = 60 * time.Second
+
+// credentialRequest is the body of a request to the credential endpoint.
+// Older versions of our Wallet send the format 'jwt_vc', which is accepted as 'jwt_vc_json'.
+type credentialRequest struct {
+	Format string `json:"format,omitempty"`
+	Proof  *struct {
+		ProofType string `json:"proof_type"`
+		JWT       string `json:"jwt"`
+	} `json:"proof,omitempty"`
+}
+
+// proofClaims are the claims of the proof of possession of the holder
+type proofClaims struct {
+	jwt.RegisteredClaims
+	Nonce string `json:"nonce,omitempty"`
+}
+
+// holderProof is a proof of possession of the key of the holder, which has been verified with the c_nonce
+// of the offer redeemed with the access token. Only the credential endpoint creates it, and it is the only
+// way to act as the holder in the life cycle of a credential.
+type holderProof struct {
+	holderDID string
+	offerID   string
+}
+
+// credentialEndpoint issues the credential of the offer associated to the access token, binding it to the
+// holder that proves possession of its key with a JWT signed over the last c_nonce given to the Wallet.
+// Every response includes a new c_nonce, so a proof can not be replayed.
+// Until the legal representative signs the credential, the response is a transaction id for the
+// deferred credential endpoint.
+func (is *IssuerServer) credentialEndpoint(c echo.Context) error {
+	app := is.App
+
+	offer, err := is.offerFromAccessToken(c.Request())
+	if err != nil {
+		c.Response().Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		return writeOAuthError(c, err)
+	}
+
+	var request credentialRequest
+	if err := echo.BindBody(c, &request); err != nil {
+		return writeOAuthError(c, newOAuthError(http.StatusBadRequest, "invalid_request", "invalid credential request"))
+	}
+	if len(request.Format) > 0 && request.Format != "jwt_vc" && !slices.Contains(supportedCredentialFormats, request.Format) {
+		return writeOAuthError(c, newOAuthError(http.StatusBadRequest, "unsupported_credential_format", request.Format))
+	}
+
+	// Check the proof, and consume the c_nonce even if the proof is not valid
+	var holderDID, nonce string
+	var proofErr error
+	if request.Proof == nil || request.Proof.ProofType != "jwt" || len(request.Proof.JWT) == 0 {
+		proofErr = fmt.Errorf("a proof of type jwt is required")
+	} else {
+		holderDID, nonce, proofErr = is.verifyProof(request.Proof.JWT)
+	}
+
+	cNonce, nonceValid, err := is.rotateCNonce(offer.Id, nonce)
+	if err != nil {
+		return writeOAuthError(c, err)
+	}
+	if proofErr == nil && !nonceValid {
+		proofErr = fmt.Errorf("invalid or expired c_nonce")
+	}
+	if proofErr != nil {
+		oerr := newOAuthError(http.StatusBadRequest, "invalid_proof", proofErr.Error())
+		oerr.CNonce = cNonce
+		oerr.CNonceExpiresIn = is.config.AccessTokenMaxAge
+		return writeOAuthError(c, oerr)
+	}
+
+	record, err := app.Dao().FindRecordById("credentials", offer.GetString("credential"))
+	if err != nil {
+		return writeOAuthError(c, err)
+	}
+
+	credential, ct, err := is.decodeCredential(record)
+	if err != nil {
+		return writeOAuthError(c, err)
+	}
+
+	// A credential already signed by the legal representative can only be retrieved by the holder it is bound to
+	if record.GetString("status") == credentialSigned {
+		if ct.credentialHolder(credential) != holderDID {
+			return writeOAuthError(c, newOAuthError(http.StatusBadRequest, "invalid_request", "the credential is bound to another holder"))
+		}
+
+		c.Response().Header().Set("Cache-Control", "no-store")
+		return c.JSON(http.StatusOK, map[string]any{
+			"credential":         record.GetString("raw"),
+			"c_nonce":            cNonce,
+			"c_nonce_expires_in": is.config.AccessTokenMaxAge,
+		})
+	}
+
+	// The legal representative has to sign the credential after it is bound to the holder, so the issuance is deferred
+	proof := holderProof{holderDID: holderDID, offerID: offer.Id}
+	if err := is.bindCredentialToHolder(record, credential, ct, proof); err != nil {
+		return writeOAuthError(c, err)
+	}
+
+	transactionID, err := is.deferIssuance(offer.Id)
+	if err != nil {
+		return writeOAuthError(c, err)
+	}
+
+	c.Response().Header().Set("Cache-Control", "no-store")
+	return c.JSON(http.StatusAccepted, map[string]any{
+		"transaction_id":     transactionID,
+		"c_nonce":            cNonce,
+		"c_nonce_expires_in": is.config.AccessTokenMaxAge,
+	})
+}
+
+// deferIssuance creates the transaction id that the Wallet uses to poll the deferred credential endpoint,
+// and extends the access token so it can be used until the legal representative signs the credential
+func (is *IssuerServer) deferIssuance(offerID string) (string, error) {
+	transactionID := randomToken()
+
+	err := is.App.Dao().RunInTransaction(func(txDao *daos.Dao) error {
+		offer, err := txDao.FindRecordById(credentialOffersCollection, offerID)
+		if err != nil {
+			return err
+		}
+		offer.Set("transaction_id_hash", tokenHash(transactionID))
+		offer.Set("access_token_expires", time.Now().Add(time.Duration(is.config.DeferredMaxAge)*time.Second))
+		return txDao.SaveRecord(offer)
+	})
+
+	return transactionID, err
+}
+
+// The interval in seconds that Wallets should wait before polling again for a deferred credential
+const deferredPollingInterval = 5
+
+// deferredCredentialEndpoint returns the credential of a deferred issuance once it has been signed by the
+// legal representative, or 'issuance_pending' while it is waiting for the signature
+func (is *IssuerServer) deferredCredentialEndpoint(c echo.Context) error {
+	app := is.App
+
+	offer, err := is.offerFromAccessToken(c.Request())
+	if err != nil {
+		c.Response().Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		return writeOAuthError(c, err)
+	}
+
+	var request struct {
+		TransactionID string `json:"transaction_id"`
+	}
+	if err := echo.BindBody(c, &request); err != nil || len(request.TransactionID) == 0 {
+		return writeOAuthError(c, newOAuthError(http.StatusBadRequest, "invalid_request", "transaction_id is required"))
+	}
+
+	transactionIDHash := offer.GetString("transaction_id_hash")
+	if len(transactionIDHash) == 0 ||
+		subtle.ConstantTimeCompare([]byte(tokenHash(request.TransactionID)), []byte(transactionIDHash)) != 1 {
+		return writeOAuthError(c, newOAuthError(http.StatusBadRequest, "invalid_transaction_id", ""))
+	}
+
+	record, err := app.Dao().FindRecordById("credentials", offer.GetString("credential"))
+	if err != nil {
+		return writeOAuthError(c, newOAuthError(http.StatusBadRequest, "invalid_transaction_id", "credential not found"))
+	}
+
+	switch record.GetString("status") {
+	case credentialHolderBound, credentialToBeSigned:
+		return writeOAuthError(c, &oauthError{
+			status:      http.StatusBadRequest,
+			Code:        "issuance_pending",
+			Description: "the credential has not yet been signed",
+			Interval:    deferredPollingInterval,
+		})
+	case credentialSigned:
+		// The transaction is finished, so its id can not be used again
+		offer.Set("transaction_id_hash", "")
+		if err := app.Dao().SaveRecord(offer); err != nil {
+			return writeOAuthError(c, err)
+		}
+
+		c.Response().Header().Set("Cache-Control", "no-store")
+		return c.JSON(http.StatusOK, map[string]any{
+			"credential": record.GetString("raw"),
+		})
+	default:
+		return writeOAuthError(c, newOAuthError(http.StatusBadRequest, "invalid_transaction_id", "the credential can not be issued"))
+	}
+}
+
+// offerFromAccessToken returns the offer redeemed with the access token in the Authorization header
+func (is *IssuerServer) offerFromAccessToken(r *http.Request) (*models.Record, error) {
+	invalidToken := newOAuthError(http.StatusUnauthorized, "invalid_token", "invalid or expired access token")
+
+	accessToken, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !found || len(accessToken) == 0 {
+		return nil, invalidToken
+	}
+
+	offer, err := is.App.Dao().FindFirstRecordByData(credentialOffersCollection, "access_token_hash", tokenHash(accessToken))
+	if err != nil {
+		return nil, invalidToken
+	}
+	if time.Now().After(offer.GetDateTime("access_token_expires").Time()) {
+		return nil, invalidToken
+	}
+
+	return offer, nil
+}
+
+// rotateCNonce replaces the c_nonce of the offer with a new one, reporting if the previous one was
+// the expected nonce and had not expired. It is done in a transaction, so a nonce is accepted only once.
+func (is *IssuerServer) rotateCNonce(offerID string, expected string) (cNonce string, valid bool, err error) {
+	cNonce = randomToken()
+
+	err = is.App.Dao().RunInTransaction(func(txDao *daos.Dao) error {
+		offer, err := txDao.FindRecordById(credentialOffersCollection, offerID)
+		if err != nil {
+			return err
+		}
+
+		now := time.Now()
+		valid = len(expected) > 0 &&
+			subtle.ConstantTimeCompare([]byte(expected), []byte(offer.GetString("c_nonce"))) == 1 &&
+			now.Before(offer.GetDateTime("c_nonce_expires").Time())
+
+		offer.Set("c_nonce", cNonce)
+		offer.Set("c_nonce_expires", now.Add(time.Duration(is.config.AccessTokenMaxAge)*time.Second))
+		return txDao.SaveRecord(offer)
+	})
+
+	return cNonce, valid, err
+}
+
+// verifyProof checks the signature of the proof with the key of the holder, identified with a did:key in 'kid' or
+// with a 'jwk', and checks that the proof is for this Issuer and is recent. It returns the DID of the holder and
+// the nonce in the proof, which has to be checked by the caller.
+func (is *IssuerServer) verifyProof(proofJWT string) (holderDID string, nonce string, err error) {
+
+	var claims proofClaims
+	parser := jwt.NewParser(
+		jwt.WithValidMethods(proofSigningAlgorithms),
+		jwt.WithAudience(is.config.IssuerURL),
+		jwt.WithIssuedAt(),
+		jwt.WithLeeway(proofMaxClockSkew),
+	)
+
+	_, err = parser.ParseWithClaims(proofJWT, &claims, func(t *jwt.Token) (any, error) {
+		if typ, _ := t.Header["typ"].(string); typ != proofJWTType {
+			return nil, fmt.Errorf("the type of the proof must be %s", proofJWTType)
+		}
+
+		if kid, _ := t.Header["kid"].(string); len(kid) > 0 {
+			holderDID, _, _ = strings.Cut(kid, "#")
+			return did.PublicKeyFromDIDKey(kid)
+		}
+
+		if header, ok := t.Header["jwk"].(map[string]any); ok {
+			raw, err := json.Marshal(header)
+			if err != nil {
+				return nil, err
+			}
+			key, err := jwk.ParseKey(raw)
+			if err != nil {
+				return nil, fmt.Errorf("parsing jwk of the proof: %w", err)
+			}
+			var publicKey any
+			if err := key.Raw(&publicKey); err != nil {
+				return nil, err
+			}
+			holderDID, err = did.DIDKeyFromPublicKey(publicKey)
+			if err != nil {
+				return nil, err
+			}
+			return publicKey, nil
+		}
+
+		return nil, fmt.Errorf("the proof must have a kid or a jwk")
+	})
+	if err != nil {
+		return "", "", err
+	}
+
+	if claims.IssuedAt == nil {
+		return "", "", fmt.Errorf("the proof must have an iat")
+	}
+	if time.Since(claims.IssuedAt.Time) > time.Duration(is.config.AccessTokenMaxAge)*time.Second+proofMaxClockSkew {
+		return "", "", fmt.Errorf("the proof is too old")
+	}
+
+	return holderDID, claims.Nonce, nil
+}
+
+// The claims of the JWT of a sealed credential which are not part of the credential
+var credentialJWTClaims = []string{"iss", "sub", "aud", "exp", "nbf", "iat", "jti"}
+
+// decodeCredential returns the credential in the JWT stored in the record, and its type
+func (is *IssuerServer) decodeCredential(record *models.Record) (map[string]any, *credentialType, error) {
+	credential, err := credentialPayload(record)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, claim := range credentialJWTClaims {
+		delete(credential, claim)
+	}
+
+	ct := is.credentialTypeOf(credential)
+	if ct == nil {
+		return nil, nil, fmt.Errorf("credential %s is not of a type which can be issued", record.Id)
+	}
+
+	return credential, ct, nil
+}
+
+// bindCredentialToHolder binds the offered credential in the record to the holder of the proof, and seals it again
+// with the certificate of the Issuer so it can be signed by the legal representative. The sealed credential is saved
+// with the binding, and a credential already bound to the same holder is not changed, so the Wallet can retry the request.
+func (is *IssuerServer) bindCredentialToHolder(record *models.Record, credential map[string]any, ct *credentialType, proof holderProof) error {
+
+	// The proof must have been verified for an offer of this credential
+	if len(proof.holderDID) == 0 || len(proof.offerID) == 0 {
+		return newOAuthError(http.StatusBadRequest, "invalid_proof", "a proof of possession is required")
+	}
+	offer, err := is.App.Dao().FindRecordById(credentialOffersCollection, proof.offerID)
+	if err != nil || offer.GetString("credential") != record.Id {
+		return newOAuthError(http.StatusBadRequest, "invalid_proof", "the proof is not for an offer of the credential")
+	}
+	holderDID := proof.holderDID
+
+	switch record.GetString("status") {
+	case credentialOffered:
+		if err := ct.setCredentialHolder(credential, holderDID); err != nil {
+			return err
+		}
+		if err := is.setCredentialStatus(record, credential); err != nil {
+			return err
+		}
+		sealed, err := is.signer.sealCredential(credential, holderDID)
+		if err != nil {
+			return err
+		}
+		record.Set("raw", sealed)
+
+		if err := is.transitionCredential(record, credentialHolderBound, credentialActor{role: roleHolder, id: holderDID}, "proof of possession for offer "+proof.offerID); err != nil {
+			return err
+		}
+	case credentialHolderBound, credentialToBeSigned:
+		if ct.credentialHolder(credential) != holderDID {
+			return newOAuthError(http.StatusBadRequest, "invalid_request", "the credential is bound to another holder")
+		}
+		if record.GetString("status") == credentialToBeSigned {
+			return nil
+		}
+	default:
+		return newOAuthError(http.StatusBadRequest, "invalid_request", "the credential can not be issued")
+	}
+
+	return is.transitionCredential(record, credentialToBeSigned, credentialActor{role: roleIssuer}, "")
+}
@@ -0,0 +1,296 @@
+package issuernew
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/evidenceledger/vcdemo/internal/did"
+	_ "github.com/evidenceledger/vcdemo/migrations"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/lestrrat-go/jwx/v2/jwk"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/migrations"
+	"github.com/pocketbase/pocketbase/models"
+	"github.com/pocketbase/pocketbase/tools/migrate"
+)
+
+const testIssuerURL = "https://issuer.example.com"
+
+func TestVerifyProof(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecDID, err := did.DIDKeyFromPublicKey(&ecKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edPublic, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edDID, err := did.DIDKeyFromPublicKey(edPublic)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	validClaims := func() jwt.MapClaims {
+		return jwt.MapClaims{"aud": testIssuerURL, "iat": now.Unix(), "nonce": "the-nonce"}
+	}
+
+	tests := []struct {
+		name      string
+		proof     string
+		wantDID   string
+		wantNonce string
+		wantErr   bool
+	}{
+		{
+			name:      "P-256 key identified with a did:key",
+			proof:     signProof(t, jwt.SigningMethodES256, ecKey, map[string]any{"kid": ecDID + "#key"}, validClaims()),
+			wantDID:   ecDID,
+			wantNonce: "the-nonce",
+		},
+		{
+			name:      "Ed25519 key in a jwk",
+			proof:     signProof(t, jwt.SigningMethodEdDSA, edKey, map[string]any{"jwk": publicJWK(t, edPublic)}, validClaims()),
+			wantDID:   edDID,
+			wantNonce: "the-nonce",
+		},
+		{
+			name:    "bad typ",
+			proof:   signProof(t, jwt.SigningMethodES256, ecKey, map[string]any{"kid": ecDID, "typ": "JWT"}, validClaims()),
+			wantErr: true,
+		},
+		{
+			name: "wrong aud",
+			proof: signProof(t, jwt.SigningMethodES256, ecKey, map[string]any{"kid": ecDID},
+				jwt.MapClaims{"aud": "https://other.example.com", "iat": now.Unix(), "nonce": "the-nonce"}),
+			wantErr: true,
+		},
+		{
+			name: "missing iat",
+			proof: signProof(t, jwt.SigningMethodES256, ecKey, map[string]any{"kid": ecDID},
+				jwt.MapClaims{"aud": testIssuerURL, "nonce": "the-nonce"}),
+			wantErr: true,
+		},
+		{
+			name: "iat too old",
+			proof: signProof(t, jwt.SigningMethodES256, ecKey, map[string]any{"kid": ecDID},
+				jwt.MapClaims{"aud": testIssuerURL, "iat": now.Add(-time.Hour).Unix(), "nonce": "the-nonce"}),
+			wantErr: true,
+		},
+		{
+			name: "iat in the future",
+			proof: signProof(t, jwt.SigningMethodES256, ecKey, map[string]any{"kid": ecDID},
+				jwt.MapClaims{"aud": testIssuerURL, "iat": now.Add(time.Hour).Unix(), "nonce": "the-nonce"}),
+			wantErr: true,
+		},
+		{
+			name:      "missing nonce is returned empty to the caller",
+			proof:     signProof(t, jwt.SigningMethodES256, ecKey, map[string]any{"kid": ecDID}, jwt.MapClaims{"aud": testIssuerURL, "iat": now.Unix()}),
+			wantDID:   ecDID,
+			wantNonce: "",
+		},
+		{
+			name:    "signed with another key",
+			proof:   signProof(t, jwt.SigningMethodEdDSA, edKey, map[string]any{"kid": ecDID}, validClaims()),
+			wantErr: true,
+		},
+		{
+			name:    "no kid or jwk",
+			proof:   signProof(t, jwt.SigningMethodES256, ecKey, nil, validClaims()),
+			wantErr: true,
+		},
+		{
+			name:    "symmetric algorithm",
+			proof:   signProof(t, jwt.SigningMethodHS256, []byte("secret"), map[string]any{"kid": ecDID}, validClaims()),
+			wantErr: true,
+		},
+	}
+
+	is := &IssuerServer{config: &Config{IssuerURL: testIssuerURL, AccessTokenMaxAge: 600}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			holderDID, nonce, err := is.verifyProof(tt.proof)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("verifyProof() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if holderDID != tt.wantDID {
+				t.Errorf("verifyProof() holderDID = %v, want %v", holderDID, tt.wantDID)
+			}
+			if nonce != tt.wantNonce {
+				t.Errorf("verifyProof() nonce = %v, want %v", nonce, tt.wantNonce)
+			}
+		})
+	}
+}
+
+func TestRotateCNonce(t *testing.T) {
+	is := newTestIssuer(t)
+	offer := newTestOffer(t, is, "first-nonce", time.Now().Add(time.Minute))
+	expired := newTestOffer(t, is, "expired-nonce", time.Now().Add(-time.Minute))
+
+	// The steps run in order, and with 'useLast' they send the nonce returned by the previous step
+	tests := []struct {
+		name      string
+		offerID   string
+		expected  string
+		useLast   bool
+		wantValid bool
+	}{
+		{
+			name:      "nonce of the token response",
+			offerID:   offer.Id,
+			expected:  "first-nonce",
+			wantValid: true,
+		},
+		{
+			name:      "the same nonce can not be used twice",
+			offerID:   offer.Id,
+			expected:  "first-nonce",
+			wantValid: false,
+		},
+		{
+			name:      "the nonce returned by the last request",
+			offerID:   offer.Id,
+			useLast:   true,
+			wantValid: true,
+		},
+		{
+			name:      "empty nonce",
+			offerID:   offer.Id,
+			expected:  "",
+			wantValid: false,
+		},
+		{
+			name:      "expired nonce",
+			offerID:   expired.Id,
+			expected:  "expired-nonce",
+			wantValid: false,
+		},
+	}
+
+	var last string
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			expected := tt.expected
+			if tt.useLast {
+				expected = last
+			}
+
+			cNonce, valid, err := is.rotateCNonce(tt.offerID, expected)
+			if err != nil {
+				t.Fatalf("rotateCNonce() error = %v", err)
+			}
+			if valid != tt.wantValid {
+				t.Errorf("rotateCNonce() valid = %v, want %v", valid, tt.wantValid)
+			}
+			if len(cNonce) == 0 || cNonce == expected {
+				t.Errorf("rotateCNonce() did not return a new nonce")
+			}
+			last = cNonce
+		})
+	}
+}
+
+// signProof returns a proof of possession with the headers and claims, signed with the key
+func signProof(t *testing.T, method jwt.SigningMethod, key any, headers map[string]any, claims jwt.MapClaims) string {
+	token := jwt.NewWithClaims(method, claims)
+	token.Header["typ"] = proofJWTType
+	for name, value := range headers {
+		token.Header[name] = value
+	}
+	proof, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return proof
+}
+
+// publicJWK returns the public key as the map of a 'jwk' header
+func publicJWK(t *testing.T, publicKey crypto.PublicKey) map[string]any {
+	key, err := jwk.FromRaw(publicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := json.Marshal(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var header map[string]any
+	if err := json.Unmarshal(raw, &header); err != nil {
+		t.Fatal(err)
+	}
+	return header
+}
+
+// newTestIssuer returns an Issuer with a copy of the database in pb_data, updated with the migrations
+func newTestIssuer(t *testing.T) *IssuerServer {
+	dataDir := t.TempDir()
+	data, err := os.ReadFile(filepath.Join("..", "pb_data", "data.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dataDir, "data.db"), data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	app := pocketbase.NewWithConfig(pocketbase.Config{DefaultDataDir: dataDir})
+	if err := app.Bootstrap(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { app.ResetBootstrapState() })
+
+	runner, err := migrate.NewRunner(app.DB(), migrations.AppMigrations)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := runner.Up(); err != nil {
+		t.Fatal(err)
+	}
+
+	return &IssuerServer{App: app, config: &Config{IssuerURL: testIssuerURL, AccessTokenMaxAge: 600}}
+}
+
+// newTestOffer saves an offer of a new credential, with the c_nonce returned in the token response
+func newTestOffer(t *testing.T, is *IssuerServer, cNonce string, cNonceExpires time.Time) *models.Record {
+	dao := is.App.Dao()
+
+	credentials, err := dao.FindCollectionByNameOrId("credentials")
+	if err != nil {
+		t.Fatal(err)
+	}
+	credential := models.NewRecord(credentials)
+	credential.Set("email", "holder@example.com")
+	credential.Set("status", credentialOffered)
+	if err := dao.SaveRecord(credential); err != nil {
+		t.Fatal(err)
+	}
+
+	offers, err := dao.FindCollectionByNameOrId(credentialOffersCollection)
+	if err != nil {
+		t.Fatal(err)
+	}
+	offer := models.NewRecord(offers)
+	offer.Set("credential", credential.Id)
+	offer.Set("pre_authorized_code", randomToken())
+	offer.Set("expires", time.Now().Add(time.Hour))
+	offer.Set("redeemed", time.Now())
+	offer.Set("c_nonce", cNonce)
+	offer.Set("c_nonce_expires", cNonceExpires)
+	if err := dao.SaveRecord(offer); err != nil {
+		t.Fatal(err)
+	}
+	return offer
+}
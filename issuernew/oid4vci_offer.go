@@ -0,0 +1,392 @@
+package issuernew
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v5"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/daos"
+	"github.com/pocketbase/pocketbase/models"
+	"github.com/pocketbase/pocketbase/tools/mailer"
+	"github.com/valyala/fasttemplate"
+)
+
+// The collection with the credential offers made to the holders. Each offer has a pre-authorized code which
+// can be exchanged only once, before it expires, for an access token to the credential endpoint.
+const credentialOffersCollection = "credential_offers"
+
+// The path of the credential offers, passed by reference to the Wallets in 'credential_offer_uri'
+const credentialOfferPath = "/credential-offer/"
+
+// The transaction code (PIN) sent by email has this number of digits, and can be tried a limited number of times
+// across all the offers of a credential made while the previous ones have not expired
+const (
+	txCodeLength      = 6
+	maxTxCodeAttempts = 5
+)
+
+// A new offer of a credential is not created (and no new PIN is sent) until this time after the previous one.
+// Requests in the meantime get the previous offer.
+const minOfferInterval = time.Minute
+
+// oauthError is an error response of the OAuth and OID4VCI endpoints
+type oauthError struct {
+	status      int
+	Code        string `json:"error"`
+	Description string `json:"error_description,omitempty"`
+
+	// A new c_nonce is returned when the proof of the credential request is rejected
+	CNonce          string `json:"c_nonce,omitempty"`
+	CNonceExpiresIn int    `json:"c_nonce_expires_in,omitempty"`
+
+	// The seconds to wait before polling again, when the issuance is pending
+	Interval int `json:"interval,omitempty"`
+}
+
+func (e *oauthError) Error() string {
+	return e.Code + ": " + e.Description
+}
+
+func newOAuthError(status int, code string, description string) *oauthError {
+	return &oauthError{status: status, Code: code, Description: description}
+}
+
+// writeOAuthError sends the error in the format of RFC 6749, hiding the details of unexpected errors
+func writeOAuthError(c echo.Context, err error) error {
+	c.Response().Header().Set("Cache-Control", "no-store")
+
+	var oerr *oauthError
+	if errors.As(err, &oerr) {
+		return c.JSON(oerr.status, oerr)
+	}
+
+	log.Println("OID4VCI error:", err)
+	return c.JSON(http.StatusInternalServerError, newOAuthError(http.StatusInternalServerError, "server_error", ""))
+}
+
+// randomToken returns a random string with 256 bits of entropy, for codes, tokens and nonces
+func randomToken() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// tokenHash is the value stored for secrets which only have to be compared, like access tokens
+func tokenHash(values ...string) string {
+	sum := sha256.Sum256([]byte(strings.Join(values, ":")))
+	return hex.EncodeToString(sum[:])
+}
+
+// newTxCode returns a random numeric PIN
+func newTxCode() (string, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(1_000_000))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%0*d", txCodeLength, n.Int64()), nil
+}
+
+// newCredentialOffer creates an offer of the credential with a new pre-authorized code, and if configured, a
+// transaction code which is sent to the holder by email. Previous offers of the credential not yet redeemed are
+// deleted, so only the last offer made to the holder can be used.
+//
+// The page creating the offers is public, so offers are rate limited: the last offer is returned while it is
+// younger than minOfferInterval, and the failed attempts with the PIN of offers not yet expired are carried to
+// the new one, so requesting new offers does not give more attempts to guess the PIN.
+func (is *IssuerServer) newCredentialOffer(credentialRecord *models.Record) (*models.Record, error) {
+	app := is.App
+
+	collection, err := app.Dao().FindCollectionByNameOrId(credentialOffersCollection)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+
+	offer := models.NewRecord(collection)
+	offer.Set("credential", credentialRecord.Id)
+	offer.Set("pre_authorized_code", randomToken())
+	offer.Set("expires", now.Add(time.Duration(is.config.OfferMaxAge)*time.Second))
+
+	var txCode string
+	if is.config.TxCode {
+		txCode, err = newTxCode()
+		if err != nil {
+			return nil, err
+		}
+		offer.Set("tx_code_hash", tokenHash(offer.GetString("pre_authorized_code"), txCode))
+	}
+
+	var recent *models.Record
+	err = app.Dao().RunInTransaction(func(txDao *daos.Dao) error {
+		previous, err := txDao.FindRecordsByExpr(credentialOffersCollection,
+			dbx.HashExp{"credential": credentialRecord.Id, "redeemed": ""})
+		if err != nil {
+			return err
+		}
+
+		attempts := 0
+		for _, p := range previous {
+			if now.After(p.GetDateTime("expires").Time()) {
+				continue
+			}
+			if now.Sub(p.Created.Time()) < minOfferInterval {
+				recent = p
+				return nil
+			}
+			attempts = max(attempts, p.GetInt("tx_code_attempts"))
+		}
+		offer.Set("tx_code_attempts", attempts)
+
+		for _, p := range previous {
+			if err := txDao.DeleteRecord(p); err != nil {
+				return err
+			}
+		}
+		return txDao.SaveRecord(offer)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if recent != nil {
+		return recent, nil
+	}
+
+	// The PIN is sent out of band, so getting the link to the offer is not enough to get the credential
+	if len(txCode) > 0 {
+		if err := is.sendTxCodeEmail(credentialRecord, txCode); err != nil {
+			return nil, err
+		}
+	}
+
+	return offer, nil
+}
+
+// credentialOfferURI is the URL where the Wallet retrieves the offer
+func (is *IssuerServer) credentialOfferURI(offer *models.Record) string {
+	return is.config.IssuerURL + credentialOfferPath + offer.Id
+}
+
+// credentialOffer returns the offer referenced by 'credential_offer_uri', while its code has not been used
+func (is *IssuerServer) credentialOffer(c echo.Context) error {
+	app := is.App
+
+	offer, err := app.Dao().FindRecordById(credentialOffersCollection, c.PathParam("offerid"))
+	if err != nil || !offer.GetDateTime("redeemed").IsZero() || time.Now().After(offer.GetDateTime("expires").Time()) {
+		return writeOAuthError(c, newOAuthError(http.StatusNotFound, "invalid_request", "credential offer not found or expired"))
+	}
+
+	credentialRecord, err := app.Dao().FindRecordById("credentials", offer.GetString("credential"))
+	if err != nil {
+		return writeOAuthError(c, newOAuthError(http.StatusNotFound, "invalid_request", "credential not found"))
+	}
+
+	grant := map[string]any{
+		"pre-authorized_code": offer.GetString("pre_authorized_code"),
+	}
+	if len(offer.GetString("tx_code_hash")) > 0 {
+		grant["tx_code"] = map[string]any{
+			"input_mode":  "numeric",
+			"length":      txCodeLength,
+			"description": "Please enter the PIN sent to your email",
+		}
+	}
+
+	c.Response().Header().Set("Cache-Control", "no-store")
+	return c.JSON(http.StatusOK, map[string]any{
+		"credential_issuer":            is.config.IssuerURL,
+		"credential_configuration_ids": []string{is.credentialConfigurationID(credentialRecord)},
+		"grants": map[string]any{
+			preAuthorizedCodeGrantType: grant,
+		},
+	})
+}
+
+// credentialConfigurationID returns the credential configuration of the credential in the record,
+// using the types of the credential
+func (is *IssuerServer) credentialConfigurationID(credentialRecord *models.Record) string {
+	payload, err := credentialPayload(credentialRecord)
+	if err == nil {
+		if ct := is.credentialTypeOf(payload); ct != nil {
+			return ct.ID
+		}
+	}
+	return "LEARCredentialEmployee"
+}
+
+// credentialTypeOf returns the type of the credential among the ones the Issuer can issue, or nil if none
+func (is *IssuerServer) credentialTypeOf(credential map[string]any) *credentialType {
+	types, _ := credential["type"].([]any)
+	for _, t := range types {
+		if id, ok := t.(string); ok && is.credentialTypes[id] != nil {
+			return is.credentialTypes[id]
+		}
+	}
+	return nil
+}
+
+// credentialPayload decodes the payload of the credential JWT stored in the record, without verifying it
+func credentialPayload(credentialRecord *models.Record) (map[string]any, error) {
+	parts := strings.Split(credentialRecord.GetString("raw"), ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("token contains an invalid number of segments")
+	}
+	claimsDecoded, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, err
+	}
+	var payload map[string]any
+	if err := json.Unmarshal(claimsDecoded, &payload); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
+// tokenEndpoint exchanges a pre-authorized code (and the transaction code, if the offer requires one)
+// for an access token to the credential endpoint and a c_nonce for the proof of possession
+func (is *IssuerServer) tokenEndpoint(c echo.Context) error {
+
+	if c.FormValue("grant_type") != preAuthorizedCodeGrantType {
+		return writeOAuthError(c, newOAuthError(http.StatusBadRequest, "unsupported_grant_type", "only the pre-authorized code grant is supported"))
+	}
+	code := c.FormValue("pre-authorized_code")
+	if len(code) == 0 {
+		return writeOAuthError(c, newOAuthError(http.StatusBadRequest, "invalid_request", "pre-authorized_code is required"))
+	}
+
+	accessToken := randomToken()
+	cNonce := randomToken()
+	tokenMaxAge := time.Duration(is.config.AccessTokenMaxAge) * time.Second
+
+	// The offer is updated in a transaction, so the code can not be used twice by concurrent requests.
+	// Failed attempts with the transaction code are also recorded, so the outcome is not the error of the transaction.
+	var outcome error
+	err := is.App.Dao().RunInTransaction(func(txDao *daos.Dao) error {
+		offer, err := txDao.FindFirstRecordByData(credentialOffersCollection, "pre_authorized_code", code)
+		if err != nil {
+			outcome = newOAuthError(http.StatusBadRequest, "invalid_grant", "invalid pre-authorized_code")
+			return nil
+		}
+
+		now := time.Now()
+
+		// A code used twice may have been stolen, so the access token issued with it is revoked
+		if !offer.GetDateTime("redeemed").IsZero() {
+			offer.Set("access_token_expires", now)
+			outcome = newOAuthError(http.StatusBadRequest, "invalid_grant", "pre-authorized_code already used")
+			return txDao.SaveRecord(offer)
+		}
+		if now.After(offer.GetDateTime("expires").Time()) {
+			outcome = newOAuthError(http.StatusBadRequest, "invalid_grant", "pre-authorized_code expired")
+			return nil
+		}
+
+		if txCodeHash := offer.GetString("tx_code_hash"); len(txCodeHash) > 0 {
+			attempts := offer.GetInt("tx_code_attempts")
+			if attempts >= maxTxCodeAttempts {
+				outcome = newOAuthError(http.StatusBadRequest, "invalid_grant", "too many attempts, please request a new offer later")
+				return nil
+			}
+			if subtle.ConstantTimeCompare([]byte(tokenHash(code, c.FormValue("tx_code"))), []byte(txCodeHash)) != 1 {
+				offer.Set("tx_code_attempts", attempts+1)
+				outcome = newOAuthError(http.StatusBadRequest, "invalid_grant", "invalid tx_code")
+				return txDao.SaveRecord(offer)
+			}
+		}
+
+		offer.Set("redeemed", now)
+		offer.Set("access_token_hash", tokenHash(accessToken))
+		offer.Set("access_token_expires", now.Add(tokenMaxAge))
+		offer.Set("c_nonce", cNonce)
+		offer.Set("c_nonce_expires", now.Add(tokenMaxAge))
+		return txDao.SaveRecord(offer)
+	})
+	if err == nil {
+		err = outcome
+	}
+	if err != nil {
+		return writeOAuthError(c, err)
+	}
+
+	c.Response().Header().Set("Cache-Control", "no-store")
+	return c.JSON(http.StatusOK, map[string]any{
+		"access_token":       accessToken,
+		"token_type":         "Bearer",
+		"expires_in":         is.config.AccessTokenMaxAge,
+		"c_nonce":            cNonce,
+		"c_nonce_expires_in": is.config.AccessTokenMaxAge,
+	})
+}
+
+// credentialOfferLinks returns the URL for the QR code scanned by the Wallet (cross-device flow) and the URL
+// opening the Wallet in the same device, both with the offer passed by reference
+func (is *IssuerServer) credentialOfferLinks(offer *models.Record) (crossDevice string, sameDevice string) {
+	offerURI := url.QueryEscape(is.credentialOfferURI(offer))
+	crossDevice = "openid-credential-offer://?credential_offer_uri=" + offerURI
+	sameDevice = is.config.SamedeviceWallet + "/?credential_offer_uri=" + offerURI
+	return crossDevice, sameDevice
+}
+
+var templateTxCodeEmail = `
+<!DOCTYPE html>
+<html>
+<body>
+	<p>Hello,</p>
+	<p>Your Wallet will ask for a PIN to receive the credential you have been offered. The PIN is:</p>
+	<p style="font-size: 24px; font-weight: bold; letter-spacing: 4px;">{{tx_code}}</p>
+	<p>It can be used only once, in the next {{minutes}} minutes. If you did not request a credential, you can ignore this email.</p>
+	<p>
+		Thanks,<br />
+		DOME Marketplace Issuer team
+	</p>
+</body>
+</html>
+`
+
+// sendTxCodeEmail sends the transaction code of an offer to the email of the holder of the credential
+func (is *IssuerServer) sendTxCodeEmail(credentialRecord *models.Record, txCode string) error {
+	app := is.App
+
+	email := credentialRecord.GetString("email")
+	if len(email) == 0 {
+		return fmt.Errorf("the credential does not have an email to send the PIN")
+	}
+
+	t := fasttemplate.New(templateTxCodeEmail, "{{", "}}")
+	emailBody := t.ExecuteString(map[string]any{
+		"tx_code": txCode,
+		"minutes": fmt.Sprint(is.config.OfferMaxAge / 60),
+	})
+
+	message := &mailer.Message{
+		From: mail.Address{
+			Address: app.Settings().Meta.SenderAddress,
+			Name:    app.Settings().Meta.SenderName,
+		},
+		To:      []mail.Address{{Address: email}},
+		Subject: "PIN to receive your credential",
+		HTML:    emailBody,
+	}
+
+	if err := app.NewMailClient().Send(message); err != nil {
+		return fmt.Errorf("sendTxCodeEmail: %w", err)
+	}
+
+	return nil
+}
@@ -6,15 +6,14 @@ import (
 	"encoding/json"
 	"log"
 	"net/http"
-	"time"
 
 	"github.com/evidenceledger/vcdemo/types"
 	"github.com/evidenceledger/vcdemo/vault/x509util"
-	"github.com/golang-jwt/jwt/v5"
 	"github.com/labstack/echo/v5"
 	"github.com/pocketbase/dbx"
 	"github.com/pocketbase/pocketbase/apis"
 	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/models"
 )
 
 func (is *IssuerServer) addSignerRoutes(e *core.ServeEvent) {
@@ -75,15 +74,13 @@ func (is *IssuerServer) addSignerRoutes(e *core.ServeEvent) {
 
 	})
 
-	// Create a LEARCredential with the info in the request
+	// Create a credential with the type and claims in the request
 	signerApiGroup.POST("/createjsoncredential", func(c echo.Context) error {
 		return is.createJSONCredential(c)
 	})
 
-	// Sign in the server the credential passed in the request
-	signerApiGroup.POST("/signcredential", func(c echo.Context) error {
-		return is.signCredential(c)
-	})
+	// Offer to a holder a credential of any of the types which can be issued
+	signerApiGroup.POST("/issuecredential", is.issueCredentialBySigner)
 
 	// Retrieve all credentials, applying the proper access control depending on the status
 	signerApiGroup.GET("/retrievecredentials", func(c echo.Context) error {
@@ -100,6 +97,11 @@ func (is *IssuerServer) addSignerRoutes(e *core.ServeEvent) {
 		return is.sendReminder(c)
 	})
 
+	// Change the status of a credential of the organization of the signer
+	signerApiGroup.POST("/revokecredential/:credid", is.changeCredentialStatusBySigner(statusActionRevoke))
+	signerApiGroup.POST("/suspendcredential/:credid", is.changeCredentialStatusBySigner(statusActionSuspend))
+	signerApiGroup.POST("/unsuspendcredential/:credid", is.changeCredentialStatusBySigner(statusActionUnsuspend))
+
 }
 
 func (is *IssuerServer) retrieveAllCredentials(c echo.Context) error {
@@ -124,9 +126,13 @@ func (is *IssuerServer) retrieveAllCredentials(c echo.Context) error {
 	// Get the email of the caller
 	creatorEmail := userRecord.Email()
 
-	// Retrieve all records which can be signed by the user and in the state 'tobesigned'
-	expr1 := dbx.HashExp{"creator_email": creatorEmail, "status": "tobesigned"}
-	records, err := app.Dao().FindRecordsByExpr("credentials", expr1)
+	// Retrieve all records which can be signed by the user and in the state 'tobesigned'.
+	// These are the ones created by the user and the ones offered by the LEARs of the organization.
+	var expr1 dbx.Expression = dbx.HashExp{"creator_email": creatorEmail}
+	if organizationIdentifier := userRecord.GetString("organizationIdentifier"); len(organizationIdentifier) > 0 {
+		expr1 = dbx.Or(expr1, dbx.HashExp{"organizationIdentifier": organizationIdentifier})
+	}
+	records, err := app.Dao().FindRecordsByExpr("credentials", expr1, dbx.HashExp{"status": credentialToBeSigned})
 	if err != nil {
 		return err
 	}
@@ -135,105 +141,52 @@ func (is *IssuerServer) retrieveAllCredentials(c echo.Context) error {
 
 }
 
-// createJSONCredential is the Echo route to create a credential from the Mandate in the body of the request.
-// We get the Mandate object, create a LEARCredential and insert the Mandate into the 'credentialSubject' object.
+// createJSONCredential is the Echo route to create a credential from the type and claims in the body of the request,
+// rendering the template of the type. A body without 'type' is the Mandate of a LEARCredentialEmployee,
+// which is inserted into the 'credentialSubject' object.
 func (is *IssuerServer) createJSONCredential(c echo.Context) error {
 
-	info := apis.RequestInfo(c)
+	var request issueCredentialRequest
 
 	// We received the body data in form of a map[string]any
-	data := info.Data
-	log.Println("data", data)
-
-	// Serialize to JSON
-	raw, err := json.Marshal(data)
-	if err != nil {
-		return err
-	}
-	log.Println("RAW", string(raw))
-
-	// Create the Mandate struct from the serialized JSON data
-	mandate := types.Mandate{}
-	err = json.Unmarshal(raw, &mandate)
-	if err != nil {
-		return err
-	}
-
-	// Generate the dates for the Mandate
-	now := time.Now()
-	nowPlusOneYear := now.AddDate(1, 0, 0)
-	nowUTC := now.UTC().String()
-	nowPlusOneYearUTC := nowPlusOneYear.UTC().String()
-
-	mandate.Id = newRandomString()
-	for i := range mandate.Power {
-		mandate.Power[i].Id = newRandomString()
-	}
-
-	mandate.LifeSpan.StartDateTime = nowUTC
-	mandate.LifeSpan.EndDateTime = nowPlusOneYearUTC
-
-	// didkey, _, err := GenDIDKey()
-	// if err != nil {
-	// 	return err
-	// }
-	// mandate.Mandatee.Id = didkey
-
-	// Print the Mandate struct to check it is OK
-	raw, err = json.MarshalIndent(mandate, "", "  ")
-	if err != nil {
-		return err
-	}
-	log.Println("===== Mandate struct Marshalled")
-	log.Println(string(raw))
-
-	// Create the LEARCredential struct
-	lc := types.LEARCredentialEmployee{}
-	lc.CredentialSubject.Mandate = mandate
-
-	// Complete the LEARCredential
-	lc.Context = []string{"https://www.w3.org/ns/credentials/v2", "https://www.evidenceledger.eu/2022/credentials/employee/v1"}
-	lc.Id = newRandomString()
-	lc.TypeCredential = []string{"VerifiableCredential", "LEARCredentialEmployee"}
-	lc.Issuer.Id = "did:elsi:" + mandate.Mandator.OrganizationIdentifier
-
-	lc.IssuanceDate = nowUTC
-	lc.ValidFrom = nowUTC
-	lc.ExpirationDate = nowPlusOneYearUTC
-
-	raw, err = json.MarshalIndent(lc, "", "  ")
-	if err != nil {
-		return err
-	}
-	log.Println("===== LEARCredential struct Marshalled")
-	log.Println(string(raw))
-
-	return c.JSON(http.StatusOK, lc)
-}
-
-func (is *IssuerServer) signCredential(c echo.Context) error {
-
-	// Get the private key from the configured x509 certificate
-	privateKey, err := getConfigPrivateKey()
-	if err != nil {
-		return err
+	data := apis.RequestInfo(c).Data
+	if _, found := data["type"]; found {
+		raw, err := json.Marshal(data)
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(raw, &request); err != nil {
+			return apis.NewBadRequestError("invalid request", err)
+		}
+	} else {
+		// The Mandate of older clients can have the names of the fields in any case
+		raw, err := json.Marshal(data)
+		if err != nil {
+			return err
+		}
+		var legacyMandate types.Mandate
+		if err := json.Unmarshal(raw, &legacyMandate); err != nil {
+			return apis.NewBadRequestError("invalid mandate", err)
+		}
+		mandate, err := claimsFromValue(legacyMandate)
+		if err != nil {
+			return err
+		}
+		request.Type = "LEARCredentialEmployee"
+		request.Claims = map[string]any{"mandate": mandate}
 	}
 
-	var learCred types.LEARCredentialEmployee
-
-	// The body of the HTTP request should be a LEARCredentialEmployee
-	err = echo.BindBody(c, &learCred)
-	if err != nil {
-		return err
+	ct := is.credentialTypes[request.Type]
+	if ct == nil {
+		return apis.NewBadRequestError("unknown credential type '"+request.Type+"'", nil)
 	}
 
-	// Sign the credential
-	tok, err := types.CreateLEARCredentialJWTtoken(learCred, jwt.SigningMethodRS256, privateKey)
+	credential, err := is.renderCredential(ct, request.Claims)
 	if err != nil {
-		return err
+		return apis.NewBadRequestError(err.Error(), nil)
 	}
 
-	return c.JSON(http.StatusOK, map[string]any{"signed": tok})
+	return c.JSON(http.StatusOK, credential)
 }
 
 func (is *IssuerServer) sendReminder(c echo.Context) error {
@@ -265,6 +218,11 @@ func (is *IssuerServer) updateSignedCredential(c echo.Context) error {
 	}
 	log.Println(string(out))
 
+	actor, err := is.signerCredentialActor(c)
+	if err != nil {
+		return err
+	}
+
 	record, err := app.Dao().FindRecordById("credentials", request.Id)
 	if err != nil {
 		return err
@@ -273,10 +231,10 @@ func (is *IssuerServer) updateSignedCredential(c echo.Context) error {
 	// set individual fields
 	// or bulk load with record.Load(map[string]any{...})
 	record.Set("title", "Lorem ipsum")
-	record.Set("status", request.Status)
 	record.Set("raw", request.Raw)
 
-	if err := app.Dao().SaveRecord(record); err != nil {
+	// The change of state is checked against the life cycle of the credential
+	if err := is.transitionCredential(record, request.Status, actor, ""); err != nil {
 		return err
 	}
 
@@ -288,3 +246,35 @@ func (is *IssuerServer) updateSignedCredential(c echo.Context) error {
 
 	return c.JSONPretty(http.StatusOK, map[string]any{"result": "OK"}, "  ")
 }
+
+// signerCredentialActor returns the actor changing the credentials in a request to the signer routes,
+// which is the admin or the signer registered with the certificate of the request
+func (is *IssuerServer) signerCredentialActor(c echo.Context) (credentialActor, error) {
+	if admin := apis.RequestInfo(c).Admin; admin != nil {
+		return credentialActor{role: roleSigner, id: "admin:" + admin.Email}, nil
+	}
+
+	signer, err := is.signerFromRequest(c)
+	if err != nil {
+		return credentialActor{}, err
+	}
+
+	return credentialActor{role: roleSigner, id: "signer:" + signer.Email()}, nil
+}
+
+// signerFromRequest returns the record of the signer registered with the certificate of the request,
+// using the unique SubjectKeyIdentifier of the certificate
+func (is *IssuerServer) signerFromRequest(c echo.Context) (*models.Record, error) {
+	cert, _, _, err := getX509UserFromHeader(c.Request())
+	if err != nil {
+		return nil, err
+	}
+	signer, err := is.App.Dao().FindFirstRecordByData("signers", "ski", hex.EncodeToString(cert.SubjectKeyId))
+	if err == sql.ErrNoRows {
+		return nil, echo.NewHTTPError(http.StatusForbidden, "Please provide valid credentials")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return signer, nil
+}
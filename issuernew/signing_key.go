@@ -0,0 +1,241 @@
+package issuernew
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/evidenceledger/vcdemo/types"
+	"github.com/evidenceledger/vcdemo/x509util"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// signingKey is the private key and x509 certificate used by the Issuer to sign the credentials.
+// It is loaded once at startup from the 'signingKey' section of the configuration.
+type signingKey struct {
+	privateKey crypto.Signer
+
+	// method is the JWT algorithm, which depends on the type of the key
+	method jwt.SigningMethod
+
+	// certificate is the certificate of the key, and chain the rest of the certificates up to the CA, if available
+	certificate *x509.Certificate
+	chain       []*x509.Certificate
+}
+
+// certificates returns the certificate of the key followed by the rest of the chain
+func (sk *signingKey) certificates() []*x509.Certificate {
+	return append([]*x509.Certificate{sk.certificate}, sk.chain...)
+}
+
+// sealCredential signs a credential of any type with the key, including the certificate chain in the JWT.
+// The JWT expires with the credential, or in one year if the credential does not have a valid expiration date.
+func (sk *signingKey) sealCredential(credential map[string]any, holderDID string) (string, error) {
+	validUntil := time.Now().AddDate(1, 0, 0)
+	for _, claim := range []string{"validUntil", "expirationDate"} {
+		if value, ok := credential[claim].(string); ok {
+			if t, err := time.Parse(time.RFC3339, value); err == nil {
+				validUntil = t
+				break
+			}
+		}
+	}
+	return types.CreateCredentialJWT(credential, holderDID, validUntil, sk.method, sk.privateKey, sk.certificates())
+}
+
+// sealStatusListCredential seals a status list credential with the key of the Issuer
+func (sk *signingKey) sealStatusListCredential(slc types.BitstringStatusListCredential, validUntil time.Time) (string, error) {
+	return types.CreateStatusListCredentialJWT(slc, validUntil, sk.method, sk.privateKey, sk.certificates())
+}
+
+// The minimum size of RSA keys accepted to sign credentials
+const minRSAKeyBits = 2048
+
+// loadSigningKey reads the key and certificates from a PKCS12 file or from PEM files, and selects the
+// signing algorithm. It fails if the key can not be used to sign credentials.
+func loadSigningKey(cfg SigningKeyConfig) (*signingKey, error) {
+
+	if len(cfg.File) == 0 {
+		return nil, errors.New("signingKey.file is not specified in the configuration file")
+	}
+
+	var key any
+	var certs []*x509.Certificate
+
+	switch strings.ToLower(filepath.Ext(cfg.File)) {
+	case ".p12", ".pfx":
+		password, err := cfg.password()
+		if err != nil {
+			return nil, err
+		}
+		var cert *x509.Certificate
+		var caCerts []*x509.Certificate
+		key, cert, caCerts, err = x509util.ReadPKCS12File(cfg.File, password)
+		if err != nil {
+			return nil, fmt.Errorf("reading PKCS12 file %s: %w", cfg.File, err)
+		}
+		certs = append([]*x509.Certificate{cert}, caCerts...)
+
+	default:
+		data, err := os.ReadFile(cfg.File)
+		if err != nil {
+			return nil, fmt.Errorf("reading signing key: %w", err)
+		}
+		key, certs, err = parsePEMKeyAndCertificates(data)
+		if err != nil {
+			return nil, fmt.Errorf("parsing PEM file %s: %w", cfg.File, err)
+		}
+		if len(cfg.CertificateFile) > 0 {
+			pemCerts, err := os.ReadFile(cfg.CertificateFile)
+			if err != nil {
+				return nil, fmt.Errorf("reading signing certificate: %w", err)
+			}
+			_, moreCerts, err := parsePEMKeyAndCertificates(pemCerts)
+			if err != nil {
+				return nil, fmt.Errorf("parsing PEM file %s: %w", cfg.CertificateFile, err)
+			}
+			certs = append(certs, moreCerts...)
+		}
+	}
+
+	if key == nil {
+		return nil, fmt.Errorf("no private key found in %s", cfg.File)
+	}
+	privateKey, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key type %T", key)
+	}
+
+	method, err := signingMethodForKey(privateKey, cfg.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+
+	sk := &signingKey{
+		privateKey: privateKey,
+		method:     method,
+	}
+
+	// The certificate is the one with the public key of the private key, and the rest form the chain
+	type publicKeyComparer interface{ Equal(crypto.PublicKey) bool }
+	for _, cert := range certs {
+		if sk.certificate == nil && privateKey.Public().(publicKeyComparer).Equal(cert.PublicKey) {
+			sk.certificate = cert
+			continue
+		}
+		sk.chain = append(sk.chain, cert)
+	}
+	if sk.certificate == nil {
+		return nil, fmt.Errorf("no certificate found for the signing key in %s", cfg.File)
+	}
+
+	// The DID of the Issuer is derived from the certificate, so it must be the one of an organization
+	if _, err := types.ELSIDIDFromCertificate(sk.certificate); err != nil {
+		return nil, fmt.Errorf("the signing certificate can not seal credentials: %w", err)
+	}
+
+	now := time.Now()
+	if now.Before(sk.certificate.NotBefore) || now.After(sk.certificate.NotAfter) {
+		log.Println("WARNING: the certificate of the signing key is not valid now:", sk.certificate.NotBefore, "-", sk.certificate.NotAfter)
+	}
+
+	return sk, nil
+}
+
+// parsePEMKeyAndCertificates returns the private key (if any) and all the certificates in PEM data
+func parsePEMKeyAndCertificates(data []byte) (key any, certs []*x509.Certificate, err error) {
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+
+		switch block.Type {
+		case "CERTIFICATE":
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, nil, err
+			}
+			certs = append(certs, cert)
+
+		case "PRIVATE KEY":
+			key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+		case "RSA PRIVATE KEY":
+			key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+		case "EC PRIVATE KEY":
+			key, err = x509.ParseECPrivateKey(block.Bytes)
+		case "ENCRYPTED PRIVATE KEY":
+			err = errors.New("encrypted PEM keys are not supported, use a PKCS12 file")
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return key, certs, nil
+}
+
+// signingMethodForKey selects the JWT algorithm for the type of the key. RSA keys use RS256 unless
+// PS256 is configured. For other keys the algorithm is determined by the key, and if one is configured it must match.
+func signingMethodForKey(key crypto.Signer, algorithm string) (jwt.SigningMethod, error) {
+	var method jwt.SigningMethod
+
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		if k.N.BitLen() < minRSAKeyBits {
+			return nil, fmt.Errorf("RSA signing key of %d bits, at least %d are required", k.N.BitLen(), minRSAKeyBits)
+		}
+		switch algorithm {
+		case "", "RS256":
+			method = jwt.SigningMethodRS256
+		case "PS256":
+			method = jwt.SigningMethodPS256
+		}
+	case *ecdsa.PrivateKey:
+		switch k.Curve.Params().Name {
+		case "P-256":
+			method = jwt.SigningMethodES256
+		case "P-384":
+			method = jwt.SigningMethodES384
+		case "P-521":
+			method = jwt.SigningMethodES512
+		default:
+			return nil, fmt.Errorf("unsupported elliptic curve %s for the signing key", k.Curve.Params().Name)
+		}
+	case ed25519.PrivateKey:
+		method = jwt.SigningMethodEdDSA
+	default:
+		return nil, fmt.Errorf("unsupported private key type %T", key)
+	}
+
+	if method == nil || len(algorithm) > 0 && method.Alg() != algorithm {
+		return nil, fmt.Errorf("algorithm %s can not be used with a signing key of type %T", algorithm, key)
+	}
+
+	return method, nil
+}
+
+// password returns the password of the PKCS12 file, from 'passwordFile' or the CERT_PASSWORD environment variable.
+// An empty password is valid.
+func (s SigningKeyConfig) password() (string, error) {
+	if len(s.PasswordFile) > 0 {
+		passwordBytes, err := os.ReadFile(s.PasswordFile)
+		if err != nil {
+			return "", fmt.Errorf("reading password of the signing key: %w", err)
+		}
+		return string(bytes.TrimSpace(passwordBytes)), nil
+	}
+	return os.Getenv("CERT_PASSWORD"), nil
+}
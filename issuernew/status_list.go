@@ -0,0 +1,253 @@
+package issuernew
+
+import (
+	"database/sql"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/evidenceledger/vcdemo/types"
+	"github.com/labstack/echo/v5"
+	"github.com/labstack/echo/v5/middleware"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/daos"
+	"github.com/pocketbase/pocketbase/models"
+)
+
+// The path of the status list credentials, followed by the purpose of the list. The URL of each list is stable,
+// so it can be included in the credentials.
+const statusListPath = "/status/"
+
+// The status list credentials are valid for one day, but verifiers should not cache them more than a few minutes
+const (
+	statusListValidity    = 24 * time.Hour
+	statusListCacheMaxAge = 300
+)
+
+// The status lists published by the Issuer. Each credential has the same index in all of them.
+var statusPurposes = []string{types.StatusPurposeRevocation, types.StatusPurposeSuspension}
+
+// The changes of status that can be requested for a credential
+const (
+	statusActionRevoke    = "revoke"
+	statusActionSuspend   = "suspend"
+	statusActionUnsuspend = "unsuspend"
+)
+
+// addStatusListRoutes publishes the status lists, which are retrieved by verifiers from other origins
+func (is *IssuerServer) addStatusListRoutes(e *core.ServeEvent) {
+	e.Router.GET(statusListPath+":purpose", is.statusListCredential, middleware.CORS())
+}
+
+// statusListCredentialURL is the URL of the status list credential with the purpose
+func (is *IssuerServer) statusListCredentialURL(purpose string) string {
+	return is.config.IssuerURL + statusListPath + purpose
+}
+
+// setCredentialStatus allocates an index in the status lists to the credential in the record if it does not
+// have one yet, and sets the 'credentialStatus' of the credential. The caller has to save the record.
+func (is *IssuerServer) setCredentialStatus(record *models.Record, credential map[string]any) error {
+
+	index := record.GetInt("status_list_index")
+	if index <= 0 {
+		var err error
+		index, err = is.newStatusListIndex()
+		if err != nil {
+			return err
+		}
+		record.Set("status_list_index", index)
+	}
+
+	var entries []types.BitstringStatusListEntry
+	for _, purpose := range statusPurposes {
+		listURL := is.statusListCredentialURL(purpose)
+		entries = append(entries, types.BitstringStatusListEntry{
+			Id:                   listURL + "#" + strconv.Itoa(index),
+			Type:                 "BitstringStatusListEntry",
+			StatusPurpose:        purpose,
+			StatusListIndex:      strconv.Itoa(index),
+			StatusListCredential: listURL,
+		})
+	}
+	credential["credentialStatus"] = entries
+
+	return nil
+}
+
+// newStatusListIndex returns a random index not used by other credentials, so the position in the list does not
+// reveal the order of issuance. Index 0 is never used, because it is the value of records without an index.
+func (is *IssuerServer) newStatusListIndex() (int, error) {
+	for i := 0; i < 20; i++ {
+		index := 1 + rand.Intn(types.StatusListSize-1)
+		_, err := is.App.Dao().FindFirstRecordByData("credentials", "status_list_index", index)
+		if err == sql.ErrNoRows {
+			return index, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	return 0, fmt.Errorf("no free index found in the status list")
+}
+
+// statusListCredential returns the status list credential with the purpose in the path, sealed as the credentials
+func (is *IssuerServer) statusListCredential(c echo.Context) error {
+	purpose := c.PathParam("purpose")
+	if !slices.Contains(statusPurposes, purpose) {
+		return echo.NewHTTPError(http.StatusNotFound, "status list not found")
+	}
+
+	// The credentials with the bit set in the list
+	exprs := []dbx.Expression{dbx.NewExp("status_list_index > 0")}
+	if purpose == types.StatusPurposeRevocation {
+		exprs = append(exprs, dbx.NewExp("revoked != ''"))
+	} else {
+		exprs = append(exprs, dbx.HashExp{"suspended": true})
+	}
+	records, err := is.App.Dao().FindRecordsByExpr("credentials", exprs...)
+	if err != nil {
+		return err
+	}
+
+	bitstring := make([]byte, types.StatusListSize/8)
+	for _, record := range records {
+		types.SetStatusListBit(bitstring, record.GetInt("status_list_index"))
+	}
+	encodedList, err := types.EncodeStatusList(bitstring)
+	if err != nil {
+		return err
+	}
+
+	listURL := is.statusListCredentialURL(purpose)
+	slc := types.BitstringStatusListCredential{
+		Context:        []string{"https://www.w3.org/ns/credentials/v2"},
+		Id:             listURL,
+		TypeCredential: []string{"VerifiableCredential", "BitstringStatusListCredential"},
+	}
+	slc.CredentialSubject.Id = listURL + "#list"
+	slc.CredentialSubject.Type = "BitstringStatusList"
+	slc.CredentialSubject.StatusPurpose = purpose
+	slc.CredentialSubject.EncodedList = encodedList
+
+	tok, err := is.signer.sealStatusListCredential(slc, time.Now().Add(statusListValidity))
+	if err != nil {
+		return err
+	}
+
+	c.Response().Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(statusListCacheMaxAge))
+	return c.Blob(http.StatusOK, "application/"+types.VCJWTMediaType, []byte(tok))
+}
+
+type changeCredentialStatusRequest struct {
+	Reason string `json:"reason"`
+}
+
+// changeCredentialStatusBySigner is the route for signers to revoke, suspend or unsuspend the credentials
+// of their organization
+func (is *IssuerServer) changeCredentialStatusBySigner(action string) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		signer, err := is.signerFromRequest(c)
+		if err != nil {
+			return err
+		}
+
+		actor := credentialActor{role: roleSigner, id: "signer:" + signer.Email()}
+		return is.changeCredentialStatus(c, action, signer.GetString("organizationIdentifier"), actor)
+	}
+}
+
+// changeCredentialStatusByLEAR is the route for LEARs to revoke, suspend or unsuspend the credentials
+// of their organization
+func (is *IssuerServer) changeCredentialStatusByLEAR(action string) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		authUser, err := is.requireLEAR(c)
+		if err != nil {
+			return err
+		}
+
+		actor := credentialActor{role: roleLEAR, id: "lear:" + authUser.Email}
+		return is.changeCredentialStatus(c, action, authUser.OrganizationIdentifier, actor)
+	}
+}
+
+// changeCredentialStatus applies the action to the credential in the path, recording the reason in the request
+// and the actor in the history of the credential. The credential must be of the organization of the actor and must
+// have been issued. Revocation and expiration are final, so the credential can not change its status after them.
+func (is *IssuerServer) changeCredentialStatus(c echo.Context, action string, organizationIdentifier string, actor credentialActor) error {
+	app := is.App
+
+	var request changeCredentialStatusRequest
+	if err := c.Bind(&request); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid request")
+	}
+	if len(request.Reason) == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "the reason is required")
+	}
+
+	id := c.PathParam("credid")
+	record, err := app.Dao().FindRecordById("credentials", id)
+	if err != nil || len(organizationIdentifier) == 0 || record.GetString("organizationIdentifier") != organizationIdentifier {
+		return echo.NewHTTPError(http.StatusNotFound, "credential "+id+" not found")
+	}
+
+	if record.GetInt("status_list_index") <= 0 {
+		return echo.NewHTTPError(http.StatusConflict, "the credential has not been issued")
+	}
+	status := record.GetString("status")
+	if status == credentialRevoked || status == credentialExpired {
+		return echo.NewHTTPError(http.StatusConflict, "the credential is "+status)
+	}
+
+	now := time.Now()
+	record.Set("status_reason", request.Reason)
+	record.Set("status_actor", actor.id)
+	record.Set("status_updated", now)
+
+	// Revocation is a change of state, while suspension is only recorded in the history
+	var event string
+	switch action {
+	case statusActionRevoke:
+		record.Set("revoked", now)
+		record.Set("suspended", false)
+		if err := is.transitionCredential(record, credentialRevoked, actor, request.Reason); err != nil {
+			return err
+		}
+	case statusActionSuspend:
+		if record.GetBool("suspended") {
+			return echo.NewHTTPError(http.StatusConflict, "the credential is already suspended")
+		}
+		record.Set("suspended", true)
+		event = credentialSuspendedEvent
+	case statusActionUnsuspend:
+		if !record.GetBool("suspended") {
+			return echo.NewHTTPError(http.StatusConflict, "the credential is not suspended")
+		}
+		record.Set("suspended", false)
+		event = credentialUnsuspendedEvent
+	default:
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid action "+action)
+	}
+
+	if len(event) > 0 {
+		err := app.Dao().RunInTransaction(func(txDao *daos.Dao) error {
+			if err := txDao.SaveRecord(record); err != nil {
+				return err
+			}
+			return is.addCredentialHistory(txDao, record.Id, status, status, event, actor, request.Reason)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return c.JSON(http.StatusOK, map[string]any{
+		"id":        record.Id,
+		"status":    record.GetString("status"),
+		"revoked":   !record.GetDateTime("revoked").IsZero(),
+		"suspended": record.GetBool("suspended"),
+	})
+}
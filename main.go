@@ -16,6 +16,7 @@ import (
 	"github.com/evidenceledger/vcdemo/client"
 	"github.com/evidenceledger/vcdemo/faster"
 	"github.com/evidenceledger/vcdemo/issuernew"
+	_ "github.com/evidenceledger/vcdemo/migrations"
 	"github.com/evidenceledger/vcdemo/verifiernew"
 	"github.com/evidenceledger/vcdemo/x509util"
 	"github.com/hesusruiz/vcutils/yaml"
@@ -84,6 +85,9 @@ func main() {
 	// Add the eIDAS-related commands
 	app.RootCmd.AddCommand(eIDASCommand(rootCfg))
 
+	// Add the commands to evaluate and test the authentication policies
+	app.RootCmd.AddCommand(policyCommand(rootCfg))
+
 	app.OnBeforeServe().Add(func(e *core.ServeEvent) error {
 		// Start Verifier and Wallet static server other services
 		return StartServices(rootCfg)
@@ -166,6 +170,114 @@ func eIDASCommand(rootCfg *yaml.YAML) *cobra.Command {
 	return eIDAScmd
 }
 
+func policyCommand(rootCfg *yaml.YAML) *cobra.Command {
+
+	// The main policy command
+	policycmd := &cobra.Command{
+		Use:   "policy",
+		Short: "Evaluate and test the authentication policies of the Verifier",
+	}
+
+	// By default, use the policy file configured for the Verifier
+	defaultPolicy := rootCfg.String("verifier.authnPolicies", "authn_policies.star")
+
+	// The builtins of the policies use the trusted issuers and power catalog of the Verifier
+	policyEnvironment := func() (*verifiernew.PolicyEnvironment, error) {
+		vcfg := rootCfg.Map("verifier")
+		if len(vcfg) == 0 {
+			return nil, nil
+		}
+		cfg, err := verifiernew.ConfigFromMap(yaml.New(vcfg))
+		if err != nil {
+			return nil, err
+		}
+		return verifiernew.NewPolicyEnvironment(cfg)
+	}
+
+	// Evaluate a policy with a credential, without a Wallet
+	var evalPolicy string
+	var evalInput string
+	var evalResource string
+	var evalAuthorize bool
+	evalcmd := &cobra.Command{
+		Use:   "eval credential_file",
+		Short: "Evaluates a policy against a credential in a JSON or YAML file, with a mocked request",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			f := &verifiernew.PolicyFixture{
+				Name:              args[0],
+				Credential:        args[0],
+				ProtectedResource: evalResource,
+			}
+			if evalAuthorize {
+				f.Decision = "authorize"
+			}
+			if len(evalInput) > 0 {
+				data, err := os.ReadFile(evalInput)
+				if err != nil {
+					return err
+				}
+				f.Input = &verifiernew.PolicyInput{}
+				if err := json.Unmarshal(data, f.Input); err != nil {
+					return fmt.Errorf("parsing input file: %w", err)
+				}
+			}
+
+			env, err := policyEnvironment()
+			if err != nil {
+				return err
+			}
+
+			res := verifiernew.EvaluatePolicyFixture(f, evalPolicy, env)
+			res.Print(os.Stdout)
+			return res.Err
+		},
+	}
+	evalcmd.Flags().StringVarP(&evalPolicy, "policy", "p", defaultPolicy, "Path to the policy file")
+	evalcmd.Flags().StringVarP(&evalInput, "input", "i", "", "Path to a JSON file with the input object for the policy")
+	evalcmd.Flags().StringVarP(&evalResource, "resource", "r", "", "The protected resource being accessed")
+	evalcmd.Flags().BoolVarP(&evalAuthorize, "authorize", "a", false, "Evaluate 'authorize' instead of 'authenticate'")
+
+	// Run a directory of fixtures with the expected decisions
+	var testPolicy string
+	testcmd := &cobra.Command{
+		Use:   "test fixtures_dir",
+		Short: "Runs the fixtures in a directory, checking that the decisions are the expected ones",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			env, err := policyEnvironment()
+			if err != nil {
+				return err
+			}
+
+			results, err := verifiernew.RunPolicyFixtures(args[0], testPolicy, env)
+			if err != nil {
+				return err
+			}
+
+			failed := 0
+			for _, res := range results {
+				res.Print(os.Stdout)
+				if res.Err != nil || !res.Passed {
+					failed++
+				}
+			}
+
+			fmt.Printf("\n%d fixtures, %d passed, %d failed\n", len(results), len(results)-failed, failed)
+			if failed > 0 {
+				return fmt.Errorf("%d fixtures failed", failed)
+			}
+			return nil
+		},
+	}
+	testcmd.Flags().StringVarP(&testPolicy, "policy", "p", defaultPolicy, "Path to the policy file, unless the fixture specifies one")
+
+	policycmd.AddCommand(evalcmd)
+	policycmd.AddCommand(testcmd)
+
+	return policycmd
+}
+
 // createCACert creates a test eIDAS CA certificate
 func createCACert(password, casubject, caoutput string) error {
 
@@ -0,0 +1,188 @@
+package migrations
+
+import (
+	"encoding/json"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/daos"
+	m "github.com/pocketbase/pocketbase/migrations"
+	"github.com/pocketbase/pocketbase/models"
+)
+
+func init() {
+	m.Register(func(db dbx.Builder) error {
+		jsonData := `{
+			"id": "q7w3nfx0ofr2k9d",
+			"created": "2026-10-19 08:30:00.000Z",
+			"updated": "2026-10-19 08:30:00.000Z",
+			"name": "credential_offers",
+			"type": "base",
+			"system": false,
+			"schema": [
+				{
+					"system": false,
+					"id": "k3d8wq1z",
+					"name": "credential",
+					"type": "text",
+					"required": true,
+					"presentable": false,
+					"unique": false,
+					"options": {
+						"min": null,
+						"max": null,
+						"pattern": ""
+					}
+				},
+				{
+					"system": false,
+					"id": "p9x2mv7c",
+					"name": "pre_authorized_code",
+					"type": "text",
+					"required": true,
+					"presentable": false,
+					"unique": false,
+					"options": {
+						"min": null,
+						"max": null,
+						"pattern": ""
+					}
+				},
+				{
+					"system": false,
+					"id": "t4n6hs0e",
+					"name": "tx_code_hash",
+					"type": "text",
+					"required": false,
+					"presentable": false,
+					"unique": false,
+					"options": {
+						"min": null,
+						"max": null,
+						"pattern": ""
+					}
+				},
+				{
+					"system": false,
+					"id": "a1f5gj8r",
+					"name": "tx_code_attempts",
+					"type": "number",
+					"required": false,
+					"presentable": false,
+					"unique": false,
+					"options": {
+						"min": 0,
+						"max": null,
+						"noDecimal": true
+					}
+				},
+				{
+					"system": false,
+					"id": "e7u3ky2b",
+					"name": "expires",
+					"type": "date",
+					"required": true,
+					"presentable": false,
+					"unique": false,
+					"options": {
+						"min": "",
+						"max": ""
+					}
+				},
+				{
+					"system": false,
+					"id": "r2v9lc4m",
+					"name": "redeemed",
+					"type": "date",
+					"required": false,
+					"presentable": false,
+					"unique": false,
+					"options": {
+						"min": "",
+						"max": ""
+					}
+				},
+				{
+					"system": false,
+					"id": "h8b1zx6q",
+					"name": "access_token_hash",
+					"type": "text",
+					"required": false,
+					"presentable": false,
+					"unique": false,
+					"options": {
+						"min": null,
+						"max": null,
+						"pattern": ""
+					}
+				},
+				{
+					"system": false,
+					"id": "w5o0dn3t",
+					"name": "access_token_expires",
+					"type": "date",
+					"required": false,
+					"presentable": false,
+					"unique": false,
+					"options": {
+						"min": "",
+						"max": ""
+					}
+				},
+				{
+					"system": false,
+					"id": "c6j4pe9y",
+					"name": "c_nonce",
+					"type": "text",
+					"required": false,
+					"presentable": false,
+					"unique": false,
+					"options": {
+						"min": null,
+						"max": null,
+						"pattern": ""
+					}
+				},
+				{
+					"system": false,
+					"id": "n0s7ri5u",
+					"name": "c_nonce_expires",
+					"type": "date",
+					"required": false,
+					"presentable": false,
+					"unique": false,
+					"options": {
+						"min": "",
+						"max": ""
+					}
+				}
+			],
+			"indexes": [
+				"CREATE UNIQUE INDEX idx_credential_offers_code ON credential_offers (pre_authorized_code)",
+				"CREATE INDEX idx_credential_offers_token ON credential_offers (access_token_hash)",
+				"CREATE INDEX idx_credential_offers_credential ON credential_offers (credential)"
+			],
+			"listRule": null,
+			"viewRule": null,
+			"createRule": null,
+			"updateRule": null,
+			"deleteRule": null,
+			"options": {}
+		}`
+
+		collection := &models.Collection{}
+		if err := json.Unmarshal([]byte(jsonData), &collection); err != nil {
+			return err
+		}
+
+		return daos.New(db).SaveCollection(collection)
+	}, func(db dbx.Builder) error {
+		dao := daos.New(db);
+
+		collection, err := dao.FindCollectionByNameOrId("q7w3nfx0ofr2k9d")
+		if err != nil {
+			return err
+		}
+
+		return dao.DeleteCollection(collection)
+	})
+}
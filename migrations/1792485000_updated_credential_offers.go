@@ -0,0 +1,55 @@
+package migrations
+
+import (
+	"encoding/json"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/daos"
+	m "github.com/pocketbase/pocketbase/migrations"
+	"github.com/pocketbase/pocketbase/models/schema"
+)
+
+func init() {
+	m.Register(func(db dbx.Builder) error {
+		dao := daos.New(db);
+
+		collection, err := dao.FindCollectionByNameOrId("q7w3nfx0ofr2k9d")
+		if err != nil {
+			return err
+		}
+
+		// add
+		new_transaction_id_hash := &schema.SchemaField{}
+		if err := json.Unmarshal([]byte(`{
+			"system": false,
+			"id": "x5r8kd2w",
+			"name": "transaction_id_hash",
+			"type": "text",
+			"required": false,
+			"presentable": false,
+			"unique": false,
+			"options": {
+				"min": null,
+				"max": null,
+				"pattern": ""
+			}
+		}`), new_transaction_id_hash); err != nil {
+			return err
+		}
+		collection.Schema.AddField(new_transaction_id_hash)
+
+		return dao.SaveCollection(collection)
+	}, func(db dbx.Builder) error {
+		dao := daos.New(db);
+
+		collection, err := dao.FindCollectionByNameOrId("q7w3nfx0ofr2k9d")
+		if err != nil {
+			return err
+		}
+
+		// remove
+		collection.Schema.RemoveField("x5r8kd2w")
+
+		return dao.SaveCollection(collection)
+	})
+}
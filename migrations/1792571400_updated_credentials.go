@@ -0,0 +1,174 @@
+package migrations
+
+import (
+	"encoding/json"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/daos"
+	m "github.com/pocketbase/pocketbase/migrations"
+	"github.com/pocketbase/pocketbase/models/schema"
+)
+
+func init() {
+	m.Register(func(db dbx.Builder) error {
+		dao := daos.New(db);
+
+		collection, err := dao.FindCollectionByNameOrId("8sflyv4gzaox8yp")
+		if err != nil {
+			return err
+		}
+
+		if err := json.Unmarshal([]byte(`[
+			"CREATE UNIQUE INDEX idx_credentials_status_list_index ON credentials (status_list_index) WHERE status_list_index > 0"
+		]`), &collection.Indexes); err != nil {
+			return err
+		}
+
+		// add
+		new_status_list_index := &schema.SchemaField{}
+		if err := json.Unmarshal([]byte(`{
+			"system": false,
+			"id": "s7q2lx4n",
+			"name": "status_list_index",
+			"type": "number",
+			"required": false,
+			"presentable": false,
+			"unique": false,
+			"options": {
+				"min": 0,
+				"max": null,
+				"noDecimal": true
+			}
+		}`), new_status_list_index); err != nil {
+			return err
+		}
+		collection.Schema.AddField(new_status_list_index)
+
+		// add
+		new_revoked := &schema.SchemaField{}
+		if err := json.Unmarshal([]byte(`{
+			"system": false,
+			"id": "r4v9cp1m",
+			"name": "revoked",
+			"type": "date",
+			"required": false,
+			"presentable": false,
+			"unique": false,
+			"options": {
+				"min": "",
+				"max": ""
+			}
+		}`), new_revoked); err != nil {
+			return err
+		}
+		collection.Schema.AddField(new_revoked)
+
+		// add
+		new_suspended := &schema.SchemaField{}
+		if err := json.Unmarshal([]byte(`{
+			"system": false,
+			"id": "u2h6wn8e",
+			"name": "suspended",
+			"type": "bool",
+			"required": false,
+			"presentable": false,
+			"unique": false,
+			"options": {}
+		}`), new_suspended); err != nil {
+			return err
+		}
+		collection.Schema.AddField(new_suspended)
+
+		// add
+		new_status_reason := &schema.SchemaField{}
+		if err := json.Unmarshal([]byte(`{
+			"system": false,
+			"id": "y8b3ft5k",
+			"name": "status_reason",
+			"type": "text",
+			"required": false,
+			"presentable": false,
+			"unique": false,
+			"options": {
+				"min": null,
+				"max": null,
+				"pattern": ""
+			}
+		}`), new_status_reason); err != nil {
+			return err
+		}
+		collection.Schema.AddField(new_status_reason)
+
+		// add
+		new_status_actor := &schema.SchemaField{}
+		if err := json.Unmarshal([]byte(`{
+			"system": false,
+			"id": "g6m1qz7d",
+			"name": "status_actor",
+			"type": "text",
+			"required": false,
+			"presentable": false,
+			"unique": false,
+			"options": {
+				"min": null,
+				"max": null,
+				"pattern": ""
+			}
+		}`), new_status_actor); err != nil {
+			return err
+		}
+		collection.Schema.AddField(new_status_actor)
+
+		// add
+		new_status_updated := &schema.SchemaField{}
+		if err := json.Unmarshal([]byte(`{
+			"system": false,
+			"id": "w3j9rs0v",
+			"name": "status_updated",
+			"type": "date",
+			"required": false,
+			"presentable": false,
+			"unique": false,
+			"options": {
+				"min": "",
+				"max": ""
+			}
+		}`), new_status_updated); err != nil {
+			return err
+		}
+		collection.Schema.AddField(new_status_updated)
+
+		return dao.SaveCollection(collection)
+	}, func(db dbx.Builder) error {
+		dao := daos.New(db);
+
+		collection, err := dao.FindCollectionByNameOrId("8sflyv4gzaox8yp")
+		if err != nil {
+			return err
+		}
+
+		if err := json.Unmarshal([]byte(`[]`), &collection.Indexes); err != nil {
+			return err
+		}
+
+		// remove
+		collection.Schema.RemoveField("s7q2lx4n")
+
+		// remove
+		collection.Schema.RemoveField("r4v9cp1m")
+
+		// remove
+		collection.Schema.RemoveField("u2h6wn8e")
+
+		// remove
+		collection.Schema.RemoveField("y8b3ft5k")
+
+		// remove
+		collection.Schema.RemoveField("g6m1qz7d")
+
+		// remove
+		collection.Schema.RemoveField("w3j9rs0v")
+
+		return dao.SaveCollection(collection)
+	})
+}
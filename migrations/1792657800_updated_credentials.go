@@ -0,0 +1,81 @@
+package migrations
+
+import (
+	"encoding/json"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/daos"
+	m "github.com/pocketbase/pocketbase/migrations"
+	"github.com/pocketbase/pocketbase/models/schema"
+)
+
+func init() {
+	m.Register(func(db dbx.Builder) error {
+		dao := daos.New(db);
+
+		collection, err := dao.FindCollectionByNameOrId("8sflyv4gzaox8yp")
+		if err != nil {
+			return err
+		}
+
+		// update
+		edit_status := &schema.SchemaField{}
+		if err := json.Unmarshal([]byte(`{
+			"system": false,
+			"id": "w7enstxq",
+			"name": "status",
+			"type": "select",
+			"required": false,
+			"presentable": false,
+			"unique": false,
+			"options": {
+				"maxSelect": 1,
+				"values": [
+					"offered",
+					"holder_bound",
+					"tobesigned",
+					"signed",
+					"revoked",
+					"expired"
+				]
+			}
+		}`), edit_status); err != nil {
+			return err
+		}
+		collection.Schema.AddField(edit_status)
+
+		return dao.SaveCollection(collection)
+	}, func(db dbx.Builder) error {
+		dao := daos.New(db);
+
+		collection, err := dao.FindCollectionByNameOrId("8sflyv4gzaox8yp")
+		if err != nil {
+			return err
+		}
+
+		// update
+		edit_status := &schema.SchemaField{}
+		if err := json.Unmarshal([]byte(`{
+			"system": false,
+			"id": "w7enstxq",
+			"name": "status",
+			"type": "select",
+			"required": false,
+			"presentable": false,
+			"unique": false,
+			"options": {
+				"maxSelect": 1,
+				"values": [
+					"offered",
+					"tobesigned",
+					"signed"
+				]
+			}
+		}`), edit_status); err != nil {
+			return err
+		}
+		collection.Schema.AddField(edit_status)
+
+		return dao.SaveCollection(collection)
+	})
+}
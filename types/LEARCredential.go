@@ -2,9 +2,7 @@ package types
 
 import (
 	"fmt"
-	"time"
 
-	"github.com/golang-jwt/jwt/v5"
 	"github.com/hesusruiz/vcutils/yaml"
 	"github.com/invopop/validation"
 )
@@ -23,25 +21,28 @@ type Mandate struct {
 	} `json:"mandator,omitempty"`
 	Mandatee struct {
 		Id           string `json:"id,omitempty"`
-		FirstName   string `json:"firstName,omitempty"`
-		LastName    string `json:"lastName,omitempty"`
+		FirstName    string `json:"firstName,omitempty"`
+		LastName     string `json:"lastName,omitempty"`
 		Gender       string `json:"gender,omitempty"`
 		Email        string `json:"email,omitempty"`
 		Mobile_phone string `json:"mobile_phone,omitempty"`
 	} `json:"mandatee,omitempty"`
-	Power []struct {
-		Id           string   `json:"id,omitempty"`
-		Tmf_type     string   `json:"type,omitempty"`
-		Tmf_domain   []string `json:"domain,omitempty"`
-		Tmf_function string   `json:"function,omitempty"`
-		Tmf_action   []string `json:"action,omitempty"`
-	} `json:"power,omitempty"`
+	Power    []Power `json:"power,omitempty"`
 	LifeSpan struct {
 		StartDateTime string `json:"start_date_time,omitempty"`
 		EndDateTime   string `json:"end_date_time,omitempty"`
 	} `json:"life_span,omitempty"`
 }
 
+// Power is a power delegated by the Mandator to the Mandatee
+type Power struct {
+	Id           string   `json:"id,omitempty"`
+	Tmf_type     string   `json:"type,omitempty"`
+	Tmf_domain   []string `json:"domain,omitempty"`
+	Tmf_function string   `json:"function,omitempty"`
+	Tmf_action   []string `json:"action,omitempty"`
+}
+
 type LEARCredentialEmployee struct {
 	Context        []string `json:"@context,omitempty"`
 	Id             string   `json:"id,omitempty"`
@@ -57,42 +58,6 @@ type LEARCredentialEmployee struct {
 	} `json:"credentialSubject,omitempty"`
 }
 
-type LEARCredentialEmployeeJWTClaims struct {
-	LEARCredentialEmployee
-	jwt.RegisteredClaims
-}
-
-// CreateLEARCredentialJWTtoken creates a JWT token from the given claims,
-// signed with the first private key associated to the issuer DID
-func CreateLEARCredentialJWTtoken(learCred LEARCredentialEmployee, sigMethod jwt.SigningMethod, privateKey any) (string, error) {
-
-	// Prepare some fields of the LEARCredential
-	now := time.Now()
-
-	// Create claims with multiple fields populated
-	claims := LEARCredentialEmployeeJWTClaims{
-		learCred,
-		jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(now.Add(24 * 365 * time.Hour)),
-			IssuedAt:  jwt.NewNumericDate(now),
-			NotBefore: jwt.NewNumericDate(now),
-			Issuer:    learCred.Issuer.Id,
-			Subject:   learCred.CredentialSubject.Mandate.Mandatee.Id,
-			ID:        learCred.Id,
-			Audience:  []string{"everybody"},
-		},
-	}
-
-	// Serialize and sign the JWT. The result is a byte array with the JWT in compact form:
-	// header.payload.signature
-	token := jwt.NewWithClaims(sigMethod, claims)
-	ss, err := token.SignedString(privateKey)
-	fmt.Println(ss, err)
-
-	return ss, nil
-
-}
-
 func LEARCredentialFromMap(s map[string]any) (err error) {
 	// s, ok := sourceany.(map[string]any)
 	// if !ok {
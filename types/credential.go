@@ -0,0 +1,64 @@
+package types
+
+import (
+	"crypto/x509"
+	"fmt"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// CreateCredentialJWT seals a credential of any type with the private key of the eIDAS certificate which is the
+// first in certChain. The issuer of the credential is the 'did:elsi' DID derived from the organizationIdentifier of
+// the certificate, and the header includes the certificate chain and the JAdES baseline-B headers, so any verifier
+// can check the seal offline. The subject is the DID of the holder, if the credential is already bound to one, and
+// the JWT expires at the end of the validity of the credential.
+func CreateCredentialJWT(credential map[string]any, subject string, validUntil time.Time, sigMethod jwt.SigningMethod, privateKey any, certChain []*x509.Certificate) (string, error) {
+
+	if len(certChain) == 0 {
+		return "", fmt.Errorf("the certificate chain is required to seal a credential")
+	}
+
+	// The issuer is the organization of the certificate, whatever was specified in the credential
+	issuerDID, err := ELSIDIDFromCertificate(certChain[0])
+	if err != nil {
+		return "", err
+	}
+
+	claims := jwt.MapClaims{}
+	for k, v := range credential {
+		claims[k] = v
+	}
+	issuer := map[string]any{}
+	if original, ok := credential["issuer"].(map[string]any); ok {
+		for k, v := range original {
+			issuer[k] = v
+		}
+	}
+	issuer["id"] = issuerDID
+	claims["issuer"] = issuer
+
+	now := time.Now()
+	claims["exp"] = jwt.NewNumericDate(validUntil)
+	claims["iat"] = jwt.NewNumericDate(now)
+	claims["nbf"] = jwt.NewNumericDate(now)
+	claims["iss"] = issuerDID
+	claims["aud"] = []string{"everybody"}
+	if len(subject) > 0 {
+		claims["sub"] = subject
+	}
+	if id, ok := credential["id"].(string); ok {
+		claims["jti"] = id
+	}
+
+	token := jwt.NewWithClaims(sigMethod, claims)
+	if err := setJAdESHeaders(token, certChain, now); err != nil {
+		return "", err
+	}
+	ss, err := token.SignedString(privateKey)
+	if err != nil {
+		return "", fmt.Errorf("signing credential: %w", err)
+	}
+
+	return ss, nil
+}
@@ -0,0 +1,72 @@
+package types
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"errors"
+	"math/big"
+	"time"
+
+	"github.com/evidenceledger/vcdemo/vault/x509util"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// The media type of credentials secured with JWT, as defined in the VC-JOSE-COSE specification
+const VCJWTMediaType = "vc+jwt"
+
+// ELSIDIDFromCertificate returns the 'did:elsi' DID of the organization of an eIDAS certificate,
+// which is derived from the organizationIdentifier (OID 2.5.4.97) of the subject.
+func ELSIDIDFromCertificate(cert *x509.Certificate) (string, error) {
+	subject := x509util.ParseEIDASNameFromATVSequence(cert.Subject.Names)
+	if len(subject.OrganizationIdentifier) == 0 {
+		return "", errors.New("the certificate does not have an organizationIdentifier")
+	}
+	return "did:elsi:" + subject.OrganizationIdentifier, nil
+}
+
+// issuerSerial is the IssuerSerial structure of RFC 5035, identifying a certificate by its issuer and serial number
+type issuerSerial struct {
+	Issuer []asn1.RawValue
+	Serial *big.Int
+}
+
+// setJAdESHeaders sets in the token the headers of a JAdES baseline-B signature (ETSI TS 119 182-1) with the
+// certificate chain, where the first certificate is the one of the signing key:
+//
+//   - x5c: the certificate chain, with the DER of each certificate in standard base64
+//   - x5t#S256: the SHA-256 thumbprint of the certificate
+//   - kid: the DER of the IssuerSerial of the certificate, in standard base64
+//   - sigT: the claimed signing time, which must be understood by the verifiers, so it is listed in 'crit'
+func setJAdESHeaders(token *jwt.Token, certChain []*x509.Certificate, signingTime time.Time) error {
+	if len(certChain) == 0 {
+		return errors.New("the certificate chain is required to seal a credential")
+	}
+	cert := certChain[0]
+
+	x5c := make([]string, len(certChain))
+	for i, c := range certChain {
+		x5c[i] = base64.StdEncoding.EncodeToString(c.Raw)
+	}
+
+	thumbprint := sha256.Sum256(cert.Raw)
+
+	// The issuer in IssuerSerial is a GeneralNames with a directoryName, which is explicitly tagged with [4]
+	kid, err := asn1.Marshal(issuerSerial{
+		Issuer: []asn1.RawValue{{Class: asn1.ClassContextSpecific, Tag: 4, IsCompound: true, Bytes: cert.RawIssuer}},
+		Serial: cert.SerialNumber,
+	})
+	if err != nil {
+		return err
+	}
+
+	token.Header["typ"] = VCJWTMediaType
+	token.Header["x5c"] = x5c
+	token.Header["x5t#S256"] = base64.RawURLEncoding.EncodeToString(thumbprint[:])
+	token.Header["kid"] = base64.StdEncoding.EncodeToString(kid)
+	token.Header["sigT"] = signingTime.UTC().Format("2006-01-02T15:04:05Z")
+	token.Header["crit"] = []string{"sigT"}
+
+	return nil
+}
@@ -0,0 +1,145 @@
+package types
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/multiformats/go-multibase"
+)
+
+// The purposes of the status lists published by the Issuer
+const (
+	StatusPurposeRevocation = "revocation"
+	StatusPurposeSuspension = "suspension"
+)
+
+// StatusListSize is the number of entries of a status list. The minimum of the Bitstring Status List
+// specification (16KB) is used, so the list does not reveal how many credentials were issued.
+const StatusListSize = 131072
+
+// MaxStatusListBytes is the maximum size of a decoded status list, which is much larger than the lists of the Issuer.
+// The encoded lists are compressed, so a small list could be decompressed into a huge one.
+const MaxStatusListBytes = 64 * StatusListSize / 8
+
+// BitstringStatusListEntry is the 'credentialStatus' of a credential, pointing to its bit in a status list
+type BitstringStatusListEntry struct {
+	Id                   string `json:"id,omitempty"`
+	Type                 string `json:"type"`
+	StatusPurpose        string `json:"statusPurpose"`
+	StatusListIndex      string `json:"statusListIndex"`
+	StatusListCredential string `json:"statusListCredential"`
+}
+
+// BitstringStatusListCredential is the credential published by the Issuer with the status of its credentials
+type BitstringStatusListCredential struct {
+	Context           []string `json:"@context"`
+	Id                string   `json:"id"`
+	TypeCredential    []string `json:"type"`
+	Issuer            string   `json:"issuer"`
+	ValidFrom         string   `json:"validFrom,omitempty"`
+	ValidUntil        string   `json:"validUntil,omitempty"`
+	CredentialSubject struct {
+		Id            string `json:"id"`
+		Type          string `json:"type"`
+		StatusPurpose string `json:"statusPurpose"`
+		EncodedList   string `json:"encodedList"`
+	} `json:"credentialSubject"`
+}
+
+type BitstringStatusListCredentialJWTClaims struct {
+	BitstringStatusListCredential
+	jwt.RegisteredClaims
+}
+
+// EncodeStatusList compresses the bitstring with GZIP and encodes it in multibase base64url, as 'encodedList'
+func EncodeStatusList(bitstring []byte) (string, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(bitstring); err != nil {
+		return "", err
+	}
+	if err := zw.Close(); err != nil {
+		return "", err
+	}
+	return multibase.Encode(multibase.Base64url, buf.Bytes())
+}
+
+// DecodeStatusList returns the bitstring of an 'encodedList', which can not be larger than MaxStatusListBytes
+func DecodeStatusList(encodedList string) ([]byte, error) {
+	_, compressed, err := multibase.Decode(encodedList)
+	if err != nil {
+		return nil, fmt.Errorf("decoding status list: %w", err)
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return nil, fmt.Errorf("decompressing status list: %w", err)
+	}
+	bitstring, err := io.ReadAll(io.LimitReader(zr, MaxStatusListBytes+1))
+	if err != nil {
+		return nil, fmt.Errorf("decompressing status list: %w", err)
+	}
+	if len(bitstring) > MaxStatusListBytes {
+		return nil, fmt.Errorf("status list larger than %d bytes", MaxStatusListBytes)
+	}
+	return bitstring, nil
+}
+
+// SetStatusListBit sets the bit of the entry with the index. The first index is the left-most bit of the first byte.
+func SetStatusListBit(bitstring []byte, index int) {
+	bitstring[index/8] |= 0x80 >> (index % 8)
+}
+
+// StatusListBit reports if the bit of the entry with the index is set
+func StatusListBit(bitstring []byte, index int) (bool, error) {
+	if index < 0 || index/8 >= len(bitstring) {
+		return false, fmt.Errorf("status list index %d out of range", index)
+	}
+	return bitstring[index/8]&(0x80>>(index%8)) != 0, nil
+}
+
+// CreateStatusListCredentialJWT seals the status list credential with the private key of the eIDAS certificate
+// which is the first in certChain, in the same way as the credentials whose status it publishes
+func CreateStatusListCredentialJWT(slc BitstringStatusListCredential, validUntil time.Time, sigMethod jwt.SigningMethod, privateKey any, certChain []*x509.Certificate) (string, error) {
+
+	if len(certChain) == 0 {
+		return "", fmt.Errorf("the certificate chain is required to seal a status list")
+	}
+
+	issuerDID, err := ELSIDIDFromCertificate(certChain[0])
+	if err != nil {
+		return "", err
+	}
+	slc.Issuer = issuerDID
+
+	now := time.Now()
+	slc.ValidFrom = now.UTC().Format(time.RFC3339)
+	slc.ValidUntil = validUntil.UTC().Format(time.RFC3339)
+
+	claims := BitstringStatusListCredentialJWTClaims{
+		slc,
+		jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(validUntil),
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
+			Issuer:    issuerDID,
+			Subject:   slc.CredentialSubject.Id,
+			ID:        slc.Id,
+		},
+	}
+
+	token := jwt.NewWithClaims(sigMethod, claims)
+	if err := setJAdESHeaders(token, certChain, now); err != nil {
+		return "", err
+	}
+	ss, err := token.SignedString(privateKey)
+	if err != nil {
+		return "", fmt.Errorf("signing status list: %w", err)
+	}
+
+	return ss, nil
+}
@@ -0,0 +1,150 @@
+package types
+
+import (
+	"bytes"
+	"compress/gzip"
+	"testing"
+
+	"github.com/multiformats/go-multibase"
+)
+
+func TestStatusListBit(t *testing.T) {
+	tests := []struct {
+		name    string
+		set     []int
+		index   int
+		want    bool
+		wantErr bool
+	}{
+		{
+			name:  "first bit is the left-most of the first byte",
+			set:   []int{0},
+			index: 0,
+			want:  true,
+		},
+		{
+			name:  "neighbour bits are not set",
+			set:   []int{9},
+			index: 8,
+			want:  false,
+		},
+		{
+			name:  "bit in the second byte",
+			set:   []int{9},
+			index: 9,
+			want:  true,
+		},
+		{
+			name:  "last bit of the list",
+			set:   []int{StatusListSize - 1},
+			index: StatusListSize - 1,
+			want:  true,
+		},
+		{
+			name:    "index after the end of the list",
+			index:   StatusListSize,
+			wantErr: true,
+		},
+		{
+			name:    "negative index",
+			index:   -1,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bitstring := make([]byte, StatusListSize/8)
+			for _, index := range tt.set {
+				SetStatusListBit(bitstring, index)
+			}
+
+			got, err := StatusListBit(bitstring, tt.index)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("StatusListBit() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("StatusListBit() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeStatusList(t *testing.T) {
+	bitstring := make([]byte, StatusListSize/8)
+	SetStatusListBit(bitstring, 42)
+	encodedList, err := EncodeStatusList(bitstring)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		encodedList string
+		wantLen     int
+		wantErr     bool
+	}{
+		{
+			name:        "roundtrip",
+			encodedList: encodedList,
+			wantLen:     StatusListSize / 8,
+		},
+		{
+			name:        "largest list allowed",
+			encodedList: gzipMultibase(t, MaxStatusListBytes),
+			wantLen:     MaxStatusListBytes,
+		},
+		{
+			name:        "compressed list too large",
+			encodedList: gzipMultibase(t, MaxStatusListBytes+1),
+			wantErr:     true,
+		},
+		{
+			name:        "not multibase",
+			encodedList: "!notmultibase",
+			wantErr:     true,
+		},
+		{
+			name:        "not gzip",
+			encodedList: "uAAAA",
+			wantErr:     true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := DecodeStatusList(tt.encodedList)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("DecodeStatusList() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if len(got) != tt.wantLen {
+				t.Errorf("DecodeStatusList() length = %v, want %v", len(got), tt.wantLen)
+			}
+		})
+	}
+
+	got, err := DecodeStatusList(encodedList)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if set, _ := StatusListBit(got, 42); !set {
+		t.Errorf("DecodeStatusList() lost the bit of index 42")
+	}
+}
+
+// gzipMultibase returns an 'encodedList' of a list of 'size' zero bytes, which compresses to a small fraction of it
+func gzipMultibase(t *testing.T, size int) string {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(make([]byte, size)); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	encoded, err := multibase.Encode(multibase.Base64url, buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return encoded
+}
@@ -0,0 +1,198 @@
+package verifiernew
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/evidenceledger/vcdemo/internal/did"
+	"github.com/evidenceledger/vcdemo/types"
+	"github.com/evidenceledger/vcdemo/verifiernew/storage"
+	"github.com/evidenceledger/vcdemo/x509util"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/hesusruiz/vcutils/yaml"
+)
+
+// checkACRProfile verifies that the presentation received from the Wallet satisfies the requirements of the
+// ACR profile requested by the Client. It returns the Authentication Method References achieved, to be included
+// in the 'amr' claim of the ID token.
+func checkACRProfile(profile *storage.ACRProfile, vpJWT string, credentialJWT string, credential *yaml.YAML) (amr []string, err error) {
+
+	// The user authenticated with a Verifiable Credential
+	amr = []string{"vc"}
+
+	if !profile.Accepts(credential.ListString("type")) {
+		return nil, fmt.Errorf("credential type not accepted for acr %s", profile.Name)
+	}
+
+	if profile.QualifiedSeal {
+		if err := verifyQualifiedSeal(credentialJWT); err != nil {
+			return nil, fmt.Errorf("acr %s requires a qualified seal: %w", profile.Name, err)
+		}
+	}
+
+	if profile.HolderBinding {
+		holderDID := credential.String("credentialSubject.mandate.mandatee.id")
+		if err := verifyHolderBinding(vpJWT, holderDID); err != nil {
+			return nil, fmt.Errorf("acr %s requires holder binding: %w", profile.Name, err)
+		}
+
+		// The user proved possession of the key bound to the credential
+		amr = append(amr, "pop")
+	}
+
+	return amr, nil
+}
+
+// verifyQualifiedSeal checks that the credential JWT is sealed with a certificate issued by a trusted CA,
+// and that the certificate is an eIDAS qualified certificate valid now.
+func verifyQualifiedSeal(credentialJWT string) error {
+	if len(credentialJWT) == 0 {
+		return fmt.Errorf("the credential is not a JWT, so it is not sealed")
+	}
+
+	cert, _, err := sealCertificate(credentialJWT)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	if now.Before(cert.NotBefore) || now.After(cert.NotAfter) {
+		return fmt.Errorf("certificate is not valid now")
+	}
+	if !x509util.IsQualifiedCertificate(cert) {
+		return fmt.Errorf("certificate is not qualified")
+	}
+
+	return nil
+}
+
+// The algorithms accepted in the seals of the credentials
+var sealSigningAlgorithms = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512", "EdDSA"}
+
+// sealTrustAnchors are the certificates of the CAs trusted to issue the certificates sealing the credentials,
+// like the ones in the EU Trusted Lists. Without them no seal can be validated.
+var sealTrustAnchors *x509.CertPool
+
+// loadTrustAnchors reads the certificates of the trusted CAs from a PEM file
+func loadTrustAnchors(fileName string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %s", fileName)
+	}
+	return pool, nil
+}
+
+// sealCertificate verifies the signature of the credential JWT with the key of the certificate in the 'x5c' header,
+// and validates the chain of the certificate up to one of the trust anchors. It returns the certificate and the
+// 'did:elsi' DID of its organization, which must be both the 'iss' of the JWT and the issuer of the credential.
+func sealCertificate(credentialJWT string) (*x509.Certificate, string, error) {
+	var chain []*x509.Certificate
+	var claims = jwt.MapClaims{}
+
+	_, err := jwt.NewParser(jwt.WithValidMethods(sealSigningAlgorithms)).ParseWithClaims(credentialJWT, &claims, func(t *jwt.Token) (any, error) {
+		x5c, ok := t.Header["x5c"].([]any)
+		if !ok || len(x5c) == 0 {
+			return nil, fmt.Errorf("no x5c header in credential")
+		}
+		for _, c := range x5c {
+			encoded, ok := c.(string)
+			if !ok {
+				return nil, fmt.Errorf("invalid x5c header in credential")
+			}
+			der, err := base64.StdEncoding.DecodeString(encoded)
+			if err != nil {
+				return nil, err
+			}
+			cert, err := x509.ParseCertificate(der)
+			if err != nil {
+				return nil, err
+			}
+			chain = append(chain, cert)
+		}
+		return chain[0].PublicKey, nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	cert := chain[0]
+
+	// The certificate must be issued by a trusted CA, with the rest of the chain as intermediates
+	if sealTrustAnchors == nil {
+		return nil, "", fmt.Errorf("no trust anchors configured to validate the seal")
+	}
+	intermediates := x509.NewCertPool()
+	for _, c := range chain[1:] {
+		intermediates.AddCert(c)
+	}
+	_, err = cert.Verify(x509.VerifyOptions{
+		Roots:         sealTrustAnchors,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		return nil, "", fmt.Errorf("the certificate of the seal is not trusted: %w", err)
+	}
+
+	// The credential can only claim to be issued by the organization of the certificate
+	issuerDID, err := types.ELSIDIDFromCertificate(cert)
+	if err != nil {
+		return nil, "", err
+	}
+	if iss, _ := claims.GetIssuer(); iss != issuerDID {
+		return nil, "", fmt.Errorf("the iss %q is not the organization of the certificate", iss)
+	}
+	if issuer := credentialIssuer(claims); issuer != issuerDID {
+		return nil, "", fmt.Errorf("the issuer %q is not the organization of the certificate", issuer)
+	}
+
+	return cert, issuerDID, nil
+}
+
+// credentialIssuer returns the issuer of the credential in the claims of its JWT, which is in the 'vc' claim
+// for credentials of the VC Data Model 1.1. The issuer can be a string or an object with an 'id'.
+func credentialIssuer(claims jwt.MapClaims) string {
+	credential := map[string]any(claims)
+	if vc, ok := claims["vc"].(map[string]any); ok {
+		credential = vc
+	}
+	switch issuer := credential["issuer"].(type) {
+	case string:
+		return issuer
+	case map[string]any:
+		id, _ := issuer["id"].(string)
+		return id
+	}
+	return ""
+}
+
+// verifyHolderBinding checks that the VP JWT is signed with the key of the DID of the holder of the credential
+func verifyHolderBinding(vpJWT string, holderDID string) error {
+	if len(holderDID) == 0 {
+		return fmt.Errorf("credential is not bound to a holder DID")
+	}
+	if len(vpJWT) == 0 {
+		return fmt.Errorf("the presentation is not a JWT signed by the holder")
+	}
+
+	var claims = jwt.MapClaims{}
+	_, err := jwt.NewParser().ParseWithClaims(vpJWT, &claims, func(t *jwt.Token) (any, error) {
+		return did.PublicKeyFromDIDKey(holderDID)
+	})
+	if err != nil {
+		return err
+	}
+
+	// The issuer of the presentation must be the holder
+	if iss, _ := claims.GetIssuer(); len(iss) > 0 && iss != holderDID {
+		return fmt.Errorf("presentation issued by %s, not by the holder", iss)
+	}
+
+	return nil
+}
@@ -3,19 +3,36 @@ package verifiernew
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 
+	"github.com/evidenceledger/vcdemo/verifiernew/storage"
 	"github.com/go-ozzo/ozzo-validation/v4/is"
 	"github.com/hesusruiz/vcutils/yaml"
 	val "github.com/invopop/validation"
 )
 
 type Config struct {
-	ListenAddress          string   `json:"listenAddress,omitempty"`
-	VerifierURL            string   `json:"verifierURL,omitempty"`
-	AuthnPolicies          string   `json:"authnPolicies,omitempty"`
-	SamedeviceWallet       string   `json:"samedeviceWallet,omitempty"`
-	CredentialTemplatesDir string   `json:"credentialTemplatesDir,omitempty"`
-	RegisteredClients      []Client `json:"registeredClients,omitempty"`
+	ListenAddress          string               `json:"listenAddress,omitempty"`
+	VerifierURL            string               `json:"verifierURL,omitempty"`
+	AuthnPolicies          string               `json:"authnPolicies,omitempty"`
+	ScopePolicies          map[string]string    `json:"scopePolicies,omitempty"`
+	TrustedIssuers         []string             `json:"trustedIssuers,omitempty"`
+	TrustAnchors           string               `json:"trustAnchors,omitempty"`
+	StatusListOrigins      map[string][]string  `json:"statusListOrigins,omitempty"`
+	PowerCatalog           string               `json:"powerCatalog,omitempty"`
+	PolicyMaxSteps         uint64               `json:"policyMaxSteps,omitempty"`
+	PolicyTimeout          int                  `json:"policyTimeout,omitempty"`
+	SamedeviceWallet       string               `json:"samedeviceWallet,omitempty"`
+	CredentialTemplatesDir string               `json:"credentialTemplatesDir,omitempty"`
+	SessionMaxAge          int                  `json:"sessionMaxAge,omitempty"`
+	ACRProfiles            []storage.ACRProfile `json:"acrProfiles,omitempty"`
+	LegacyWalletResponse   bool                 `json:"legacyWalletResponse,omitempty"`
+	RegisteredClients      []Client             `json:"registeredClients,omitempty"`
+	ProxyRoutes            []ProxyRoute         `json:"proxyRoutes,omitempty"`
+	AuditLog               string               `json:"auditLog,omitempty"`
+	AuditMinimise          bool                 `json:"auditMinimise,omitempty"`
+	AuditKey               string               `json:"auditKey,omitempty"`
+	AuditAdmins            []string             `json:"auditAdmins,omitempty"`
 }
 
 type Client struct {
@@ -23,6 +40,17 @@ type Client struct {
 	Type         string   `json:"type,omitempty"`
 	Secret       string   `json:"secret,omitempty"`
 	RedirectURIs []string `json:"redirectURIs,omitempty"`
+	Policy       string   `json:"policy,omitempty"`
+}
+
+// ProxyRoute is a route of the reverse proxy Policy Enforcement Point.
+// Requests to /pep/{prefix}/... are forwarded to the upstream URL when the 'authorize' policy allows them.
+type ProxyRoute struct {
+	Prefix   string `json:"prefix,omitempty"`
+	Upstream string `json:"upstream,omitempty"`
+
+	// ClientID, if specified, is the only Client whose access tokens are accepted in the route
+	ClientID string `json:"clientID,omitempty"`
 }
 
 var defaultConfig = Config{
@@ -31,6 +59,9 @@ var defaultConfig = Config{
 	AuthnPolicies:          "authn_policies.star",
 	SamedeviceWallet:       "https://wallet.mycredential.eu",
 	CredentialTemplatesDir: "data/credential_templates",
+	SessionMaxAge:          8 * 3600,
+	PolicyMaxSteps:         1000000,
+	PolicyTimeout:          1000,
 }
 
 func ConfigFromMap(cfg *yaml.YAML) (*Config, error) {
@@ -75,6 +106,23 @@ func (s *Config) Validate() (err error) {
 	if len(s.CredentialTemplatesDir) == 0 {
 		s.CredentialTemplatesDir = defaultConfig.CredentialTemplatesDir
 	}
+	if s.SessionMaxAge == 0 {
+		s.SessionMaxAge = defaultConfig.SessionMaxAge
+	}
+	if s.PolicyMaxSteps == 0 {
+		s.PolicyMaxSteps = defaultConfig.PolicyMaxSteps
+	}
+	if s.PolicyTimeout == 0 {
+		s.PolicyTimeout = defaultConfig.PolicyTimeout
+	}
+	if len(s.ACRProfiles) == 0 {
+		s.ACRProfiles = storage.DefaultACRProfiles
+	}
+	for _, p := range s.ACRProfiles {
+		if len(p.Name) == 0 {
+			return errors.New("acrProfiles must have a name")
+		}
+	}
 
 	err = val.ValidateStruct(s,
 		val.Field(&s.ListenAddress, val.Required),
@@ -82,6 +130,8 @@ func (s *Config) Validate() (err error) {
 		val.Field(&s.AuthnPolicies, val.Required),
 		val.Field(&s.SamedeviceWallet, val.Required, is.URL),
 		val.Field(&s.CredentialTemplatesDir, val.Required),
+		val.Field(&s.SessionMaxAge, val.Min(0)),
+		val.Field(&s.PolicyTimeout, val.Min(0)),
 	)
 
 	if err != nil {
@@ -90,9 +140,26 @@ func (s *Config) Validate() (err error) {
 
 	if len(s.RegisteredClients) > 0 {
 		err = val.Validate(&s.RegisteredClients, val.Required)
+		if err != nil {
+			return err
+		}
+	}
+
+	if s.AuditMinimise && len(s.AuditKey) == 0 {
+		return errors.New("auditKey is required to minimise personal data in the audit log")
+	}
+
+	for _, route := range s.ProxyRoutes {
+		err = val.ValidateStruct(&route,
+			val.Field(&route.Prefix, val.Required),
+			val.Field(&route.Upstream, val.Required, is.URL),
+		)
+		if err != nil {
+			return fmt.Errorf("proxyRoutes: %w", err)
+		}
 	}
 
-	return err
+	return nil
 }
 
 func (s *Config) Copy() Config {
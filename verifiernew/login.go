@@ -4,18 +4,18 @@ import (
 	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"log"
+	"log/slog"
 	"net/http"
 	"net/url"
-	"strings"
 
+	"github.com/evidenceledger/vcdemo/internal/cache"
 	"github.com/evidenceledger/vcdemo/verifiernew/storage"
 	"github.com/foolin/goview"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/cors"
-	"github.com/golang-jwt/jwt/v5"
 	"github.com/hesusruiz/vcutils/yaml"
 	"github.com/sirupsen/logrus"
 	"github.com/skip2/go-qrcode"
@@ -31,6 +31,7 @@ type login struct {
 	authenticate authenticate
 	router       chi.Router
 	callback     func(context.Context, string) string
+	replay       *cache.ReplayCache
 }
 
 func NewLogin(
@@ -44,6 +45,7 @@ func NewLogin(
 		cfg:          cfg,
 		authenticate: authenticate,
 		callback:     callback,
+		replay:       cache.NewReplayCache(storage.WalletAuthRequestLifetime),
 	}
 
 	l.createRouter()
@@ -84,7 +86,16 @@ func (l *login) createRouter() {
 		}
 		// the oidc package will pass the id of the auth request as query parameter
 		// we will use this id through the login process and therefore pass it to the login page
-		renderLogin(l.cfg, w, r.FormValue(queryAuthRequestID), nil)
+		authRequestID := r.FormValue(queryAuthRequestID)
+
+		// The request may have been satisfied already by an existing SSO session, so there is no need
+		// to ask the Wallet for the credential
+		if l.authenticate.CheckLoginDone(authRequestID) {
+			http.Redirect(w, r, l.callback(r.Context(), authRequestID), http.StatusFound)
+			return
+		}
+
+		renderLogin(l.cfg, w, authRequestID, nil)
 	})
 
 	// The JavaScript in the Login page polls the backend to see when the Wallet has sent the
@@ -97,7 +108,7 @@ func (l *login) createRouter() {
 
 		err := r.ParseForm()
 		if err != nil {
-			http.Error(w, fmt.Sprintf("cannot parse form:%s", err), http.StatusInternalServerError)
+			walletError(w, http.StatusBadRequest, errInvalidRequest, fmt.Sprintf("cannot parse form:%s", err))
 			return
 		}
 		authReqId := r.FormValue("state")
@@ -105,10 +116,15 @@ func (l *login) createRouter() {
 		// Get the original auth request from the Client
 		authReq, err := l.authenticate.GetWalletAuthRequestByID(authReqId)
 		if err != nil {
-			http.Error(w, fmt.Sprintf("error getting the Wallet AuthorizationRequest:%s", err), http.StatusInternalServerError)
+			walletError(w, http.StatusBadRequest, errInvalidRequest, fmt.Sprintf("error getting the Wallet AuthorizationRequest:%s", err))
 			return
 		}
 
+		// The link for same-device flows marks the request, so the response can redirect the browser
+		if r.FormValue("samedevice") == "true" {
+			l.authenticate.SetSameDevice(authReqId)
+		}
+
 		// Get the auth request that was sent to the Wallet
 		walletAuthRequest := authReq.WalletAuthRequest
 
@@ -123,7 +139,7 @@ func (l *login) createRouter() {
 		// Parse the received body as a form (URLencoded)
 		err := r.ParseForm()
 		if err != nil {
-			http.Error(w, fmt.Sprintf("cannot parse form:%s", err), http.StatusInternalServerError)
+			walletError(w, http.StatusBadRequest, errInvalidRequest, fmt.Sprintf("cannot parse form:%s", err))
 			return
 		}
 
@@ -132,111 +148,121 @@ func (l *login) createRouter() {
 		log.Println("APIWalletAuthenticationResponse", "stateKey", authReqId)
 
 		// Check if the AuthRequest exists
-		_, err = l.authenticate.GetWalletAuthRequestByID(authReqId)
+		authReq, err := l.authenticate.GetWalletAuthRequestByID(authReqId)
 		if err != nil {
-			http.Error(w, fmt.Sprintf("AuthRequest does not exist:%s", err), http.StatusInternalServerError)
+			walletError(w, http.StatusBadRequest, errInvalidRequest, fmt.Sprintf("AuthRequest does not exist:%s", err))
 			return
 		}
 
 		// Get the vp_token field
 		vp_token := r.FormValue("vp_token")
 		if len(vp_token) == 0 {
-			http.Error(w, "vp_token not found", http.StatusInternalServerError)
+			walletError(w, http.StatusBadRequest, errInvalidRequest, "vp_token not found")
 			return
 		}
 
-		// Decode VP token from B64Url to get a JWT
-		vpJWT, err := base64.RawURLEncoding.DecodeString(vp_token)
+		// The Wallet must send a JWT presentation (jwt_vp_json), and the presentation_submission tells us
+		// where the credential is inside it. JSON-LD presentations (ldp_vp) are rejected.
+		vp, err := parsePresentation(vp_token, r.FormValue("presentation_submission"))
 		if err != nil {
-			http.Error(w, fmt.Sprintf("error decoding VP:%s", err), http.StatusInternalServerError)
+			code := errInvalidRequest
+			if errors.As(err, &formatError{}) {
+				code = errVPFormatsNotSupported
+			}
+			walletError(w, http.StatusBadRequest, code, err.Error())
 			return
 		}
 
-		// The VP object is a JWT, signed with the private key associated to the user did:key
-		// We must verify the signature and decode the JWT payload to get the VerifiablePresentation
-		// TODO: We do not check the signature.
-		var pc = jwt.MapClaims{}
-		tokenParser := jwt.NewParser()
-		_, _, err = tokenParser.ParseUnverified(string(vpJWT), &pc)
-		if err != nil {
-			http.Error(w, fmt.Sprintf("error parsing the JWT:%s", err), http.StatusInternalServerError)
+		// The same presentation can not be used twice, even for a different AuthRequest
+		if err := l.checkReplay(authReq, vp); err != nil {
+			auditEvent(r, "vp_replay_rejected",
+				slog.String("state", authReqId),
+				slog.String("client_id", authReq.ApplicationID),
+				slog.String("reason", err.Error()),
+			)
+			walletError(w, http.StatusBadRequest, errInvalidRequest, err.Error())
 			return
 		}
 
-		fmt.Print(pc["vp"])
+		wcred := vp.Credential
 
-		// Parse the VP object into a map
-		vp := yaml.New(pc["vp"])
-
-		// Get the list of credentials in the VP
-		credentials := vp.List("verifiableCredential")
-		if len(credentials) == 0 {
-			http.Error(w, "no credentials found in VP", http.StatusInternalServerError)
+		// Serialize the credential into a JSON string
+		serialCredential, err := json.Marshal(wcred.Data())
+		if err != nil {
+			walletError(w, http.StatusInternalServerError, errServerError, fmt.Sprintf("error serialising the credential:%s", err))
 			return
 		}
 
-		// TODO: for the moment, we accept only the first credential inside the VP
-		firstCredentialJWT := credentials[0].(string)
-
-		// The credential is in 'jwt_vc_json' format (which is a JWT)
-		var credMap = jwt.MapClaims{}
-		_, _, err = tokenParser.ParseUnverified(firstCredentialJWT, &credMap)
+		// Invoke the PDP (Policy Decision Point) of the Client to authenticate/authorize this request
+		input := newPolicyInput(authReq, vp)
+		decision, err := policies.For(authReq.ApplicationID, authReq.Scopes).TakeAuthnDecision(Authenticate, r, string(serialCredential), "", input)
 		if err != nil {
-			http.Error(w, fmt.Sprintf("error parsing the JWT:%s", err), http.StatusInternalServerError)
+			walletError(w, http.StatusInternalServerError, errServerError, fmt.Sprintf("error evaluating authentication rules:%s", err))
 			return
 		}
 
-		// Serialize the credential into a JSON string
-		serialCredential, err := json.Marshal(credMap["vc"])
-		if err != nil {
-			http.Error(w, fmt.Sprintf("error serialising the credential:%s", err), http.StatusInternalServerError)
+		if !decision.Allow {
+			l.denyAuthentication(w, authReqId, decision.Reasons)
 			return
 		}
-		log.Println("credential", string(serialCredential))
 
-		// Invoke the PDP (Policy Decision Point) to authenticate/authorize this request
-		accepted, err := pdp.TakeAuthnDecision(Authenticate, r, string(serialCredential), "")
+		// Check that the presentation satisfies the assurance level requested by the Client with 'acr_values'
+		acrProfile, ok := l.authenticate.ACRProfile(authReq.RequestedACR)
+		if !ok {
+			walletError(w, http.StatusInternalServerError, errServerError, fmt.Sprintf("acr profile not configured:%s", authReq.RequestedACR))
+			return
+		}
+		amr, err := checkACRProfile(acrProfile, vp.VPJWT, vp.CredentialJWT, wcred)
 		if err != nil {
-			http.Error(w, fmt.Sprintf("error evaluating authentication rules:%s", err), http.StatusInternalServerError)
+			l.denyAuthentication(w, authReqId, []string{err.Error()})
 			return
 		}
 
-		if !accepted {
-			http.Error(w, "authentication failed", http.StatusUnauthorized)
+		// Enforce the obligations of the policy decision, which will be reflected in the tokens for the Client
+		err = l.authenticate.ApplyPolicyObligations(authReqId, decision.Obligations.Claims, decision.Obligations.DropScopes)
+		if err != nil {
+			walletError(w, http.StatusInternalServerError, errServerError, fmt.Sprintf("error applying policy obligations:%s", err))
 			return
 		}
 
-		wcred := yaml.New(credMap["vc"])
-
 		// Update the internal AuthRequest with the LEARCredential received from the Wallet.
-		err = l.authenticate.SaveWalletAuthenticationResponse(authReqId, wcred)
+		err = l.authenticate.SaveWalletAuthenticationResponse(authReqId, wcred, vp.CredentialJWT, acrProfile.Name, amr)
 		if err != nil {
-			http.Error(w, fmt.Sprintf("error updating Wallet authentication response:%s", err), http.StatusInternalServerError)
+			walletError(w, http.StatusInternalServerError, errServerError, fmt.Sprintf("error updating Wallet authentication response:%s", err))
 			return
 		}
 
-		// Send reply to the Wallet, so it can show a success screen
-		resp := map[string]string{
-			"authenticatorRequired": "no",
-			"type":                  "login",
-			"email":                 "email",
-		}
-		out, _ := json.Marshal(resp)
-
-		w.Header().Add("Content-Type", "application/json")
-		w.Write(out)
+		// Send reply to the Wallet, so it can show a success screen and, in same-device flows,
+		// send the browser back to us.
+		l.walletSuccess(w, authReqId, authReq.SameDevice)
 
 	})
 
-	// For testing several things
-	l.router.Get("/fake", l.FakeAPIWalletAuthenticationResponse)
-	l.router.Post("/fake", l.FakeAPIWalletAuthenticationResponse)
+	// The user can see the current SSO session at the Verifier and end it
+	l.router.Get("/session", l.displaySession)
+	l.router.Post("/session/end", l.endSession)
+
+	// In same-device flows the Wallet redirects the browser here after sending the Authentication Response
+	l.router.Get("/samedevice", l.sameDeviceCallback)
+
+	// The login page navigates here when the policies denied the authentication
+	l.router.Get("/denied", l.displayDenied)
 }
 
 type authenticate interface {
 	GetWalletAuthRequestByID(id string) (*storage.InternalAuthRequest, error)
-	SaveWalletAuthenticationResponse(id string, cred *yaml.YAML) error
+	SaveWalletAuthenticationResponse(id string, cred *yaml.YAML, credentialJWT string, acr string, amr []string) error
 	CheckLoginDone(id string) bool
+	ACRProfile(name string) (*storage.ACRProfile, bool)
+	CreateSSOSession(authReqID string) (*storage.SSOSession, error)
+	GetSSOSession(id string) (*storage.SSOSession, bool)
+	EndSSOSession(id string)
+	SetSameDevice(id string) error
+	CreateResponseCode(id string) (string, error)
+	UseResponseCode(id string, code string) bool
+	ApplyPolicyObligations(id string, claims map[string]any, dropScopes []string) error
+	SaveWalletAuthenticationDenial(id string, reasons []string) error
+	CheckLoginDenied(id string) ([]string, bool)
 }
 
 func renderLogin(cfg *Config, w http.ResponseWriter, authRequestID string, formError error) {
@@ -245,11 +271,12 @@ func renderLogin(cfg *Config, w http.ResponseWriter, authRequestID string, formE
 
 	request_uri := verifierURL + "/login/authenticationrequest" + "?state=" + authRequestID
 	escaped_request_uri := url.QueryEscape(request_uri)
+	escaped_samedevice_request_uri := url.QueryEscape(request_uri + "&samedevice=true")
 
 	sameDeviceWallet := cfg.SamedeviceWallet
 	openid4PVURL := "openid4vp://"
 
-	samedevice_uri := sameDeviceWallet + "?request_uri=" + escaped_request_uri
+	samedevice_uri := sameDeviceWallet + "?request_uri=" + escaped_samedevice_request_uri
 	crossdevice_uri := openid4PVURL + "?request_uri=" + escaped_request_uri
 
 	// Create the QR code for cross-device SIOP
@@ -263,27 +290,14 @@ func renderLogin(cfg *Config, w http.ResponseWriter, authRequestID string, formE
 	base64Img := base64.StdEncoding.EncodeToString(png)
 	base64Img = "data:image/png;base64," + base64Img
 
-	const fakeURL = "openid://?response_type=vp_token&response_mode=direct_post&client_id=did:web:dome-marketplace-prd.org&redirect_uri=https://dome-verifier.mycredential.es/login/fake&state=mKSGXgsJ_Ktjr-9qwgO6SA&nonce=rjHS716zcPtrCO_Rl01hlg&scope=didRead,defaultScope"
-
-	fakepng, err := qrcode.Encode(fakeURL, qrcode.Medium, 256)
-	if err != nil {
-		http.Error(w, fmt.Sprintf("cannot create QR code:%s", err), http.StatusInternalServerError)
-		return
-	}
-
-	fakebase64Img := base64.StdEncoding.EncodeToString(fakepng)
-	fakebase64Img = "data:image/png;base64," + fakebase64Img
-
 	data := &struct {
 		AuthRequestID string
 		QRcode        string
-		FakeQRcode    string
 		Samedevice    string
 		Error         string
 	}{
 		AuthRequestID: authRequestID,
 		QRcode:        base64Img,
-		FakeQRcode:    fakebase64Img,
 		Samedevice:    samedevice_uri,
 		Error:         errMsg(formError),
 	}
@@ -294,16 +308,7 @@ func renderLogin(cfg *Config, w http.ResponseWriter, authRequestID string, formE
 	}
 }
 
-func (l *login) FakeAPIWalletAuthenticationResponse(w http.ResponseWriter, r *http.Request) {
-	var theCredential *yaml.YAML
-
-	fmt.Println("\n\n\n\n======================")
-	fmt.Println("Inside FAKE API")
-	fmt.Println(r.URL)
-
-	body, _ := io.ReadAll(r.Body)
-
-	fmt.Println(string(body))
+func (l *login) APIWalletPoll(w http.ResponseWriter, r *http.Request) {
 
 	err := r.ParseForm()
 	if err != nil {
@@ -311,91 +316,30 @@ func (l *login) FakeAPIWalletAuthenticationResponse(w http.ResponseWriter, r *ht
 		return
 	}
 	authReqId := r.FormValue("state")
-	log.Println("APIWalletAuthenticationResponse", "stateKey", authReqId)
-
-	// The body should have a form like 'vp_token=eyJAY29udGV4dCI...IFVUQyJ9XX0'
-	rawVP, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(string(body), "vp_token="))
-	if err != nil {
-		http.Error(w, fmt.Sprintf("error decoding VP:%s", err), http.StatusInternalServerError)
-		return
-	}
-
-	fmt.Println(string(rawVP))
-
-	// Decode into a map
-	vp, err := yaml.ParseJson(string(rawVP))
-	if err != nil {
-		http.Error(w, fmt.Sprintf("cannot parse body:%s", err), http.StatusInternalServerError)
+	if l.authenticate.CheckLoginDone(authReqId) {
+		l.completeLogin(w, r, authReqId)
 		return
 	}
-
-	// Get the list of credentials in the VP
-	credentials := vp.List("verifiableCredential")
-	if len(credentials) == 0 {
-		http.Error(w, "no credentials found in VP", http.StatusInternalServerError)
+	if _, denied := l.authenticate.CheckLoginDenied(authReqId); denied {
+		w.Write([]byte("denied"))
 		return
 	}
 
-	// TODO: for the moment, we accept only the first credential inside the VP
-	firstCredential := credentials[0]
-	theCredential = yaml.New(firstCredential)
-
-	// Serialize the credential into a JSON string
-	serialCredential, err := json.Marshal(theCredential.Data())
-	if err != nil {
-		http.Error(w, fmt.Sprintf("error serialising the credential:%s", err), http.StatusInternalServerError)
-		return
-	}
-	fmt.Print("======================\n\n\n")
-	log.Println("credential", string(serialCredential))
-
-	fmt.Print("======================\n\n\n")
-
-	// // Invoke the PDP (Policy Decision Point) to authenticate/authorize this request
-	// accepted, err := pdp.TakeAuthnDecision(Authenticate, r, string(serialCredential), "")
-	// if err != nil {
-	// 	http.Error(w, fmt.Sprintf("error evaluating authentication rules:%s", err), http.StatusInternalServerError)
-	// 	return
-	// }
-
-	// if !accepted {
-	// 	http.Error(w, "authentication failed", http.StatusUnauthorized)
-	// 	return
-	// }
-
-	// // Update the storage object with the Wallet Authentication Response and signal login completed
-	// err = l.authenticate.CheckWalletAuthenticationResponse(authReqId, theCredential)
-	// if err != nil {
-	// 	http.Error(w, fmt.Sprintf("error updating Wallet authentication response:%s", err), http.StatusInternalServerError)
-	// 	return
-	// }
-
-	resp := map[string]string{
-		"authenticatorRequired": "no",
-		"type":                  "login",
-		"email":                 "email",
-	}
-	out, _ := json.Marshal(resp)
+	w.Write([]byte("pending"))
 
-	w.Header().Add("Content-Type", "application/json")
-	w.Write(out)
-	return
 }
 
-func (l *login) APIWalletPoll(w http.ResponseWriter, r *http.Request) {
-
-	err := r.ParseForm()
+// completeLogin is called in the browser of the user when the Wallet has sent the Authentication Response.
+// This is the moment to establish the SSO session and continue with the OIDC flow of the Client.
+func (l *login) completeLogin(w http.ResponseWriter, r *http.Request, authReqId string) {
+	session, err := l.authenticate.CreateSSOSession(authReqId)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("cannot parse form:%s", err), http.StatusInternalServerError)
+		http.Error(w, fmt.Sprintf("error creating session:%s", err), http.StatusInternalServerError)
 		return
 	}
-	authReqId := r.FormValue("state")
-	if l.authenticate.CheckLoginDone(authReqId) {
-		http.Redirect(w, r, l.callback(r.Context(), authReqId), http.StatusFound)
-	}
-
-	w.Write([]byte("pending"))
+	l.setSessionCookie(w, session)
 
+	http.Redirect(w, r, l.callback(r.Context(), authReqId), http.StatusFound)
 }
 
 // func (l *login) APIWalletAuthenticationResponse(w http.ResponseWriter, r *http.Request) {
@@ -4,19 +4,29 @@
 package verifiernew
 
 import (
-	"encoding/json"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
+	stdmath "math"
 	"net/http"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	gotime "time"
 
+	"github.com/fsnotify/fsnotify"
 	"github.com/gofiber/fiber/v2"
 	zlog "github.com/rs/zerolog/log"
 	starjson "go.starlark.net/lib/json"
 	"go.starlark.net/lib/math"
 	"go.starlark.net/lib/time"
-	"go.starlark.net/repl"
 	"go.starlark.net/starlark"
 	"go.starlark.net/starlarkstruct"
+	"go.starlark.net/syntax"
 )
 
 // Decision can be Authenticate or Authorize
@@ -33,88 +43,383 @@ func (d Decision) String() string {
 	}
 }
 
-// PDP implements a simple Policy Decision Point in Starlark
+// PDP implements a simple Policy Decision Point in Starlark.
+// The policy file is compiled once and the result is shared by all the evaluations, each one running in its own
+// Starlark thread, so the PDP can be used concurrently. When the file changes it is compiled again and, if there are
+// no errors, the new policy replaces the old one atomically. If there are errors, the last good policy stays in force.
 type PDP struct {
 
-	// The globals for the Starlark program
+	// The compiled policy currently in force
+	policy atomic.Pointer[compiledPolicy]
+
+	// The name of the Starlark script file.
+	scriptname string
+
+	// Watches the script file for changes
+	watcher *fsnotify.Watcher
+
+	// The configuration used by the builtins of the 'star' module
+	env *PolicyEnvironment
+}
+
+// compiledPolicy is the result of executing the top-level statements of the policy file.
+// The globals are frozen, so they can not be modified by the evaluations and can be shared among threads.
+type compiledPolicy struct {
 	globals              starlark.StringDict
-	thread               *starlark.Thread
 	authenticateFunction *starlark.Function
 	authorizeFunction    *starlark.Function
 
-	// The name of the Starlark script file.
-	scriptname string
+	// The helper modules loaded by the policy, so changes to them also trigger a reload
+	modules []string
+
+	// The SHA-256 of the sources of the policy and its modules, identifying the version of the policy
+	digest hash.Hash
+	hash   string
 }
 
-func NewPDP(fileName string) (*PDP, error) {
+// predeclared returns the modules available to the policies, including our own utility functions.
+// They are passed to each compilation instead of modifying the global starlark.Universe.
+func (m *PDP) predeclared() starlark.StringDict {
 
 	// Create a StarLark module with our own utility functions
+	members := m.env.builtins()
+	members["getbody"] = starlark.NewBuiltin("getbody", getRequestBody)
+
 	var Module = &starlarkstruct.Module{
-		Name: "star",
-		Members: starlark.StringDict{
-			"getbody": starlark.NewBuiltin("getbody", getRequestBody),
-		},
+		Name:    "star",
+		Members: members,
+	}
+
+	return starlark.StringDict{
+		"json": starjson.Module,
+		"time": time.Module,
+		"math": math.Module,
+		"star": Module,
 	}
+}
+
+// NewPDP compiles the policy file and watches it for changes.
+// The environment configures the builtins of the 'star' module and the execution limits. If nil, the defaults are used.
+func NewPDP(fileName string, env *PolicyEnvironment) (*PDP, error) {
 
-	// Set the global Starlark environment with required modules, including our own
-	starlark.Universe["json"] = starjson.Module
-	starlark.Universe["time"] = time.Module
-	starlark.Universe["math"] = math.Module
-	starlark.Universe["star"] = Module
+	if env == nil {
+		env = defaultPolicyEnvironment()
+	}
 
 	p := &PDP{}
 	p.scriptname = fileName
+	p.env = env
 	err := p.ParseAndCompileFile()
 	if err != nil {
 		return nil, err
 	}
 
+	// Compile the policies again whenever the file changes. Failure to watch is not fatal,
+	// but changes in the policies will require a restart.
+	if err := p.watch(); err != nil {
+		zlog.Err(err).Str("file", fileName).Msg("cannot watch policy file, hot reload disabled")
+	}
+
 	return p, nil
 }
 
 // ParseAndCompileFile reads a file with Starlark code and compiles it, storing the resulting global
 // dictionary for later usage. In particular, the compiled module should define two functions,
 // one for athentication and the second for athorisation.
-// ParseAndCompileFile can be called several times and will perform a new compilation every time,
-// creating a new Thread and so the old ones will never be called again and eventually will be disposed.
+// ParseAndCompileFile can be called several times and will perform a new compilation every time.
+// The new policy is used only if the compilation succeeds; otherwise the previous one remains in force.
 func (m *PDP) ParseAndCompileFile() error {
-	var err error
 
-	// The compiled program context will be stored in a new Starlark thread for each invocation
-	m.thread = &starlark.Thread{
-		Load:  repl.MakeLoad(),
+	policy := &compiledPolicy{digest: sha256.New()}
+
+	src, err := os.ReadFile(m.scriptname)
+	if err != nil {
+		zlog.Err(err).Msg("error reading Starlark program")
+		return err
+	}
+	policy.digest.Write(src)
+
+	// This thread is used only to execute the top-level statements of the script
+	thread := &starlark.Thread{
+		Load:  m.makeLoad(policy),
 		Print: func(_ *starlark.Thread, msg string) { fmt.Println(msg) },
 		Name:  "exec " + m.scriptname,
 	}
-
-	// Create a predeclared environment specific for this module (empy for the moment)
-	predeclared := make(starlark.StringDict)
+	ctx, release := m.limit(context.Background(), thread)
+	defer release()
 
 	// Parse and execute the top-level commands in the script file
-	m.globals, err = starlark.ExecFile(m.thread, m.scriptname, nil, predeclared)
+	globals, err := starlark.ExecFileOptions(syntax.LegacyFileOptions(), thread, m.scriptname, src, m.predeclared())
+	err = m.budgetError(ctx, thread, err)
 	if err != nil {
 		zlog.Err(err).Msg("error compiling Starlark program")
 		return err
 	}
+	policy.hash = hex.EncodeToString(policy.digest.Sum(nil))
+
+	// Make the globals immutable, so they can be safely shared by concurrent evaluations
+	globals.Freeze()
+
+	policy.globals = globals
 
 	// There should be two functions: 'authenticate' and 'authorize', called at the proper moments
 
-	m.authenticateFunction, err = m.getGlobalFunction("authenticate")
+	policy.authenticateFunction, err = policy.getGlobalFunction("authenticate")
+	if err != nil {
+		return err
+	}
+
+	policy.authorizeFunction, err = policy.getGlobalFunction("authorize")
+	if err != nil {
+		return err
+	}
+
+	m.policy.Store(policy)
+
+	// Watch also the directories of the helper modules
+	if m.watcher != nil {
+		for _, module := range policy.modules {
+			m.watcher.Add(filepath.Dir(module))
+		}
+	}
+
+	return nil
+
+}
+
+// makeLoad returns the function used by the 'load' statement of the policies, to share helper modules
+// among them. Module names are relative to the directory of the policy file (see modulePath), and each module
+// is executed only once per compilation, with the same limits and predeclared modules as the policies.
+func (m *PDP) makeLoad(policy *compiledPolicy) func(thread *starlark.Thread, module string) (starlark.StringDict, error) {
+	type entry struct {
+		globals starlark.StringDict
+		err     error
+	}
+
+	var cache = make(map[string]*entry)
+
+	var load func(thread *starlark.Thread, module string) (starlark.StringDict, error)
+	load = func(thread *starlark.Thread, module string) (starlark.StringDict, error) {
+		path, err := m.modulePath(module)
+		if err != nil {
+			zlog.Err(err).Str("file", m.scriptname).Msg("load rejected")
+			return nil, err
+		}
+
+		e, ok := cache[path]
+		if e == nil {
+			if ok {
+				// request for module whose loading is in progress
+				return nil, fmt.Errorf("cycle in load graph")
+			}
+
+			// Add a placeholder to indicate "load in progress".
+			cache[path] = nil
+			policy.modules = append(policy.modules, path)
+
+			// Load it.
+			thread := &starlark.Thread{
+				Name:  "exec " + module,
+				Load:  load,
+				Print: thread.Print,
+			}
+			src, err := os.ReadFile(path)
+			if err != nil {
+				return nil, err
+			}
+			policy.digest.Write(src)
+
+			ctx, release := m.limit(context.Background(), thread)
+			globals, err := starlark.ExecFileOptions(syntax.LegacyFileOptions(), thread, path, src, m.predeclared())
+			err = m.budgetError(ctx, thread, err)
+			release()
+			if err == nil {
+				globals.Freeze()
+			}
+			e = &entry{globals, err}
+
+			// Update the cache.
+			cache[path] = e
+		}
+		return e.globals, e.err
+	}
+
+	return load
+}
+
+// modulePath resolves the name of a module in a 'load' statement. Only Starlark files (.star) in the directory
+// of the policy file or its subdirectories can be loaded, so a policy can not read arbitrary files of the server.
+// Absolute paths and paths going up with '..' are rejected, and so are symbolic links pointing outside the directory.
+func (m *PDP) modulePath(module string) (string, error) {
+	if filepath.IsAbs(module) || !filepath.IsLocal(module) {
+		return "", fmt.Errorf("load %q: only paths relative to the directory of the policy are allowed", module)
+	}
+	if filepath.Ext(module) != ".star" {
+		return "", fmt.Errorf("load %q: only Starlark files (.star) can be loaded", module)
+	}
+
+	baseDir := filepath.Dir(m.scriptname)
+	path := filepath.Join(baseDir, module)
+
+	realBase, err := filepath.EvalSymlinks(baseDir)
+	if err != nil {
+		return "", fmt.Errorf("load %q: %w", module, err)
+	}
+	realPath, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return "", fmt.Errorf("load %q: %w", module, err)
+	}
+	rel, err := filepath.Rel(realBase, realPath)
+	if err != nil || !filepath.IsLocal(rel) {
+		return "", fmt.Errorf("load %q: the module is outside the directory of the policy", module)
+	}
+
+	return path, nil
+}
+
+// ErrPolicyBudget is returned when the execution of a policy is aborted because it exceeded its limits.
+// The request must be denied, as no decision was taken.
+var ErrPolicyBudget = errors.New("policy execution aborted")
+
+// limit applies the execution limits of the environment to the thread: the maximum number of steps and the
+// timeout. The thread is also cancelled when the context is done, for example when the client of the HTTP request
+// goes away. The returned function releases the resources and must be called when the execution finishes.
+// Starlark does not limit memory, but it can only grow with the number of steps.
+func (m *PDP) limit(ctx context.Context, thread *starlark.Thread) (context.Context, func()) {
+	if m.env.MaxSteps > 0 {
+		thread.SetMaxExecutionSteps(m.env.MaxSteps)
+	}
+
+	cancel := func() {}
+	if m.env.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, m.env.Timeout)
+	}
+	stop := context.AfterFunc(ctx, func() {
+		thread.Cancel(ctx.Err().Error())
+	})
+
+	return ctx, func() {
+		stop()
+		cancel()
+	}
+}
+
+// budgetError checks if the error of an execution was caused by the limits, and in that case logs it and
+// returns ErrPolicyBudget with the reason. Other errors are returned unchanged.
+func (m *PDP) budgetError(ctx context.Context, thread *starlark.Thread, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	var reason string
+	switch {
+	case m.env.MaxSteps > 0 && thread.ExecutionSteps() >= m.env.MaxSteps:
+		reason = fmt.Sprintf("exceeded the maximum of %d execution steps", m.env.MaxSteps)
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		reason = fmt.Sprintf("exceeded the timeout of %s", m.env.Timeout)
+	case ctx.Err() != nil:
+		reason = "the request was cancelled"
+	default:
+		return err
+	}
+
+	zlog.Error().Str("file", m.scriptname).Str("thread", thread.Name).Str("reason", reason).Msg("policy execution aborted, access denied")
+	return fmt.Errorf("%w in %s: %s", ErrPolicyBudget, m.scriptname, reason)
+}
+
+// isPolicyFile returns true if the file is the policy or one of the helper modules it loads
+func (m *PDP) isPolicyFile(name string) bool {
+	name = filepath.Clean(name)
+	if name == filepath.Clean(m.scriptname) {
+		return true
+	}
+	if policy := m.policy.Load(); policy != nil {
+		for _, module := range policy.modules {
+			if name == filepath.Clean(module) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// watch starts monitoring the policy file and compiles it again when it changes.
+// We watch the directory instead of the file, because many editors replace the file when saving it.
+func (m *PDP) watch() error {
+	w, err := fsnotify.NewWatcher()
 	if err != nil {
 		return err
 	}
 
-	m.authorizeFunction, err = m.getGlobalFunction("authorize")
+	err = w.Add(filepath.Dir(m.scriptname))
 	if err != nil {
+		w.Close()
 		return err
 	}
+	for _, module := range m.policy.Load().modules {
+		w.Add(filepath.Dir(module))
+	}
+	m.watcher = w
+
+	go m.reloadLoop()
 
 	return nil
+}
 
+// reloadLoop compiles the policy file when it is written. Several write events may be generated for a single save,
+// so we wait a short time for more events before compiling.
+func (m *PDP) reloadLoop() {
+	var (
+		// Wait 100ms for new events; each new event resets the timer.
+		waitFor = 100 * gotime.Millisecond
+
+		timer = gotime.AfterFunc(stdmath.MaxInt64, func() {
+			if err := m.ParseAndCompileFile(); err != nil {
+				zlog.Err(err).Str("file", m.scriptname).Msg("policy reload failed, keeping the last good policy")
+				return
+			}
+			zlog.Info().Str("file", m.scriptname).Msg("policy reloaded")
+		})
+	)
+	timer.Stop()
+
+	for {
+		select {
+		case err, ok := <-m.watcher.Errors:
+			if !ok { // Channel was closed (i.e. Watcher.Close() was called).
+				return
+			}
+			zlog.Err(err).Msg("watching policy file")
+
+		case e, ok := <-m.watcher.Events:
+			if !ok { // Channel was closed (i.e. Watcher.Close() was called).
+				return
+			}
+
+			// We are only interested in changes to the policy file and its modules
+			if !m.isPolicyFile(e.Name) {
+				continue
+			}
+			if !e.Has(fsnotify.Create) && !e.Has(fsnotify.Write) && !e.Has(fsnotify.Rename) {
+				continue
+			}
+
+			// Reset the timer, so it will start from 100ms again.
+			timer.Reset(waitFor)
+		}
+	}
+}
+
+// Close stops watching the policy file
+func (m *PDP) Close() error {
+	if m.watcher == nil {
+		return nil
+	}
+	return m.watcher.Close()
 }
 
 // getGlobalFunction retrieves a global with the specified name, requiring it to be a Callable
-func (m PDP) getGlobalFunction(funcName string) (*starlark.Function, error) {
+func (m *compiledPolicy) getGlobalFunction(funcName string) (*starlark.Function, error) {
 
 	// Check that we have the function
 	f, ok := m.globals[funcName]
@@ -135,31 +440,42 @@ func (m PDP) getGlobalFunction(funcName string) (*starlark.Function, error) {
 	return starFunction, nil
 }
 
+// newThread creates the Starlark thread for a single evaluation. Threads are cheap, and not safe for concurrent use.
+// The output of 'print' in the policy is passed to the print function.
+func (m *PDP) newThread(r *http.Request, print func(msg string)) *starlark.Thread {
+	thread := &starlark.Thread{
+		Print: func(_ *starlark.Thread, msg string) { print(msg) },
+		Name:  "eval " + m.scriptname,
+	}
+	thread.SetLocal("httprequest", r)
+	return thread
+}
+
 // TakeAuthnDecision is called when a decision should be taken for either Athentication or Authorization.
 // The type of decision to evaluate is passed in the Decision argument. The rest of the arguments contain the information required
 // for the decision. They are:
 // - the Verifiable Credential with the information from the caller needed for the decision
 // - the protected resource that the caller identified in the Credential wants to access
-func (m PDP) TakeAuthnDecision(decision Decision, r *http.Request, credential string, protectedResource string) (bool, error) {
-	var err error
-	debug := true
-
+// - the input object with the details of the authentication request and the verification results (may be nil)
+// The input is passed only to policy functions declaring a fourth parameter, so older policies keep working.
+// The result includes the reasons for the decision and the obligations that the caller must enforce.
+func (m *PDP) TakeAuthnDecision(decision Decision, r *http.Request, credential string, protectedResource string, input *PolicyInput) (*PolicyDecision, error) {
 	zlog.Info().Str("decision", decision.String()).Msg("TakeAuthnDecision")
-	fmt.Println("Credential", credential)
+	return m.Evaluate(decision, r, credential, protectedResource, input, func(msg string) { fmt.Println(msg) })
+}
 
-	// In development, parse and compile the script on every request
-	if debug {
-		err := m.ParseAndCompileFile()
-		if err != nil {
-			return false, err
-		}
-	}
+// Evaluate is like TakeAuthnDecision, but the output of 'print' in the policy is passed to the print function
+// instead of writing it to the standard output.
+func (m *PDP) Evaluate(decision Decision, r *http.Request, credential string, protectedResource string, input *PolicyInput, print func(msg string)) (*PolicyDecision, error) {
+	var err error
+
+	// Use the policy in force at this moment, even if it is replaced during the evaluation
+	policy := m.policy.Load()
 
 	// Create the input arguments
-	// httpRequest := StarDictFromFiberRequest(c)
 	httpRequest, err := StarDictFromHttpRequest(r)
 	if err != nil {
-		return false, err
+		return nil, err
 	}
 	credentialArgument := starlark.String(credential)
 	protectedArgument := starlark.String(protectedResource)
@@ -170,112 +486,43 @@ func (m PDP) TakeAuthnDecision(decision Decision, r *http.Request, credential st
 	args = append(args, credentialArgument)
 	args = append(args, protectedArgument)
 
-	// Call the corresponding function in the Starlark Thread
-	var result starlark.Value
-	if decision == Authenticate {
-		// Call the 'authenticate' funcion
-		result, err = starlark.Call(m.thread, m.authenticateFunction, args, nil)
-	} else {
-		// Call the 'authorize' function
-		result, err = starlark.Call(m.thread, m.authorizeFunction, args, nil)
-	}
-
-	if err != nil {
-		return false, err
-	}
-
-	// Check that the value returned is of the correct type (boolean)
-	resultType := result.Type()
-	if resultType != "bool" {
-		err := fmt.Errorf("function returned wrong type: %v", resultType)
-		return false, err
-	}
-
-	// Return the value as a Go boolean
-	return bool(result.(starlark.Bool).Truth()), nil
-
-}
-
-type jsonrpcMessage struct {
-	Version string          `json:"jsonrpc"`
-	ID      int             `json:"id"`
-	Method  string          `json:"method"`
-	Params  json.RawMessage `json:"params"`
-}
-
-func (m PDP) HttpHandler(w http.ResponseWriter, r *http.Request) {
-	var err error
-	debug := true
-
-	zlog.Info().Msg("in JSONRPC handler")
-
-	// Check that this is a JSON request
-	contentType := r.Header.Get("Content-Type")
-	if contentType != "application/json" {
-		http.Error(w, "invalid content type", http.StatusForbidden)
+	// Select the 'authenticate' or 'authorize' function
+	function := policy.authenticateFunction
+	if decision == Authorize {
+		function = policy.authorizeFunction
 	}
 
-	// Read and decode the body from the request and store in thread locals in case we need it later
-	bytes, err := io.ReadAll(r.Body)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-	}
-
-	var msg jsonrpcMessage
-	err = json.Unmarshal(bytes, &msg)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-	}
-	if msg.Version != "2.0" {
-		http.Error(w, "invalid JSON-RPC version", http.StatusBadRequest)
-	}
-	if len(msg.Method) == 0 {
-		http.Error(w, "JSON-RPC method not specified", http.StatusBadRequest)
-	}
-	m.thread.SetLocal("jsonmessage", m)
-
-	// In development, parse and compile the script on every request
-	if debug {
-		err := m.ParseAndCompileFile()
+	if function.NumParams() > 3 {
+		inputArgument, err := input.toStarlark()
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return nil, err
 		}
+		args = append(args, inputArgument)
 	}
 
-	m.thread.SetLocal("httprequest", r)
+	// Each evaluation runs in its own thread, limited in steps and time
+	thread := m.newThread(r, print)
+	ctx, release := m.limit(r.Context(), thread)
+	defer release()
 
-	// Create the input argument
-	req, err := StarDictFromHttpRequest(r)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-	}
-	req.SetKey(starlark.String("jsonrpc_method"), starlark.String(msg.Method))
+	// Call the function in the Starlark Thread
+	result, err := starlark.Call(thread, function, args, nil)
 
-	// Call the already compiled 'authenticate' funcion
-	var args starlark.Tuple
-	args = append(args, req)
-	res, err := starlark.Call(m.thread, m.authenticateFunction, args, nil)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-	}
+	err = m.budgetError(ctx, thread, err)
 
-	// Check that the value returned is of the correct type
-	resultType := res.Type()
-	if resultType != "string" {
-		err := fmt.Errorf("authenticate function returned wrong type: %v", resultType)
-		zlog.Err(err).Msg("")
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	// The function can return a bool or a dict with the decision and its reasons and obligations
+	var policyDecision *PolicyDecision
+	if err == nil {
+		policyDecision, err = policyDecisionFromStarlark(result)
 	}
 
-	// Return the value
-	user := res.(starlark.String).GoString()
-
-	if len(user) > 0 {
-		w.Write([]byte("Authenticated"))
-	} else {
-		w.Write([]byte("Forbidden"))
+	// Record the decision, or the error which denies the request
+	if m.env.Audit != nil {
+		m.env.Audit.record(m, policy, decision, protectedResource, input, policyDecision, err)
 	}
 
+	return policyDecision, err
+
 }
 
 func getRequestBody(thread *starlark.Thread, _ *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
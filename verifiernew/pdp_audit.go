@@ -0,0 +1,411 @@
+package verifiernew
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	zlog "github.com/rs/zerolog/log"
+)
+
+// AuditRecord is the entry of the audit log written for each evaluation of a policy
+type AuditRecord struct {
+	Time     time.Time `json:"time"`
+	Decision string    `json:"decision"`
+	ClientID string    `json:"client_id,omitempty"`
+
+	// Subject is the DID of the holder of the credential, or a pseudonym of it when personal data is minimised
+	Subject  string `json:"subject,omitempty"`
+	Issuer   string `json:"issuer,omitempty"`
+	Resource string `json:"resource,omitempty"`
+
+	// Policy is the file of the policy, and PolicyHash the SHA-256 of its source and the modules it loads
+	Policy     string `json:"policy"`
+	PolicyHash string `json:"policy_hash"`
+
+	Allow   bool     `json:"allow"`
+	Reasons []string `json:"reasons,omitempty"`
+	Error   string   `json:"error,omitempty"`
+
+	// Each record includes the hash of the previous one, so removing or modifying records can be detected
+	Prev string `json:"prev"`
+	Hash string `json:"hash"`
+}
+
+// AuditLog is an append-only log of the decisions of the policies, stored as a JSONL file.
+// It is safe for concurrent use.
+type AuditLog struct {
+	mu       sync.Mutex
+	file     *os.File
+	fileName string
+	lastHash string
+
+	// When minimise is true the subjects are replaced by a keyed hash, which still allows searching by subject
+	minimise bool
+	key      []byte
+}
+
+// OpenAuditLog opens the audit log, creating the file if it does not exist.
+// With minimise, subjects are stored as a pseudonym derived from the subject and the key.
+func OpenAuditLog(fileName string, minimise bool, key string) (*AuditLog, error) {
+	a := &AuditLog{
+		fileName: fileName,
+		minimise: minimise,
+		key:      []byte(key),
+	}
+
+	if err := os.MkdirAll(filepath.Dir(fileName), 0700); err != nil {
+		return nil, fmt.Errorf("opening audit log: %w", err)
+	}
+	f, err := os.OpenFile(fileName, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("opening audit log: %w", err)
+	}
+	a.file = f
+
+	// Continue the hash chain from the last record in the file
+	a.lastHash, err = a.recoverLastHash()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return a, nil
+}
+
+// recoverLastHash returns the hash of the last record, reading only the end of the file.
+// A final line without newline is a record whose write was interrupted, and is removed so the next record
+// starts in a new line.
+func (a *AuditLog) recoverLastHash() (string, error) {
+	info, err := a.file.Stat()
+	if err != nil {
+		return "", err
+	}
+	size := info.Size()
+	if size == 0 {
+		return "", nil
+	}
+
+	offset := max(0, size-maxAuditLineSize)
+	tail := make([]byte, size-offset)
+	if _, err := a.file.ReadAt(tail, offset); err != nil {
+		return "", fmt.Errorf("reading audit log %s: %w", a.fileName, err)
+	}
+
+	if i := bytes.LastIndexByte(tail, '\n'); i < len(tail)-1 {
+		zlog.Warn().Str("file", a.fileName).Msg("removing incomplete last record of audit log")
+		if err := a.file.Truncate(offset + int64(i+1)); err != nil {
+			return "", fmt.Errorf("repairing audit log %s: %w", a.fileName, err)
+		}
+		tail = tail[:i+1]
+	}
+
+	lines := bytes.Split(bytes.TrimSpace(tail), []byte{'\n'})
+	last := lines[len(lines)-1]
+	if len(last) == 0 {
+		return "", nil
+	}
+	rec := &AuditRecord{}
+	if err := json.Unmarshal(last, rec); err != nil {
+		return "", fmt.Errorf("corrupted audit log %s: %w", a.fileName, err)
+	}
+	return rec.Hash, nil
+}
+
+// Close closes the file of the log
+func (a *AuditLog) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.file.Close()
+}
+
+// pseudonym returns the value stored for a subject, which is the subject itself unless personal data is minimised
+func (a *AuditLog) pseudonym(subject string) string {
+	if !a.minimise || len(subject) == 0 {
+		return subject
+	}
+	mac := hmac.New(sha256.New, a.key)
+	mac.Write([]byte(subject))
+	return "hmac:" + hex.EncodeToString(mac.Sum(nil))[:32]
+}
+
+// Append writes a record to the log, completing its hash chain
+func (a *AuditLog) Append(rec *AuditRecord) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	rec.Subject = a.pseudonym(rec.Subject)
+	rec.Prev = a.lastHash
+	rec.Hash = ""
+
+	// The hash is calculated over the record without the hash
+	unhashed, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(unhashed)
+	rec.Hash = hex.EncodeToString(sum[:])
+
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if _, err := a.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+
+	a.lastHash = rec.Hash
+	return nil
+}
+
+// record writes the result of an evaluation, logging the error if the record can not be written
+func (a *AuditLog) record(m *PDP, policy *compiledPolicy, decision Decision, protectedResource string, input *PolicyInput, result *PolicyDecision, evalErr error) {
+	rec := &AuditRecord{
+		Time:       time.Now().UTC(),
+		Decision:   strings.ToLower(decision.String()),
+		Resource:   protectedResource,
+		Policy:     m.scriptname,
+		PolicyHash: policy.hash,
+	}
+	if input != nil {
+		rec.ClientID = input.ClientID
+		rec.Subject = input.Holder
+		rec.Issuer = input.Issuer.DID
+	}
+	if result != nil {
+		rec.Allow = result.Allow
+		rec.Reasons = result.Reasons
+	}
+	if evalErr != nil {
+		rec.Error = evalErr.Error()
+	}
+
+	if err := a.Append(rec); err != nil {
+		zlog.Err(err).Str("file", a.fileName).Msg("writing audit record")
+	}
+}
+
+// AuditQuery selects records of the audit log. Empty fields match any record.
+type AuditQuery struct {
+	ClientID string
+	Subject  string
+	Issuer   string
+	Decision string
+
+	// Allow is "allow" or "deny"
+	Allow string
+
+	From  time.Time
+	Until time.Time
+}
+
+func (q *AuditQuery) matches(rec *AuditRecord) bool {
+	if len(q.ClientID) > 0 && rec.ClientID != q.ClientID {
+		return false
+	}
+	if len(q.Subject) > 0 && rec.Subject != q.Subject {
+		return false
+	}
+	if len(q.Issuer) > 0 && rec.Issuer != q.Issuer {
+		return false
+	}
+	if len(q.Decision) > 0 && rec.Decision != q.Decision {
+		return false
+	}
+	if q.Allow == "allow" && !rec.Allow || q.Allow == "deny" && rec.Allow {
+		return false
+	}
+	if !q.From.IsZero() && rec.Time.Before(q.From) {
+		return false
+	}
+	if !q.Until.IsZero() && rec.Time.After(q.Until) {
+		return false
+	}
+	return true
+}
+
+// Search returns the records matching the query, in chronological order.
+// The subject in the query is the real one, and is converted to its pseudonym when personal data is minimised.
+func (a *AuditLog) Search(q AuditQuery) ([]*AuditRecord, error) {
+	q.Subject = a.pseudonym(q.Subject)
+
+	// Records are written while holding the lock, so the size of the file at this moment is the end of a complete
+	// record. The file is scanned up to that size without the lock, so the decisions are not blocked meanwhile.
+	a.mu.Lock()
+	info, err := a.file.Stat()
+	a.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return a.read(q, info.Size())
+}
+
+// The maximum size of a record in the file of the log
+const maxAuditLineSize = 1024 * 1024
+
+// read scans the first 'size' bytes of the file of the log for the records matching the query.
+// The records appended after them are not seen.
+func (a *AuditLog) read(q AuditQuery, size int64) ([]*AuditRecord, error) {
+	f, err := os.Open(a.fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var records []*AuditRecord
+	scanner := bufio.NewScanner(io.NewSectionReader(f, 0, size))
+	scanner.Buffer(make([]byte, 64*1024), maxAuditLineSize)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		rec := &AuditRecord{}
+		if err := json.Unmarshal(line, rec); err != nil {
+			return nil, fmt.Errorf("corrupted audit log %s: %w", a.fileName, err)
+		}
+		if q.matches(rec) {
+			records = append(records, rec)
+		}
+	}
+	return records, scanner.Err()
+}
+
+// The maximum number of records returned by the search endpoint
+const maxAuditRecords = 1000
+
+// auditRouter creates the routes to search and export the audit log, to be mounted in /audit.
+// They are only available to the registered Clients listed in 'auditAdmins', authenticating with their
+// client_id and secret with HTTP Basic authentication.
+func auditRouter(audit *AuditLog, admins []string, clients clientAuthenticator) chi.Router {
+	router := chi.NewRouter()
+	router.Use(requireAuditAdmin(admins, clients))
+
+	// GET /audit/records returns the last matching records as a JSON array, with 'limit' records at most
+	router.Get("/records", func(w http.ResponseWriter, r *http.Request) {
+		q, limit, err := auditQueryFromRequest(r)
+		if err != nil {
+			walletError(w, http.StatusBadRequest, errInvalidRequest, err.Error())
+			return
+		}
+		records, err := audit.Search(q)
+		if err != nil {
+			walletError(w, http.StatusInternalServerError, errServerError, err.Error())
+			return
+		}
+		if len(records) > limit {
+			records = records[len(records)-limit:]
+		}
+		if records == nil {
+			records = []*AuditRecord{}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(records)
+	})
+
+	// GET /audit/export downloads all the matching records as JSONL, in the same format as the log
+	router.Get("/export", func(w http.ResponseWriter, r *http.Request) {
+		q, _, err := auditQueryFromRequest(r)
+		if err != nil {
+			walletError(w, http.StatusBadRequest, errInvalidRequest, err.Error())
+			return
+		}
+		records, err := audit.Search(q)
+		if err != nil {
+			walletError(w, http.StatusInternalServerError, errServerError, err.Error())
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="pdp_audit_%s.jsonl"`, time.Now().UTC().Format("20060102T150405Z")))
+		enc := json.NewEncoder(w)
+		for _, rec := range records {
+			if err := enc.Encode(rec); err != nil {
+				return
+			}
+		}
+	})
+
+	return router
+}
+
+// auditQueryFromRequest builds the query from the parameters of the request:
+// client_id, subject, issuer, decision (authenticate or authorize), result (allow or deny),
+// from and until (RFC3339) and limit.
+func auditQueryFromRequest(r *http.Request) (AuditQuery, int, error) {
+	params := r.URL.Query()
+	q := AuditQuery{
+		ClientID: params.Get("client_id"),
+		Subject:  params.Get("subject"),
+		Issuer:   params.Get("issuer"),
+		Decision: params.Get("decision"),
+		Allow:    params.Get("result"),
+	}
+
+	switch q.Allow {
+	case "", "allow", "deny":
+	default:
+		return q, 0, fmt.Errorf("result must be 'allow' or 'deny'")
+	}
+
+	var err error
+	if from := params.Get("from"); len(from) > 0 {
+		if q.From, err = time.Parse(time.RFC3339, from); err != nil {
+			return q, 0, fmt.Errorf("invalid 'from': %w", err)
+		}
+	}
+	if until := params.Get("until"); len(until) > 0 {
+		if q.Until, err = time.Parse(time.RFC3339, until); err != nil {
+			return q, 0, fmt.Errorf("invalid 'until': %w", err)
+		}
+	}
+
+	limit := 100
+	if l := params.Get("limit"); len(l) > 0 {
+		if limit, err = strconv.Atoi(l); err != nil || limit <= 0 {
+			return q, 0, fmt.Errorf("invalid 'limit'")
+		}
+	}
+	limit = min(limit, maxAuditRecords)
+
+	return q, limit, nil
+}
+
+// clientAuthenticator checks the credentials of the registered Clients
+type clientAuthenticator interface {
+	AuthorizeClientIDSecret(ctx context.Context, clientID, clientSecret string) error
+}
+
+// requireAuditAdmin allows only requests authenticated with the client_id and secret of one of the admins
+func requireAuditAdmin(admins []string, clients clientAuthenticator) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			clientID, secret, ok := r.BasicAuth()
+			if !ok || len(secret) == 0 || !slices.Contains(admins, clientID) || clients.AuthorizeClientIDSecret(r.Context(), clientID, secret) != nil {
+				auditEvent(r, "audit_access_denied", "client_id", clientID)
+				w.Header().Set("WWW-Authenticate", `Basic realm="audit"`)
+				walletError(w, http.StatusUnauthorized, errAccessDenied, "admin credentials required")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
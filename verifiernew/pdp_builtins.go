@@ -0,0 +1,331 @@
+package verifiernew
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/evidenceledger/vcdemo/internal/did"
+	"github.com/hesusruiz/vcutils/yaml"
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/lestrrat-go/jwx/v2/jwk"
+	"github.com/lestrrat-go/jwx/v2/jws"
+	"go.starlark.net/starlark"
+)
+
+// PolicyEnvironment is the configuration used by the builtins of the 'star' module available to the policies,
+// the limits of their execution and the audit log of their decisions.
+// It is shared by all the evaluations and must not be modified after creating the PDPs.
+type PolicyEnvironment struct {
+	// TrustedIssuers is the list of DIDs of the issuers trusted by the Verifier
+	TrustedIssuers []string
+
+	// PowerCatalog is the list of powers that can be delegated with a mandate
+	PowerCatalog []PowerDefinition
+
+	// MaxSteps is the maximum number of Starlark steps of a single evaluation, zero for no limit
+	MaxSteps uint64
+
+	// Timeout is the maximum duration of a single evaluation, zero for no limit
+	Timeout time.Duration
+
+	// Audit is the log where the evaluations are recorded, if not nil
+	Audit *AuditLog
+}
+
+// defaultPolicyEnvironment has no trusted issuers nor power catalog, and the default execution limits
+func defaultPolicyEnvironment() *PolicyEnvironment {
+	return &PolicyEnvironment{
+		MaxSteps: defaultConfig.PolicyMaxSteps,
+		Timeout:  time.Duration(defaultConfig.PolicyTimeout) * time.Millisecond,
+	}
+}
+
+// PowerDefinition is an entry of the power catalog
+type PowerDefinition struct {
+	Function    string   `json:"function"`
+	Domain      string   `json:"domain"`
+	Actions     []string `json:"actions"`
+	Description string   `json:"description,omitempty"`
+}
+
+// NewPolicyEnvironment creates the environment for the policies from the configuration of the Verifier,
+// reading the power catalog file if one is configured. The audit log is not opened here, as it is used
+// only by the Verifier and not when evaluating policies from the command line.
+func NewPolicyEnvironment(cfg *Config) (*PolicyEnvironment, error) {
+	env := &PolicyEnvironment{
+		TrustedIssuers: cfg.TrustedIssuers,
+		MaxSteps:       cfg.PolicyMaxSteps,
+		Timeout:        time.Duration(cfg.PolicyTimeout) * time.Millisecond,
+	}
+
+	if len(cfg.PowerCatalog) == 0 {
+		return env, nil
+	}
+
+	data, err := os.ReadFile(cfg.PowerCatalog)
+	if err != nil {
+		return nil, fmt.Errorf("reading power catalog: %w", err)
+	}
+	y, err := yaml.ParseYaml(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("parsing power catalog %s: %w", cfg.PowerCatalog, err)
+	}
+	raw, err := json.Marshal(y.List("powers"))
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(raw, &env.PowerCatalog); err != nil {
+		return nil, fmt.Errorf("parsing power catalog %s: %w", cfg.PowerCatalog, err)
+	}
+
+	return env, nil
+}
+
+// builtins returns the functions of the 'star' module which depend on the environment.
+// They are implemented in Go so the policies can express trust rules without reimplementing crypto in Starlark.
+func (env *PolicyEnvironment) builtins() starlark.StringDict {
+	return starlark.StringDict{
+		"trusted_issuer":   starlark.NewBuiltin("trusted_issuer", env.trustedIssuer),
+		"is_past":          starlark.NewBuiltin("is_past", isPast),
+		"is_future":        starlark.NewBuiltin("is_future", isFuture),
+		"normalize_org_id": starlark.NewBuiltin("normalize_org_id", normalizeOrgIDBuiltin),
+		"same_org":         starlark.NewBuiltin("same_org", sameOrg),
+		"power_lookup":     starlark.NewBuiltin("power_lookup", env.powerLookup),
+		"verify_jwt":       starlark.NewBuiltin("verify_jwt", verifyJWT),
+	}
+}
+
+// trustedIssuer implements star.trusted_issuer(did), which returns True if the DID is in the list of trusted issuers.
+// For 'did:elsi' DIDs the organizationIdentifier is normalised before comparing, so 'did:elsi:VATES-B60645900'
+// and 'did:elsi:VATES:B60645900' are the same issuer.
+func (env *PolicyEnvironment) trustedIssuer(_ *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var issuer string
+	if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 1, &issuer); err != nil {
+		return nil, err
+	}
+
+	issuer = normalizeIssuerDID(issuer)
+	if len(issuer) == 0 {
+		return starlark.False, nil
+	}
+	for _, trusted := range env.TrustedIssuers {
+		if normalizeIssuerDID(trusted) == issuer {
+			return starlark.True, nil
+		}
+	}
+	return starlark.False, nil
+}
+
+// normalizeIssuerDID normalises the organizationIdentifier in 'did:elsi' DIDs, leaving other DIDs unchanged
+func normalizeIssuerDID(issuer string) string {
+	issuer = strings.TrimSpace(issuer)
+	if orgID, found := cutPrefixFold(issuer, "did:elsi:"); found {
+		return "did:elsi:" + normalizeOrgID(orgID)
+	}
+	return issuer
+}
+
+// isPast implements star.is_past(timestamp, leeway=0), which returns True if the RFC3339 timestamp is before
+// the current time minus the leeway in seconds.
+func isPast(_ *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	t, leeway, err := unpackTimestamp(b, args, kwargs)
+	if err != nil {
+		return nil, err
+	}
+	return starlark.Bool(t.Before(time.Now().Add(-leeway))), nil
+}
+
+// isFuture implements star.is_future(timestamp, leeway=0), which returns True if the RFC3339 timestamp is after
+// the current time plus the leeway in seconds.
+func isFuture(_ *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	t, leeway, err := unpackTimestamp(b, args, kwargs)
+	if err != nil {
+		return nil, err
+	}
+	return starlark.Bool(t.After(time.Now().Add(leeway))), nil
+}
+
+// unpackTimestamp parses the arguments of the time builtins. An invalid timestamp is an error, so a policy
+// never takes a decision based on a date that could not be understood.
+func unpackTimestamp(b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (time.Time, time.Duration, error) {
+	var timestamp string
+	var leeway int
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "timestamp", &timestamp, "leeway?", &leeway); err != nil {
+		return time.Time{}, 0, err
+	}
+	if leeway < 0 {
+		return time.Time{}, 0, fmt.Errorf("%s: leeway must not be negative", b.Name())
+	}
+
+	t, err := time.Parse(time.RFC3339, timestamp)
+	if err != nil {
+		return time.Time{}, 0, fmt.Errorf("%s: invalid RFC3339 timestamp %q", b.Name(), timestamp)
+	}
+	return t, time.Duration(leeway) * time.Second, nil
+}
+
+// normalizeOrgIDBuiltin implements star.normalize_org_id(id)
+func normalizeOrgIDBuiltin(_ *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var orgID string
+	if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 1, &orgID); err != nil {
+		return nil, err
+	}
+	return starlark.String(normalizeOrgID(orgID)), nil
+}
+
+// sameOrg implements star.same_org(a, b), which returns True if both organizationIdentifiers are the same
+// after normalising them. Empty identifiers never match.
+func sameOrg(_ *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var first, second string
+	if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 2, &first, &second); err != nil {
+		return nil, err
+	}
+	first, second = normalizeOrgID(first), normalizeOrgID(second)
+	return starlark.Bool(len(first) > 0 && first == second), nil
+}
+
+// The identity types defined in ETSI EN 319 412-1 for the organizationIdentifier attribute
+var orgIDTypes = []string{"VAT", "NTR", "PSD", "LEI"}
+
+// normalizeOrgID converts an organizationIdentifier into the canonical form of ETSI EN 319 412-1:
+// three characters for the identity type, two for the country, a hyphen and the identifier (e.g. 'VATES-B60645900').
+// Case is ignored, a 'did:elsi:' prefix is removed and the separator after the type or the country can be
+// a hyphen, a colon, a space or nothing, so 'vat:es-b60645900', 'VATES:B60645900' and 'VAT ES B60645900'
+// are all converted to 'VATES-B60645900'. Identifiers without a known type are only trimmed and uppercased.
+func normalizeOrgID(orgID string) string {
+	orgID = strings.ToUpper(strings.TrimSpace(orgID))
+	orgID, _ = cutPrefixFold(orgID, "did:elsi:")
+
+	isSeparator := func(r rune) bool { return r == '-' || r == ':' || r == ' ' }
+
+	for _, idType := range orgIDTypes {
+		rest, found := strings.CutPrefix(orgID, idType)
+		if !found {
+			continue
+		}
+		rest = strings.TrimLeftFunc(rest, isSeparator)
+		if len(rest) < 3 || !isUpperLetter(rest[0]) || !isUpperLetter(rest[1]) {
+			break
+		}
+		country := rest[:2]
+		identifier := strings.TrimLeftFunc(rest[2:], isSeparator)
+		if len(identifier) == 0 {
+			break
+		}
+		return idType + country + "-" + strings.ReplaceAll(identifier, " ", "")
+	}
+
+	return orgID
+}
+
+func isUpperLetter(c byte) bool {
+	return c >= 'A' && c <= 'Z'
+}
+
+// cutPrefixFold is like strings.CutPrefix, but ignoring case
+func cutPrefixFold(s, prefix string) (string, bool) {
+	if len(s) >= len(prefix) && strings.EqualFold(s[:len(prefix)], prefix) {
+		return s[len(prefix):], true
+	}
+	return s, false
+}
+
+// powerLookup implements star.power_lookup(function, domain=None), which returns the entry of the power catalog
+// as a dict with 'function', 'domain', 'actions' and 'description', or None if the power is not in the catalog.
+// Function, domain and actions are compared ignoring case, as different issuers use different capitalisation.
+func (env *PolicyEnvironment) powerLookup(_ *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var function string
+	var domain string
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "function", &function, "domain?", &domain); err != nil {
+		return nil, err
+	}
+
+	for _, p := range env.PowerCatalog {
+		if !strings.EqualFold(p.Function, function) {
+			continue
+		}
+		if len(domain) > 0 && !strings.EqualFold(p.Domain, domain) {
+			continue
+		}
+
+		actions := make([]starlark.Value, 0, len(p.Actions))
+		for _, a := range p.Actions {
+			actions = append(actions, starlark.String(strings.ToLower(a)))
+		}
+
+		entry := starlark.NewDict(4)
+		entry.SetKey(starlark.String("function"), starlark.String(p.Function))
+		entry.SetKey(starlark.String("domain"), starlark.String(p.Domain))
+		entry.SetKey(starlark.String("actions"), starlark.NewList(actions))
+		entry.SetKey(starlark.String("description"), starlark.String(p.Description))
+		return entry, nil
+	}
+
+	return starlark.None, nil
+}
+
+// verifyJWT implements star.verify_jwt(token, key, payload=None), which returns True if the signature of the JWS
+// in compact serialization is valid. For a detached JWS ('header..signature') the payload must be passed
+// in 'payload'. The key is a 'did:key' or a public JWK in JSON; symmetric keys and the 'none' algorithm are rejected.
+// An invalid key is an error, because it comes from the policy, but an invalid token just returns False.
+func verifyJWT(_ *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var token, key string
+	var payload starlark.Value = starlark.None
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "token", &token, "key", &key, "payload?", &payload); err != nil {
+		return nil, err
+	}
+
+	publicKey, err := policyPublicKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", b.Name(), err)
+	}
+
+	msg, err := jws.Parse([]byte(token))
+	if err != nil || len(msg.Signatures()) != 1 {
+		return starlark.False, nil
+	}
+	alg := msg.Signatures()[0].ProtectedHeaders().Algorithm()
+	switch alg {
+	case jwa.NoSignature, jwa.HS256, jwa.HS384, jwa.HS512:
+		return starlark.False, nil
+	}
+
+	options := []jws.VerifyOption{jws.WithKey(alg, publicKey)}
+	if payload != starlark.None {
+		detached, ok := starlark.AsString(payload)
+		if !ok {
+			return nil, fmt.Errorf("%s: payload must be a string, got %s", b.Name(), payload.Type())
+		}
+		options = append(options, jws.WithDetachedPayload([]byte(detached)))
+	}
+
+	if _, err := jws.Verify([]byte(token), options...); err != nil {
+		return starlark.False, nil
+	}
+	return starlark.True, nil
+}
+
+// policyPublicKey returns the public key specified as a 'did:key' or a JWK
+func policyPublicKey(key string) (any, error) {
+	key = strings.TrimSpace(key)
+
+	if strings.HasPrefix(key, "did:key:") {
+		return did.PublicKeyFromDIDKey(key)
+	}
+
+	if strings.HasPrefix(key, "{") {
+		k, err := jwk.ParseKey([]byte(key))
+		if err != nil {
+			return nil, fmt.Errorf("parsing JWK: %w", err)
+		}
+		if k.KeyType() == jwa.OctetSeq {
+			return nil, fmt.Errorf("symmetric keys are not allowed")
+		}
+		return jwk.PublicRawKeyOf(k)
+	}
+
+	return nil, fmt.Errorf("the key must be a did:key or a JWK")
+}
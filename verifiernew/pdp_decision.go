@@ -0,0 +1,183 @@
+package verifiernew
+
+import (
+	"fmt"
+	"strings"
+
+	"go.starlark.net/starlark"
+)
+
+// PolicyDecision is the result of evaluating a policy.
+// The Starlark functions can return a bare bool, or a dict with the following fields:
+//
+//	{
+//	    "allow": True or False,
+//	    "reasons": ["human readable explanation", ...],
+//	    "obligations": {
+//	        "claims": {"claim_name": value, ...},   # added to the ID token
+//	        "drop_scopes": ["scope", ...],          # removed from the granted scopes
+//	    },
+//	}
+type PolicyDecision struct {
+	Allow       bool        `json:"allow"`
+	Reasons     []string    `json:"reasons,omitempty"`
+	Obligations Obligations `json:"obligations,omitempty"`
+}
+
+// Obligations are actions that the Verifier must perform when the decision is enforced
+type Obligations struct {
+	// Claims to add to the ID token
+	Claims map[string]any `json:"claims,omitempty"`
+
+	// Scopes to remove from the ones requested by the Client
+	DropScopes []string `json:"drop_scopes,omitempty"`
+}
+
+// Reason returns the reasons of the decision as a single string, suitable for error responses
+func (d *PolicyDecision) Reason() string {
+	if len(d.Reasons) == 0 {
+		if d.Allow {
+			return "allowed by policy"
+		}
+		return "denied by policy"
+	}
+	return strings.Join(d.Reasons, "; ")
+}
+
+// policyDecisionFromStarlark converts the value returned by a policy function into a PolicyDecision
+func policyDecisionFromStarlark(result starlark.Value) (*PolicyDecision, error) {
+
+	switch v := result.(type) {
+	case starlark.Bool:
+		return &PolicyDecision{Allow: bool(v)}, nil
+
+	case *starlark.Dict:
+		decision := &PolicyDecision{}
+
+		allow, found, err := v.Get(starlark.String("allow"))
+		if err != nil {
+			return nil, err
+		}
+		if !found {
+			return nil, fmt.Errorf("policy result does not include 'allow'")
+		}
+		b, ok := allow.(starlark.Bool)
+		if !ok {
+			return nil, fmt.Errorf("'allow' must be a bool, got %s", allow.Type())
+		}
+		decision.Allow = bool(b)
+
+		if reasons, found, _ := v.Get(starlark.String("reasons")); found {
+			decision.Reasons, err = stringListFromStarlark(reasons)
+			if err != nil {
+				return nil, fmt.Errorf("'reasons': %w", err)
+			}
+		}
+
+		obligations, found, _ := v.Get(starlark.String("obligations"))
+		if !found || obligations == starlark.None {
+			return decision, nil
+		}
+		od, ok := obligations.(*starlark.Dict)
+		if !ok {
+			return nil, fmt.Errorf("'obligations' must be a dict, got %s", obligations.Type())
+		}
+
+		if claims, found, _ := od.Get(starlark.String("claims")); found {
+			c, err := goFromStarlark(claims)
+			if err != nil {
+				return nil, fmt.Errorf("'claims': %w", err)
+			}
+			m, ok := c.(map[string]any)
+			if !ok {
+				return nil, fmt.Errorf("'claims' must be a dict, got %s", claims.Type())
+			}
+			decision.Obligations.Claims = m
+		}
+
+		if scopes, found, _ := od.Get(starlark.String("drop_scopes")); found {
+			decision.Obligations.DropScopes, err = stringListFromStarlark(scopes)
+			if err != nil {
+				return nil, fmt.Errorf("'drop_scopes': %w", err)
+			}
+		}
+
+		return decision, nil
+
+	default:
+		return nil, fmt.Errorf("function returned wrong type: %v", result.Type())
+	}
+}
+
+// stringListFromStarlark accepts a single string or a list of strings
+func stringListFromStarlark(v starlark.Value) ([]string, error) {
+	if s, ok := starlark.AsString(v); ok {
+		return []string{s}, nil
+	}
+
+	iterable, ok := v.(starlark.Iterable)
+	if !ok {
+		return nil, fmt.Errorf("expected a list of strings, got %s", v.Type())
+	}
+
+	var list []string
+	iter := iterable.Iterate()
+	defer iter.Done()
+	var item starlark.Value
+	for iter.Next(&item) {
+		s, ok := starlark.AsString(item)
+		if !ok {
+			return nil, fmt.Errorf("expected a string, got %s", item.Type())
+		}
+		list = append(list, s)
+	}
+	return list, nil
+}
+
+// goFromStarlark converts a Starlark value into the equivalent Go value, as it would be decoded from JSON
+func goFromStarlark(v starlark.Value) (any, error) {
+	switch v := v.(type) {
+	case starlark.NoneType:
+		return nil, nil
+	case starlark.Bool:
+		return bool(v), nil
+	case starlark.Int:
+		if i, ok := v.Int64(); ok {
+			return i, nil
+		}
+		return nil, fmt.Errorf("integer out of range: %s", v)
+	case starlark.Float:
+		return float64(v), nil
+	case starlark.String:
+		return string(v), nil
+	case *starlark.List, starlark.Tuple:
+		var list = []any{}
+		iter := v.(starlark.Iterable).Iterate()
+		defer iter.Done()
+		var item starlark.Value
+		for iter.Next(&item) {
+			elem, err := goFromStarlark(item)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, elem)
+		}
+		return list, nil
+	case *starlark.Dict:
+		var m = map[string]any{}
+		for _, kv := range v.Items() {
+			key, ok := starlark.AsString(kv[0])
+			if !ok {
+				return nil, fmt.Errorf("dict keys must be strings, got %s", kv[0].Type())
+			}
+			elem, err := goFromStarlark(kv[1])
+			if err != nil {
+				return nil, err
+			}
+			m[key] = elem
+		}
+		return m, nil
+	default:
+		return nil, fmt.Errorf("unsupported type %s", v.Type())
+	}
+}
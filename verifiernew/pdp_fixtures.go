@@ -0,0 +1,299 @@
+package verifiernew
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/hesusruiz/vcutils/yaml"
+)
+
+// PolicyFixture describes an evaluation of a policy, used to try policies without a Wallet and to test them.
+// Fixtures are YAML or JSON files, with paths relative to the directory of the fixture:
+//
+//	policy: ../authn_policies.star        # optional, overrides the policy given in the command line
+//	decision: authenticate                # or authorize
+//	credential: credentials/lear.json     # a file with the credential, or the credential itself as an object
+//	protected_resource: /api/orders       # optional
+//	request:                              # optional, the mocked HTTP request
+//	  method: POST
+//	  url: https://verifier.mycredential.eu/login/authenticationresponse
+//	  headers:
+//	    User-Agent: test
+//	input:                                # optional, the input object (see PolicyInput)
+//	  client_id: marketplace
+//	  checks:
+//	    validity: valid
+//	expect: allow                         # or deny
+//	reasons: ["expected reason"]          # optional, each one must be among the reasons of the decision
+type PolicyFixture struct {
+	Name              string         `json:"-"`
+	Policy            string         `json:"policy,omitempty"`
+	Decision          string         `json:"decision,omitempty"`
+	Credential        any            `json:"credential,omitempty"`
+	ProtectedResource string         `json:"protected_resource,omitempty"`
+	Request           FixtureRequest `json:"request,omitempty"`
+	Input             *PolicyInput   `json:"input,omitempty"`
+	Expect            string         `json:"expect,omitempty"`
+	Reasons           []string       `json:"reasons,omitempty"`
+
+	// The directory of the fixture file, to resolve relative paths
+	dir string
+}
+
+// FixtureRequest is the mocked HTTP request passed to the policy, also used by the JSON-RPC endpoint
+type FixtureRequest struct {
+	Method  string            `json:"method,omitempty"`
+	URL     string            `json:"url,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Body    string            `json:"body,omitempty"`
+}
+
+// PolicyResult is the outcome of evaluating a fixture
+type PolicyResult struct {
+	Fixture  *PolicyFixture
+	Decision *PolicyDecision
+	Output   []string
+	Err      error
+
+	// Passed is true if the decision matches the expectations of the fixture
+	Passed  bool
+	Failure string
+}
+
+// LoadPolicyFixture reads a fixture from a YAML or JSON file
+func LoadPolicyFixture(fileName string) (*PolicyFixture, error) {
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	y, err := yaml.ParseYaml(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("parsing fixture %s: %w", fileName, err)
+	}
+	raw, err := json.Marshal(y.Data())
+	if err != nil {
+		return nil, err
+	}
+
+	f := &PolicyFixture{}
+	if err := json.Unmarshal(raw, f); err != nil {
+		return nil, fmt.Errorf("parsing fixture %s: %w", fileName, err)
+	}
+	f.Name = fileName
+	f.dir = filepath.Dir(fileName)
+
+	return f, nil
+}
+
+// credential returns the serialized credential of the fixture, reading it from a file if needed
+func (f *PolicyFixture) credential() (string, error) {
+	switch cred := f.Credential.(type) {
+	case nil:
+		return "", fmt.Errorf("no credential specified")
+	case string:
+		data, err := os.ReadFile(f.path(cred))
+		if err != nil {
+			return "", err
+		}
+		// The credential file can be JSON or YAML
+		y, err := yaml.ParseYaml(string(data))
+		if err != nil {
+			return "", err
+		}
+		raw, err := json.Marshal(y.Data())
+		return string(raw), err
+	default:
+		raw, err := json.Marshal(cred)
+		return string(raw), err
+	}
+}
+
+// httpRequest builds the mocked HTTP request of the fixture
+func (f *PolicyFixture) httpRequest() (*http.Request, error) {
+	return f.Request.build(context.Background(), "https://verifier.mycredential.eu/login/authenticationresponse")
+}
+
+// build creates the HTTP request, with POST and the default URL when they are not specified
+func (fr *FixtureRequest) build(ctx context.Context, defaultURL string) (*http.Request, error) {
+	method := fr.Method
+	if len(method) == 0 {
+		method = http.MethodPost
+	}
+	url := fr.URL
+	if len(url) == 0 {
+		url = defaultURL
+	}
+
+	var body io.Reader
+	if len(fr.Body) > 0 {
+		body = strings.NewReader(fr.Body)
+	}
+
+	r, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	for key, value := range fr.Headers {
+		r.Header.Set(key, value)
+	}
+	return r, nil
+}
+
+func (f *PolicyFixture) path(p string) string {
+	if filepath.IsAbs(p) || len(f.dir) == 0 {
+		return p
+	}
+	return filepath.Join(f.dir, p)
+}
+
+// EvaluatePolicyFixture evaluates the fixture with the given policy file, unless the fixture specifies its own.
+// The environment configures the builtins available to the policy, as in the Verifier.
+// An error is returned only when the evaluation could not be performed.
+func EvaluatePolicyFixture(f *PolicyFixture, policyFile string, env *PolicyEnvironment) *PolicyResult {
+	res := &PolicyResult{Fixture: f}
+
+	if len(f.Policy) > 0 {
+		policyFile = f.path(f.Policy)
+	}
+
+	decision := Authenticate
+	switch strings.ToLower(f.Decision) {
+	case "", "authenticate":
+	case "authorize":
+		decision = Authorize
+	default:
+		res.Err = fmt.Errorf("invalid decision: %s", f.Decision)
+		return res
+	}
+
+	credential, err := f.credential()
+	if err != nil {
+		res.Err = err
+		return res
+	}
+
+	r, err := f.httpRequest()
+	if err != nil {
+		res.Err = err
+		return res
+	}
+
+	pdp, err := NewPDP(policyFile, env)
+	if err != nil {
+		res.Err = err
+		return res
+	}
+	defer pdp.Close()
+
+	res.Decision, res.Err = pdp.Evaluate(decision, r, credential, f.ProtectedResource, f.Input, func(msg string) {
+		res.Output = append(res.Output, msg)
+	})
+	if res.Err != nil {
+		return res
+	}
+
+	res.Passed, res.Failure = f.check(res.Decision)
+	return res
+}
+
+// check compares the decision with the expectations of the fixture
+func (f *PolicyFixture) check(decision *PolicyDecision) (bool, string) {
+	switch strings.ToLower(f.Expect) {
+	case "":
+		// Nothing expected, used when just evaluating a policy
+	case "allow":
+		if !decision.Allow {
+			return false, "expected allow, got deny"
+		}
+	case "deny":
+		if decision.Allow {
+			return false, "expected deny, got allow"
+		}
+	default:
+		return false, fmt.Sprintf("invalid expectation: %s", f.Expect)
+	}
+
+	for _, reason := range f.Reasons {
+		if !slices.Contains(decision.Reasons, reason) {
+			return false, fmt.Sprintf("expected reason not found: %s", reason)
+		}
+	}
+
+	return true, ""
+}
+
+// RunPolicyFixtures evaluates all the fixtures (files with extension .yaml, .yml or .json) in a directory
+func RunPolicyFixtures(dir string, policyFile string, env *PolicyEnvironment) ([]*PolicyResult, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var results []*PolicyResult
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		switch filepath.Ext(entry.Name()) {
+		case ".yaml", ".yml", ".json":
+		default:
+			continue
+		}
+
+		f, err := LoadPolicyFixture(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			results = append(results, &PolicyResult{Fixture: &PolicyFixture{Name: entry.Name()}, Err: err})
+			continue
+		}
+		results = append(results, EvaluatePolicyFixture(f, policyFile, env))
+	}
+
+	return results, nil
+}
+
+// Print writes the result in a human readable form
+func (res *PolicyResult) Print(w io.Writer) {
+	status := "PASS"
+	if res.Err != nil {
+		status = "ERROR"
+	} else if !res.Passed {
+		status = "FAIL"
+	}
+	fmt.Fprintf(w, "%-5s %s\n", status, res.Fixture.Name)
+
+	for _, line := range res.Output {
+		fmt.Fprintf(w, "      print: %s\n", line)
+	}
+
+	if res.Err != nil {
+		fmt.Fprintf(w, "      error: %s\n", res.Err)
+		return
+	}
+
+	decision := "deny"
+	if res.Decision.Allow {
+		decision = "allow"
+	}
+	fmt.Fprintf(w, "      decision: %s\n", decision)
+	for _, reason := range res.Decision.Reasons {
+		fmt.Fprintf(w, "      reason: %s\n", reason)
+	}
+	if len(res.Decision.Obligations.Claims) > 0 {
+		claims, _ := json.Marshal(res.Decision.Obligations.Claims)
+		fmt.Fprintf(w, "      claims: %s\n", claims)
+	}
+	if len(res.Decision.Obligations.DropScopes) > 0 {
+		fmt.Fprintf(w, "      drop scopes: %s\n", strings.Join(res.Decision.Obligations.DropScopes, ", "))
+	}
+	if len(res.Failure) > 0 {
+		fmt.Fprintf(w, "      failure: %s\n", res.Failure)
+	}
+}
@@ -0,0 +1,235 @@
+package verifiernew
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/evidenceledger/vcdemo/verifiernew/storage"
+	"github.com/evidenceledger/vcdemo/x509util"
+	"go.starlark.net/starlark"
+)
+
+// PolicyInput is the information about the authentication passed to the policies, in addition to the HTTP request
+// and the raw credential. It is received by the policy functions as their fourth argument ('input'), as a dict
+// with the same field names as the JSON serialization of this struct.
+type PolicyInput struct {
+	// ClientID is the identifier of the Client (Relying Party) which started the authentication
+	ClientID string `json:"client_id"`
+
+	// Scopes requested by the Client
+	Scopes []string `json:"scopes"`
+
+	// ACRValues requested by the Client, and the ACR profile selected from them
+	ACRValues    []string `json:"acr_values"`
+	RequestedACR string   `json:"requested_acr"`
+
+	// Format of the presentation received from the Wallet (jwt_vp_json),
+	// or of the credential (jwt_vc_json or ldp_vc) received in the JSON-RPC endpoint
+	Format string `json:"format"`
+
+	// Holder is the DID of the mandatee, the subject of the credential
+	Holder string `json:"holder"`
+
+	// Issuer of the credential, and the results of verifying its seal
+	Issuer PolicyIssuer `json:"issuer"`
+
+	// Checks are the results of the checks performed on the credential
+	Checks PolicyChecks `json:"checks"`
+}
+
+// PolicyIssuer describes the issuer of the credential
+type PolicyIssuer struct {
+	// DID of the issuer: the organization of the certificate of the seal when verified,
+	// and otherwise the one stated in the credential
+	DID string `json:"did"`
+
+	// Verified is true if the signature of the credential was verified with the certificate in its 'x5c' header,
+	// and the certificate was issued by one of the trust anchors of the Verifier
+	Verified bool `json:"verified"`
+
+	// Error explains why the verification failed, if it did
+	Error string `json:"error,omitempty"`
+
+	// Certificate is the subject of the certificate used to seal the credential, when verified
+	Certificate *PolicyCertificate `json:"certificate,omitempty"`
+}
+
+// PolicyCertificate is the subject of the eIDAS certificate of the issuer
+type PolicyCertificate struct {
+	Subject                string `json:"subject"`
+	CommonName             string `json:"common_name"`
+	Organization           string `json:"organization"`
+	OrganizationIdentifier string `json:"organization_identifier"`
+	Country                string `json:"country"`
+	Qualified              bool   `json:"qualified"`
+	NotBefore              string `json:"not_before"`
+	NotAfter               string `json:"not_after"`
+}
+
+// PolicyChecks are the results of the checks performed by the Verifier before calling the policies
+type PolicyChecks struct {
+	// Validity is "valid", "not_yet_valid" or "expired", according to the validity period of the credential
+	Validity string `json:"validity"`
+
+	// ValidFrom and ValidUntil are the validity period of the credential in RFC3339 format, if specified
+	ValidFrom  string `json:"valid_from,omitempty"`
+	ValidUntil string `json:"valid_until,omitempty"`
+
+	// Status is the revocation status of the credential: "valid", "revoked", "suspended", "unknown"
+	// when the credential does not include a status, or "unavailable" when it could not be checked
+	Status string `json:"status"`
+}
+
+const (
+	validityValid       = "valid"
+	validityNotYetValid = "not_yet_valid"
+	validityExpired     = "expired"
+	statusValid         = "valid"
+	statusRevoked       = "revoked"
+	statusSuspended     = "suspended"
+	statusUnknown       = "unknown"
+	statusUnavailable   = "unavailable"
+)
+
+// newPolicyInput builds the input for the policies from the AuthRequest of the Client and the presentation
+// received from the Wallet, performing the verifications whose results are reported to the policies.
+func newPolicyInput(authReq *storage.InternalAuthRequest, vp *presentation) *PolicyInput {
+	cred := vp.Credential
+
+	input := &PolicyInput{
+		ClientID:     authReq.ApplicationID,
+		Scopes:       authReq.Scopes,
+		ACRValues:    authReq.ACRValues,
+		RequestedACR: authReq.RequestedACR,
+		Format:       vp.Format,
+		Holder:       cred.String("credentialSubject.mandate.mandatee.id"),
+	}
+
+	// The issuer can be a string or an object with an 'id'
+	input.Issuer.DID = cred.String("issuer")
+	if len(input.Issuer.DID) == 0 {
+		input.Issuer.DID = cred.String("issuer.id")
+	}
+
+	if len(vp.CredentialJWT) == 0 {
+		input.Issuer.Error = "the credential is not a JWT"
+	} else if cert, issuerDID, err := sealCertificate(vp.CredentialJWT); err != nil {
+		input.Issuer.Error = err.Error()
+	} else {
+		input.Issuer.DID = issuerDID
+		input.Issuer.Verified = true
+		subject := x509util.ParseEIDASNameFromATVSequence(cert.Subject.Names)
+		input.Issuer.Certificate = &PolicyCertificate{
+			Subject:                cert.Subject.String(),
+			CommonName:             subject.CommonName,
+			Organization:           subject.Organization,
+			OrganizationIdentifier: subject.OrganizationIdentifier,
+			Country:                subject.Country,
+			Qualified:              x509util.IsQualifiedCertificate(cert),
+			NotBefore:              cert.NotBefore.Format(time.RFC3339),
+			NotAfter:               cert.NotAfter.Format(time.RFC3339),
+		}
+	}
+
+	// The validity period, using the names of the VC Data Model 2.0 or 1.1
+	now := time.Now()
+	input.Checks.Validity = validityValid
+	validFrom, ok := credentialTime(cred.String("validFrom"), cred.String("issuanceDate"))
+	if ok {
+		input.Checks.ValidFrom = validFrom.Format(time.RFC3339)
+		if now.Before(validFrom) {
+			input.Checks.Validity = validityNotYetValid
+		}
+	}
+	validUntil, ok := credentialTime(cred.String("validUntil"), cred.String("expirationDate"))
+	if ok {
+		input.Checks.ValidUntil = validUntil.Format(time.RFC3339)
+		if now.After(validUntil) {
+			input.Checks.Validity = validityExpired
+		}
+	}
+
+	// The status is checked only when the seal of the Issuer is valid, because the status lists are sealed by it
+	input.Checks.Status = statusUnknown
+	if input.Issuer.Verified {
+		input.Checks.Status = credentialStatus(cred, input.Issuer.DID)
+	} else if len(credentialStatusEntries(cred)) > 0 {
+		input.Checks.Status = statusUnavailable
+	}
+
+	return input
+}
+
+// credentialTime parses the first non-empty date, which can be in RFC3339 format or seconds since the epoch
+func credentialTime(values ...string) (time.Time, bool) {
+	for _, v := range values {
+		if len(v) == 0 {
+			continue
+		}
+		if t, err := time.Parse(time.RFC3339, v); err == nil {
+			return t, true
+		}
+		if secs, err := strconv.ParseInt(v, 10, 64); err == nil {
+			return time.Unix(secs, 0), true
+		}
+	}
+	return time.Time{}, false
+}
+
+// toStarlark converts the input into a Starlark dict, with the same structure as its JSON serialization
+func (in *PolicyInput) toStarlark() (starlark.Value, error) {
+	if in == nil {
+		return &starlark.Dict{}, nil
+	}
+
+	raw, err := json.Marshal(in)
+	if err != nil {
+		return nil, err
+	}
+	var data any
+	if err := json.Unmarshal(raw, &data); err != nil {
+		return nil, err
+	}
+	return starlarkFromGo(data)
+}
+
+// starlarkFromGo converts a value decoded from JSON into the equivalent Starlark value
+func starlarkFromGo(v any) (starlark.Value, error) {
+	switch v := v.(type) {
+	case nil:
+		return starlark.None, nil
+	case bool:
+		return starlark.Bool(v), nil
+	case float64:
+		if v == float64(int64(v)) {
+			return starlark.MakeInt64(int64(v)), nil
+		}
+		return starlark.Float(v), nil
+	case string:
+		return starlark.String(v), nil
+	case []any:
+		elems := make([]starlark.Value, 0, len(v))
+		for _, e := range v {
+			sv, err := starlarkFromGo(e)
+			if err != nil {
+				return nil, err
+			}
+			elems = append(elems, sv)
+		}
+		return starlark.NewList(elems), nil
+	case map[string]any:
+		dict := starlark.NewDict(len(v))
+		for key, e := range v {
+			sv, err := starlarkFromGo(e)
+			if err != nil {
+				return nil, err
+			}
+			dict.SetKey(starlark.String(key), sv)
+		}
+		return dict, nil
+	default:
+		return nil, fmt.Errorf("unsupported type %T", v)
+	}
+}
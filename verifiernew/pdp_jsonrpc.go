@@ -0,0 +1,366 @@
+package verifiernew
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/evidenceledger/vcdemo/verifiernew/storage"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/hesusruiz/vcutils/yaml"
+	zlog "github.com/rs/zerolog/log"
+)
+
+// The PDP can be used by external Policy Enforcement Points (like an API gateway) with JSON-RPC 2.0 requests
+// sent with POST to /pdp. The PEP is a registered Client, authenticating with its client_id and secret with
+// HTTP Basic authentication. The methods are:
+//
+//   - authenticate: evaluates the 'authenticate' function of the policy
+//   - authorize: evaluates the 'authorize' function of the policy for the 'protected_resource'
+//   - explain: evaluates the function in 'decision' (default 'authenticate') and returns also the input
+//     passed to the policy, its output and the policy file used, to help writing and debugging policies.
+//     It is only available to the admins, because it exposes the output of the policies.
+//
+// The input of the policy is always built by the Verifier from the credential.
+// The params are described by PDPParams, for example:
+//
+//	{
+//	    "jsonrpc": "2.0",
+//	    "id": 1,
+//	    "method": "authorize",
+//	    "params": {
+//	        "credential": "eyJhbGciOi...",
+//	        "protected_resource": "/api/orders",
+//	        "client_id": "marketplace"
+//	    }
+//	}
+//
+// The result of 'authenticate' and 'authorize' is a PolicyDecision. A denial is a valid result, not an error.
+
+// JSON-RPC 2.0 error codes
+const (
+	rpcParseError     = -32700
+	rpcInvalidRequest = -32600
+	rpcMethodNotFound = -32601
+	rpcInvalidParams  = -32602
+	rpcInternalError  = -32603
+)
+
+// The maximum size of a JSON-RPC request
+const maxRPCRequestSize = 1 << 20
+
+type jsonrpcMessage struct {
+	Version string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params"`
+}
+
+type jsonrpcResponse struct {
+	Version string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  any             `json:"result,omitempty"`
+	Error   *jsonrpcError   `json:"error,omitempty"`
+}
+
+type jsonrpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// PDPParams are the params of the JSON-RPC methods
+type PDPParams struct {
+	// Credential is the credential as a JWT (jwt_vc_json) or as a JSON object (ldp_vc)
+	Credential json.RawMessage `json:"credential"`
+
+	// ProtectedResource is the resource the holder of the credential wants to access
+	ProtectedResource string `json:"protected_resource,omitempty"`
+
+	// ClientID and Scopes select the policy, as for the authentication requests of the Clients.
+	// The ClientID is the one of the authenticated PEP, and if specified it must be the same.
+	ClientID string   `json:"client_id,omitempty"`
+	Scopes   []string `json:"scopes,omitempty"`
+
+	// Request is the HTTP request received by the PEP. If not specified, the JSON-RPC request is passed to the policy.
+	Request *FixtureRequest `json:"request,omitempty"`
+
+	// Decision is the function evaluated by 'explain': 'authenticate' or 'authorize'
+	Decision string `json:"decision,omitempty"`
+}
+
+// PDPExplanation is the result of the 'explain' method
+type PDPExplanation struct {
+	Policy     string          `json:"policy"`
+	PolicyHash string          `json:"policy_hash"`
+	Decision   string          `json:"decision"`
+	Result     *PolicyDecision `json:"result"`
+	Input      *PolicyInput    `json:"input"`
+	Output     []string        `json:"output"`
+}
+
+// pepClient is the Policy Enforcement Point authenticated in a request to the JSON-RPC endpoint
+type pepClient struct {
+	id    string
+	admin bool
+}
+
+type pepClientKey struct{}
+
+// requirePEPClient allows only requests authenticated with the client_id and secret of a registered Client.
+// The Clients listed in 'admins' can also use the 'explain' method.
+func requirePEPClient(admins []string, clients clientAuthenticator) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			clientID, secret, ok := r.BasicAuth()
+			if !ok || len(secret) == 0 || clients.AuthorizeClientIDSecret(r.Context(), clientID, secret) != nil {
+				w.Header().Set("WWW-Authenticate", `Basic realm="pdp"`)
+				http.Error(w, "client credentials required", http.StatusUnauthorized)
+				return
+			}
+			pep := &pepClient{id: clientID, admin: slices.Contains(admins, clientID)}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), pepClientKey{}, pep)))
+		})
+	}
+}
+
+// HttpHandler serves the JSON-RPC endpoint, using the policy of the authenticated client and the scopes specified
+// in the params
+func (ps *PolicySet) HttpHandler(w http.ResponseWriter, r *http.Request) {
+	serveJSONRPC(w, r, ps.For)
+}
+
+// HttpHandler serves the JSON-RPC endpoint, using always the policy of this PDP
+func (m *PDP) HttpHandler(w http.ResponseWriter, r *http.Request) {
+	serveJSONRPC(w, r, func(string, []string) *PDP { return m })
+}
+
+// serveJSONRPC processes a JSON-RPC request, evaluating the policy returned by selectPDP.
+// The request must have been authenticated with requirePEPClient. Batches are not supported, and notifications (requests without 'id') are accepted but not evaluated.
+func serveJSONRPC(w http.ResponseWriter, r *http.Request, selectPDP func(clientID string, scopes []string) *PDP) {
+
+	zlog.Info().Msg("in JSONRPC handler")
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Check that this is a JSON request
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "application/json" {
+		http.Error(w, "invalid content type", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxRPCRequestSize))
+	if err != nil {
+		writeRPCError(w, nil, rpcInvalidRequest, err.Error())
+		return
+	}
+
+	if bytes.HasPrefix(bytes.TrimSpace(body), []byte("[")) {
+		writeRPCError(w, nil, rpcInvalidRequest, "batch requests are not supported")
+		return
+	}
+
+	var msg jsonrpcMessage
+	if err := json.Unmarshal(body, &msg); err != nil {
+		writeRPCError(w, nil, rpcParseError, err.Error())
+		return
+	}
+	if msg.Version != "2.0" {
+		writeRPCError(w, msg.ID, rpcInvalidRequest, "invalid JSON-RPC version")
+		return
+	}
+	if len(msg.Method) == 0 {
+		writeRPCError(w, msg.ID, rpcInvalidRequest, "JSON-RPC method not specified")
+		return
+	}
+
+	// A notification does not have a response, and a decision nobody receives is useless
+	if len(msg.ID) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	var decision Decision
+	explain := false
+	switch msg.Method {
+	case "authenticate":
+		decision = Authenticate
+	case "authorize":
+		decision = Authorize
+	case "explain":
+		explain = true
+	default:
+		writeRPCError(w, msg.ID, rpcMethodNotFound, fmt.Sprintf("method not found: %s", msg.Method))
+		return
+	}
+
+	pep, ok := r.Context().Value(pepClientKey{}).(*pepClient)
+	if !ok {
+		writeRPCError(w, msg.ID, rpcInvalidRequest, "client not authenticated")
+		return
+	}
+
+	// The output of the policies can have personal data and details of the policies
+	if explain && !pep.admin {
+		writeRPCError(w, msg.ID, rpcInvalidRequest, "explain is only available to admins")
+		return
+	}
+
+	var params PDPParams
+	if len(msg.Params) == 0 {
+		writeRPCError(w, msg.ID, rpcInvalidParams, "params are required")
+		return
+	}
+	if err := json.Unmarshal(msg.Params, &params); err != nil {
+		writeRPCError(w, msg.ID, rpcInvalidParams, err.Error())
+		return
+	}
+
+	// A PEP can only obtain the decisions of the policy of its own Client
+	if len(params.ClientID) > 0 && params.ClientID != pep.id {
+		writeRPCError(w, msg.ID, rpcInvalidParams, "client_id is not the authenticated client")
+		return
+	}
+	params.ClientID = pep.id
+
+	if explain {
+		switch params.Decision {
+		case "", "authenticate":
+			decision = Authenticate
+		case "authorize":
+			decision = Authorize
+		default:
+			writeRPCError(w, msg.ID, rpcInvalidParams, fmt.Sprintf("invalid decision: %s", params.Decision))
+			return
+		}
+	}
+
+	// The credential and the input for the policy
+	vc, err := credentialFromParams(params.Credential)
+	if err != nil {
+		writeRPCError(w, msg.ID, rpcInvalidParams, err.Error())
+		return
+	}
+	serialCredential, err := json.Marshal(vc.Credential.Data())
+	if err != nil {
+		writeRPCError(w, msg.ID, rpcInvalidParams, err.Error())
+		return
+	}
+	authReq := &storage.InternalAuthRequest{ApplicationID: params.ClientID, Scopes: params.Scopes}
+	input := newPolicyInput(authReq, vc)
+
+	// The HTTP request of the PEP, or the JSON-RPC request itself
+	policyRequest := r
+	if params.Request != nil {
+		policyRequest, err = params.Request.build(r.Context(), r.URL.String())
+		if err != nil {
+			writeRPCError(w, msg.ID, rpcInvalidParams, err.Error())
+			return
+		}
+	}
+
+	pdp := selectPDP(params.ClientID, params.Scopes)
+
+	var output []string
+	print := func(msg string) { fmt.Println(msg) }
+	if explain {
+		print = func(msg string) { output = append(output, msg) }
+	}
+
+	result, err := pdp.Evaluate(decision, policyRequest, string(serialCredential), params.ProtectedResource, input, print)
+	if err != nil {
+		zlog.Err(err).Str("method", msg.Method).Msg("evaluating policy")
+		message := "error evaluating policy"
+		if errors.Is(err, ErrPolicyBudget) {
+			message = err.Error()
+		}
+		writeRPCError(w, msg.ID, rpcInternalError, message)
+		return
+	}
+
+	if !explain {
+		writeRPCResult(w, msg.ID, result)
+		return
+	}
+
+	writeRPCResult(w, msg.ID, &PDPExplanation{
+		Policy:     pdp.scriptname,
+		PolicyHash: pdp.policy.Load().hash,
+		Decision:   strings.ToLower(decision.String()),
+		Result:     result,
+		Input:      input,
+		Output:     output,
+	})
+}
+
+// credentialFromParams parses the credential received in the params, which is a JWT or a JSON object.
+// The signature of a JWT is not checked here: the result of the verification is reported in the input of the policy.
+func credentialFromParams(raw json.RawMessage) (*presentation, error) {
+	raw = bytes.TrimSpace(raw)
+	if len(raw) == 0 || bytes.Equal(raw, []byte("null")) {
+		return nil, fmt.Errorf("credential is required")
+	}
+
+	switch raw[0] {
+	case '"':
+		var credentialJWT string
+		if err := json.Unmarshal(raw, &credentialJWT); err != nil {
+			return nil, err
+		}
+		var credMap = jwt.MapClaims{}
+		if _, _, err := jwt.NewParser().ParseUnverified(credentialJWT, &credMap); err != nil {
+			return nil, fmt.Errorf("invalid credential JWT: %w", err)
+		}
+		vc, ok := credMap["vc"].(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("no 'vc' claim in credential JWT")
+		}
+		return &presentation{
+			Format:        formatJWTVCJSON,
+			Credential:    yaml.New(vc),
+			CredentialJWT: credentialJWT,
+		}, nil
+
+	case '{':
+		var cred map[string]any
+		if err := json.Unmarshal(raw, &cred); err != nil {
+			return nil, err
+		}
+		return &presentation{
+			Format:     formatLDPVC,
+			Credential: yaml.New(cred),
+		}, nil
+
+	default:
+		return nil, fmt.Errorf("credential must be a JWT or a JSON object")
+	}
+}
+
+func writeRPCResult(w http.ResponseWriter, id json.RawMessage, result any) {
+	writeRPCResponse(w, &jsonrpcResponse{Version: "2.0", ID: id, Result: result})
+}
+
+func writeRPCError(w http.ResponseWriter, id json.RawMessage, code int, message string) {
+	if len(id) == 0 {
+		id = json.RawMessage("null")
+	}
+	writeRPCResponse(w, &jsonrpcResponse{Version: "2.0", ID: id, Error: &jsonrpcError{Code: code, Message: message}})
+}
+
+// writeRPCResponse sends the response with status 200, as the errors are reported inside the JSON-RPC response
+func writeRPCResponse(w http.ResponseWriter, resp *jsonrpcResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,93 @@
+package verifiernew
+
+import (
+	"fmt"
+)
+
+// PolicySet holds the PDPs for the different policy files configured in the Verifier.
+// Each registered client, or each scope, can specify its own policy file. Otherwise the default one is used.
+// A policy file used by several clients or scopes is compiled only once.
+type PolicySet struct {
+	defaultPDP *PDP
+	byClient   map[string]*PDP
+	byScope    map[string]*PDP
+	byFile     map[string]*PDP
+
+	// The environment shared by all the PDPs
+	env *PolicyEnvironment
+}
+
+// NewPolicySet compiles all the policy files specified in the configuration.
+// The decisions are recorded in the audit log, if not nil.
+func NewPolicySet(cfg *Config, audit *AuditLog) (*PolicySet, error) {
+	ps := &PolicySet{
+		byClient: make(map[string]*PDP),
+		byScope:  make(map[string]*PDP),
+		byFile:   make(map[string]*PDP),
+	}
+
+	var err error
+
+	ps.env, err = NewPolicyEnvironment(cfg)
+	if err != nil {
+		return nil, err
+	}
+	ps.env.Audit = audit
+
+	ps.defaultPDP, err = ps.pdpForFile(cfg.AuthnPolicies)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, client := range cfg.RegisteredClients {
+		if len(client.Policy) == 0 {
+			continue
+		}
+		ps.byClient[client.Id], err = ps.pdpForFile(client.Policy)
+		if err != nil {
+			return nil, fmt.Errorf("policy for client %s: %w", client.Id, err)
+		}
+	}
+
+	for scope, file := range cfg.ScopePolicies {
+		ps.byScope[scope], err = ps.pdpForFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("policy for scope %s: %w", scope, err)
+		}
+	}
+
+	return ps, nil
+}
+
+// pdpForFile returns the PDP for a policy file, creating it if needed
+func (ps *PolicySet) pdpForFile(fileName string) (*PDP, error) {
+	if p, ok := ps.byFile[fileName]; ok {
+		return p, nil
+	}
+	p, err := NewPDP(fileName, ps.env)
+	if err != nil {
+		return nil, err
+	}
+	ps.byFile[fileName] = p
+	return p, nil
+}
+
+// For returns the PDP that applies to an authentication request.
+// The policy of the client has precedence, then the policy of the first requested scope that has one,
+// and finally the default policy.
+func (ps *PolicySet) For(clientID string, scopes []string) *PDP {
+	if p, ok := ps.byClient[clientID]; ok {
+		return p
+	}
+	for _, scope := range scopes {
+		if p, ok := ps.byScope[scope]; ok {
+			return p
+		}
+	}
+	return ps.defaultPDP
+}
+
+// Default returns the PDP of the default policy file
+func (ps *PolicySet) Default() *PDP {
+	return ps.defaultPDP
+}
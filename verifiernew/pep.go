@@ -0,0 +1,185 @@
+package verifiernew
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+
+	"github.com/evidenceledger/vcdemo/verifiernew/storage"
+	"github.com/go-chi/chi/v5"
+	"github.com/hesusruiz/vcutils/yaml"
+	"github.com/zitadel/logging"
+	"github.com/zitadel/oidc/v3/pkg/op"
+)
+
+// The header with the subject of the access token, sent to the upstream servers
+const pepSubjectHeader = "X-Verifier-Subject"
+
+// tokenCredentials gives access to the credentials presented by the users, from the access tokens issued to the Clients
+type tokenCredentials interface {
+	AccessTokenCredential(tokenID string, subject string) (*storage.Token, *yaml.YAML, error)
+}
+
+// pep is an optional Policy Enforcement Point working as a reverse proxy. Requests must include an access token
+// issued by the Verifier. The credential presented by the user when authenticating is passed to the 'authorize'
+// function of the policy, with the path in the upstream server as the protected resource, and the request is
+// forwarded only if the policy allows it. This way, backend APIs get credential-based authorization without any code.
+type pep struct {
+	// Crypto decrypts the opaque access tokens issued by the OpenID Provider
+	crypto op.Crypto
+	tokens tokenCredentials
+}
+
+// pepAuthorization is passed in the context of the request from the authorization to the proxy
+type pepAuthorization struct {
+	subject  string
+	upstream *url.URL
+}
+
+type pepContextKey struct{}
+
+// newPEPRouter creates the router for the configured proxy routes, to be mounted in /pep
+func newPEPRouter(routes []ProxyRoute, crypto op.Crypto, tokens tokenCredentials) (chi.Router, error) {
+	p := &pep{crypto: crypto, tokens: tokens}
+
+	router := chi.NewRouter()
+	for _, route := range routes {
+		target, err := url.Parse(route.Upstream)
+		if err != nil {
+			return nil, fmt.Errorf("proxy route %s: %w", route.Prefix, err)
+		}
+
+		prefix := "/" + strings.Trim(route.Prefix, "/")
+		handler := p.handler(route, target)
+		router.Handle(prefix, handler)
+		router.Handle(prefix+"/*", handler)
+	}
+
+	return router, nil
+}
+
+// handler authorizes the requests of a route and forwards them to the upstream server
+func (p *pep) handler(route ProxyRoute, target *url.URL) http.Handler {
+
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			auth := pr.In.Context().Value(pepContextKey{}).(*pepAuthorization)
+			pr.Out.URL = auth.upstream
+			pr.Out.Host = target.Host
+			pr.SetXForwarded()
+
+			// The access token is for the Verifier, and the subject is asserted by us, not by the caller
+			pr.Out.Header.Del("Authorization")
+			pr.Out.Header.Set(pepSubjectHeader, auth.subject)
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			logger, ok := logging.FromContext(r.Context())
+			if !ok {
+				logger = slog.Default()
+			}
+			logger.Error("forwarding request", "upstream", target.String(), "error", err)
+			walletError(w, http.StatusBadGateway, errServerError, "upstream server not available")
+		},
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth, ok := p.authorize(w, r, route, target)
+		if !ok {
+			return
+		}
+		proxy.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), pepContextKey{}, auth)))
+	})
+}
+
+// authorize validates the access token and evaluates the policy. If the request is not allowed, the response is
+// written and false is returned.
+func (p *pep) authorize(w http.ResponseWriter, r *http.Request, route ProxyRoute, target *url.URL) (*pepAuthorization, bool) {
+
+	// The access token as defined in RFC 6750
+	scheme, accessToken, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !strings.EqualFold(scheme, "Bearer") || len(accessToken) == 0 {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="verifier"`)
+		walletError(w, http.StatusUnauthorized, errInvalidRequest, "access token required")
+		return nil, false
+	}
+
+	tokenID, subject, err := p.tokenIDAndSubject(accessToken)
+	var token *storage.Token
+	var cred *yaml.YAML
+	if err == nil {
+		token, cred, err = p.tokens.AccessTokenCredential(tokenID, subject)
+	}
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="verifier", error="invalid_token"`)
+		walletError(w, http.StatusUnauthorized, "invalid_token", err.Error())
+		return nil, false
+	}
+
+	if len(route.ClientID) > 0 && token.ApplicationID != route.ClientID {
+		auditEvent(r, "pep_wrong_client", "client_id", token.ApplicationID, "route", route.Prefix)
+		walletError(w, http.StatusForbidden, errAccessDenied, "the access token was not issued for this resource")
+		return nil, false
+	}
+
+	upstream, err := upstreamURL(target, chi.URLParam(r, "*"), r.URL.RawQuery)
+	if err != nil {
+		walletError(w, http.StatusBadRequest, errInvalidRequest, err.Error())
+		return nil, false
+	}
+
+	serialCredential, err := json.Marshal(cred.Data())
+	if err != nil {
+		walletError(w, http.StatusInternalServerError, errServerError, err.Error())
+		return nil, false
+	}
+	authReq := &storage.InternalAuthRequest{ApplicationID: token.ApplicationID, Scopes: token.Scopes}
+	// The credential JWT is passed so the seal is verified and the status is checked again on every request,
+	// and a credential revoked or suspended after the token was issued is denied
+	input := newPolicyInput(authReq, &presentation{Credential: cred, CredentialJWT: token.CredentialJWT})
+
+	// Any error evaluating the policy denies the request
+	decision, err := policies.For(token.ApplicationID, token.Scopes).TakeAuthnDecision(Authorize, r, string(serialCredential), upstream.Path, input)
+	if err != nil {
+		walletError(w, http.StatusInternalServerError, errServerError, fmt.Sprintf("error evaluating authorization rules:%s", err))
+		return nil, false
+	}
+	if !decision.Allow {
+		auditEvent(r, "pep_denied", "subject", subject, "client_id", token.ApplicationID, "resource", upstream.Path, "reasons", decision.Reasons)
+		walletError(w, http.StatusForbidden, errAccessDenied, decision.Reason())
+		return nil, false
+	}
+
+	return &pepAuthorization{subject: subject, upstream: upstream}, true
+}
+
+// tokenIDAndSubject decrypts an opaque access token issued by the OpenID Provider, which contains 'tokenID:subject'
+func (p *pep) tokenIDAndSubject(accessToken string) (string, string, error) {
+	tokenIDSubject, err := p.crypto.Decrypt(accessToken)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid access token")
+	}
+	tokenID, subject, found := strings.Cut(tokenIDSubject, ":")
+	if !found {
+		return "", "", fmt.Errorf("invalid access token")
+	}
+	return tokenID, subject, nil
+}
+
+// upstreamURL builds the URL in the upstream server, appending the rest of the path of the request to the one of
+// the target. The result must be inside the path of the target, so '..' can not be used to reach other resources.
+func upstreamURL(target *url.URL, rest string, rawQuery string) (*url.URL, error) {
+	u := target.JoinPath(rest)
+
+	base := strings.TrimSuffix(target.Path, "/")
+	if u.Path != base && !strings.HasPrefix(u.Path, base+"/") {
+		return nil, fmt.Errorf("invalid path")
+	}
+
+	u.RawQuery = rawQuery
+	return u, nil
+}
@@ -0,0 +1,208 @@
+package verifiernew
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/hesusruiz/vcutils/yaml"
+)
+
+// Formats of presentations and credentials, as identified in the 'presentation_submission' of the Wallet
+const (
+	formatJWTVP     = "jwt_vp"
+	formatJWTVPJSON = "jwt_vp_json"
+	formatLDPVP     = "ldp_vp"
+	formatJWTVC     = "jwt_vc"
+	formatJWTVCJSON = "jwt_vc_json"
+	formatLDPVC     = "ldp_vc"
+)
+
+// presentation is the result of parsing the 'vp_token' sent by the Wallet, independently of its format
+type presentation struct {
+	// Format is the format of the presentation, which is always jwt_vp_json
+	Format string
+
+	// VPJWT is the presentation
+	VPJWT string
+
+	// Claims are the values of the presentation used to detect replays ('jti', 'nonce', 'exp')
+	Claims jwt.MapClaims
+
+	// Credential is the credential selected by the presentation submission
+	Credential *yaml.YAML
+
+	// CredentialJWT is the credential when it is a JWT, and empty for ldp_vc
+	CredentialJWT string
+}
+
+// presentationSubmission is the object defined in DIF Presentation Exchange, telling the Verifier
+// where the credentials are inside the vp_token and in which format.
+type presentationSubmission struct {
+	ID            string                 `json:"id,omitempty"`
+	DefinitionID  string                 `json:"definition_id,omitempty"`
+	DescriptorMap []submissionDescriptor `json:"descriptor_map,omitempty"`
+}
+
+type submissionDescriptor struct {
+	ID         string                `json:"id,omitempty"`
+	Format     string                `json:"format,omitempty"`
+	Path       string                `json:"path,omitempty"`
+	PathNested *submissionDescriptor `json:"path_nested,omitempty"`
+}
+
+// formatError signals that the Wallet sent a presentation or credential in a format we do not support
+type formatError struct {
+	format string
+}
+
+func (e formatError) Error() string {
+	return fmt.Sprintf("format not supported: %s", e.format)
+}
+
+// parsePresentation parses the 'vp_token' and the optional 'presentation_submission' received from the Wallet.
+// When the Wallet does not send a presentation submission, the format is detected from the token itself,
+// and the first credential is used.
+//
+// Only JWT presentations are accepted. JSON-LD presentations (ldp_vp) are rejected, because their Linked Data
+// proof, and so the nonce in it, can not be verified without JSON-LD canonicalization.
+func parsePresentation(vpToken string, submission string) (*presentation, error) {
+
+	var descriptor submissionDescriptor
+	if len(submission) > 0 {
+		var ps presentationSubmission
+		if err := json.Unmarshal([]byte(submission), &ps); err != nil {
+			return nil, fmt.Errorf("invalid presentation_submission: %w", err)
+		}
+		if len(ps.DescriptorMap) == 0 {
+			return nil, fmt.Errorf("empty descriptor_map in presentation_submission")
+		}
+		descriptor = ps.DescriptorMap[0]
+	}
+
+	raw, err := decodeVPToken(vpToken)
+	if err != nil {
+		return nil, err
+	}
+
+	format := descriptor.Format
+	if len(format) == 0 {
+		if strings.HasPrefix(raw, "{") {
+			format = formatLDPVP
+		} else {
+			format = formatJWTVPJSON
+		}
+	}
+
+	p := &presentation{
+		Format: format,
+	}
+
+	var vp *yaml.YAML
+
+	switch format {
+	case formatJWTVP, formatJWTVPJSON:
+		p.Format = formatJWTVPJSON
+		p.VPJWT = raw
+
+		// The signature of the VP is checked with the key of the holder before using its claims (see checkReplay)
+		p.Claims = jwt.MapClaims{}
+		if _, _, err := jwt.NewParser().ParseUnverified(raw, &p.Claims); err != nil {
+			return nil, formatError{format: fmt.Sprintf("%s (%s)", format, err)}
+		}
+		vp = yaml.New(p.Claims["vp"])
+
+	case formatLDPVP:
+		return nil, formatError{format: fmt.Sprintf("%s (the Linked Data proof can not be verified)", format)}
+
+	default:
+		return nil, formatError{format: format}
+	}
+
+	// Get the list of credentials in the VP
+	credentials := vp.List("verifiableCredential")
+	if len(credentials) == 0 {
+		return nil, fmt.Errorf("no credentials found in VP")
+	}
+
+	index := 0
+	credentialFormat := ""
+	if descriptor.PathNested != nil {
+		credentialFormat = descriptor.PathNested.Format
+		index, err = credentialIndex(descriptor.PathNested.Path)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if index >= len(credentials) {
+		return nil, fmt.Errorf("credential %d not found in VP", index)
+	}
+
+	switch cred := credentials[index].(type) {
+	case string:
+		if len(credentialFormat) > 0 && credentialFormat != formatJWTVC && credentialFormat != formatJWTVCJSON {
+			return nil, formatError{format: credentialFormat}
+		}
+
+		// The credential is in 'jwt_vc_json' format (which is a JWT)
+		var credMap = jwt.MapClaims{}
+		if _, _, err := jwt.NewParser().ParseUnverified(cred, &credMap); err != nil {
+			return nil, formatError{format: fmt.Sprintf("%s (%s)", formatJWTVCJSON, err)}
+		}
+		p.CredentialJWT = cred
+		p.Credential = yaml.New(credMap["vc"])
+
+	case map[string]any:
+		if len(credentialFormat) > 0 && credentialFormat != formatLDPVC {
+			return nil, formatError{format: credentialFormat}
+		}
+
+		// The credential is in 'ldp_vc' format (a JSON object)
+		p.Credential = yaml.New(cred)
+
+	default:
+		return nil, formatError{format: fmt.Sprintf("credential of type %T", cred)}
+	}
+
+	return p, nil
+}
+
+// decodeVPToken returns the presentation inside the 'vp_token', which can be sent directly or base64url encoded
+func decodeVPToken(vpToken string) (string, error) {
+	vpToken = strings.TrimSpace(vpToken)
+
+	// A JSON object or a JWT sent as is
+	if strings.HasPrefix(vpToken, "{") || strings.Count(vpToken, ".") == 2 {
+		return vpToken, nil
+	}
+
+	decoded, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(vpToken, "="))
+	if err != nil {
+		return "", fmt.Errorf("error decoding VP:%w", err)
+	}
+	return string(decoded), nil
+}
+
+// credentialIndex returns the index of the credential in a path like '$.verifiableCredential[1]',
+// which is the only kind of path that we support in the presentation submission.
+func credentialIndex(path string) (int, error) {
+	if len(path) == 0 || path == "$" {
+		return 0, nil
+	}
+
+	path = strings.TrimPrefix(path, "$.vp")
+	path = strings.TrimPrefix(path, "$")
+	rest, ok := strings.CutPrefix(path, ".verifiableCredential[")
+	if !ok || !strings.HasSuffix(rest, "]") {
+		return 0, fmt.Errorf("unsupported path in presentation_submission: %s", path)
+	}
+
+	index, err := strconv.Atoi(strings.TrimSuffix(rest, "]"))
+	if err != nil || index < 0 {
+		return 0, fmt.Errorf("unsupported path in presentation_submission: %s", path)
+	}
+	return index, nil
+}
@@ -0,0 +1,71 @@
+package verifiernew
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/evidenceledger/vcdemo/verifiernew/storage"
+	"github.com/zitadel/logging"
+)
+
+// checkReplay rejects a presentation which is not for the AuthRequest, or whose 'jti', 'nonce' or content has
+// already been received. The presentation must be signed by the holder of the credential, so the values can not
+// be changed by somebody who captured the credential, and must include the nonce sent to the Wallet, as required
+// by OID4VP. Each nonce is accepted only once, so the same presentation can not be posted again for this or
+// another 'state'. The values are remembered until the AuthRequest (or the presentation, if it lives longer) expires.
+func (l *login) checkReplay(authReq *storage.InternalAuthRequest, vp *presentation) error {
+
+	now := time.Now()
+	expiration := authReq.WalletRequestExpiration()
+	if now.After(expiration) {
+		return fmt.Errorf("authentication request expired")
+	}
+
+	holderDID := vp.Credential.String("credentialSubject.mandate.mandatee.id")
+	if err := verifyHolderBinding(vp.VPJWT, holderDID); err != nil {
+		return fmt.Errorf("presentation not signed by the holder: %w", err)
+	}
+
+	if exp, _ := vp.Claims.GetExpirationTime(); exp != nil && exp.After(expiration) {
+		expiration = exp.Time
+	}
+	ttl := expiration.Sub(now)
+
+	// The nonce must be the one we sent for this request
+	nonce, _ := vp.Claims["nonce"].(string)
+	if len(nonce) == 0 || len(authReq.WalletNonce) == 0 ||
+		subtle.ConstantTimeCompare([]byte(nonce), []byte(authReq.WalletNonce)) != 1 {
+		return fmt.Errorf("nonce does not match the authentication request")
+	}
+	if err := l.replay.Check("nonce", nonce, ttl); err != nil {
+		return fmt.Errorf("presentation nonce: %w", err)
+	}
+
+	if jti, _ := vp.Claims["jti"].(string); len(jti) > 0 {
+		if err := l.replay.Check("jti", jti, ttl); err != nil {
+			return fmt.Errorf("presentation jti: %w", err)
+		}
+	}
+
+	// The fingerprint of the whole presentation detects it being posted again, whatever its claims
+	fingerprint := sha256.Sum256([]byte(vp.VPJWT))
+	if err := l.replay.Check("vp", hex.EncodeToString(fingerprint[:]), ttl); err != nil {
+		return fmt.Errorf("presentation: %w", err)
+	}
+
+	return nil
+}
+
+// auditEvent logs a security relevant event with the logger of the request, so it can be correlated
+func auditEvent(r *http.Request, event string, args ...any) {
+	logger, ok := logging.FromContext(r.Context())
+	if !ok {
+		logger = slog.Default()
+	}
+	logger.WarnContext(r.Context(), "audit", append([]any{slog.String("event", event)}, args...)...)
+}
@@ -0,0 +1,139 @@
+package verifiernew
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/evidenceledger/vcdemo/internal/cache"
+	"github.com/evidenceledger/vcdemo/internal/did"
+	"github.com/evidenceledger/vcdemo/verifiernew/storage"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestCheckReplay(t *testing.T) {
+	holderPublic, holderKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	holderDID, err := did.DIDKeyFromPublicKey(holderPublic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, otherKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	credentialJWT := testCredentialJWT(t, holderDID)
+
+	now := time.Now()
+	first := &storage.InternalAuthRequest{ID: "first", CreationDate: now, WalletNonce: "first-nonce"}
+	second := &storage.InternalAuthRequest{ID: "second", CreationDate: now, WalletNonce: "second-nonce"}
+	expired := &storage.InternalAuthRequest{ID: "expired", CreationDate: now.Add(-storage.WalletAuthRequestLifetime - time.Minute), WalletNonce: "expired-nonce"}
+
+	firstVP := testPresentation(t, holderKey, holderDID, credentialJWT, jwt.MapClaims{"nonce": "first-nonce", "jti": "vp-1"})
+
+	// The steps run in order with the same replay cache
+	tests := []struct {
+		name    string
+		authReq *storage.InternalAuthRequest
+		vpJWT   string
+		wantErr string
+	}{
+		{
+			name:    "presentation signed by another key",
+			authReq: first,
+			vpJWT:   testPresentation(t, otherKey, holderDID, credentialJWT, jwt.MapClaims{"nonce": "first-nonce"}),
+			wantErr: "not signed by the holder",
+		},
+		{
+			name:    "missing nonce",
+			authReq: first,
+			vpJWT:   testPresentation(t, holderKey, holderDID, credentialJWT, jwt.MapClaims{}),
+			wantErr: "nonce does not match",
+		},
+		{
+			name:    "nonce of another request",
+			authReq: first,
+			vpJWT:   testPresentation(t, holderKey, holderDID, credentialJWT, jwt.MapClaims{"nonce": "second-nonce"}),
+			wantErr: "nonce does not match",
+		},
+		{
+			name:    "valid presentation",
+			authReq: first,
+			vpJWT:   firstVP,
+		},
+		{
+			name:    "the same presentation posted again",
+			authReq: first,
+			vpJWT:   firstVP,
+			wantErr: "presentation nonce",
+		},
+		{
+			name:    "the same presentation for another request",
+			authReq: second,
+			vpJWT:   firstVP,
+			wantErr: "nonce does not match",
+		},
+		{
+			name:    "jti already used with the nonce of another request",
+			authReq: second,
+			vpJWT:   testPresentation(t, holderKey, holderDID, credentialJWT, jwt.MapClaims{"nonce": "second-nonce", "jti": "vp-1"}),
+			wantErr: "presentation jti",
+		},
+		{
+			name:    "expired request",
+			authReq: expired,
+			vpJWT:   testPresentation(t, holderKey, holderDID, credentialJWT, jwt.MapClaims{"nonce": "expired-nonce"}),
+			wantErr: "request expired",
+		},
+	}
+
+	l := &login{replay: cache.NewReplayCache(time.Minute)}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vp, err := parsePresentation(tt.vpJWT, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = l.checkReplay(tt.authReq, vp)
+			if len(tt.wantErr) == 0 && err != nil || len(tt.wantErr) > 0 && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("checkReplay() error = %v, wantErr %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// testCredentialJWT returns a credential JWT for the holder. Its seal is not checked by checkReplay.
+func testCredentialJWT(t *testing.T, holderDID string) string {
+	credential := jwt.MapClaims{
+		"vc": map[string]any{
+			"credentialSubject": map[string]any{
+				"mandate": map[string]any{
+					"mandatee": map[string]any{"id": holderDID},
+				},
+			},
+		},
+	}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, credential).SignedString([]byte("not checked"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// testPresentation returns a VP JWT with the credential and the claims, signed with the key
+func testPresentation(t *testing.T, key ed25519.PrivateKey, holderDID string, credentialJWT string, claims jwt.MapClaims) string {
+	claims["iss"] = holderDID
+	claims["vp"] = map[string]any{
+		"type":                 []string{"VerifiablePresentation"},
+		"verifiableCredential": []string{credentialJWT},
+	}
+	vp, err := jwt.NewWithClaims(jwt.SigningMethodEdDSA, claims).SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return vp
+}
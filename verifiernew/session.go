@@ -0,0 +1,126 @@
+package verifiernew
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/evidenceledger/vcdemo/verifiernew/storage"
+	"github.com/foolin/goview"
+)
+
+// ssoSessionMiddleware passes the SSO session id received in the browser cookie to the handlers down the chain,
+// including the OpenID Provider, so the Storage can reuse the session for new authentication requests.
+// The request itself is also passed, because the policies evaluated before reusing a session receive it.
+func ssoSessionMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cookie, err := r.Cookie(storage.SessionCookieName)
+		if err == nil && len(cookie.Value) > 0 {
+			ctx := storage.ContextWithSessionID(r.Context(), cookie.Value)
+			r = r.WithContext(context.WithValue(ctx, sessionRequestKey{}, r))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+type sessionRequestKey struct{}
+
+// sessionPolicy evaluates the authentication policy of the Client with the credential of an SSO session, in the
+// same way as with a new presentation, so a session created for a Client is not reused for another one whose
+// policy would deny the credential. The obligations of the decision are returned to be applied to the request.
+func sessionPolicy(ctx context.Context, authReq *storage.InternalAuthRequest, session *storage.SSOSession) (map[string]any, []string, error) {
+	r, ok := ctx.Value(sessionRequestKey{}).(*http.Request)
+	if !ok {
+		return nil, nil, fmt.Errorf("no HTTP request for the session")
+	}
+
+	serialCredential, err := json.Marshal(session.Credential.Data())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	vp := &presentation{Format: formatJWTVPJSON, Credential: session.Credential, CredentialJWT: session.CredentialJWT}
+	input := newPolicyInput(authReq, vp)
+	decision, err := policies.For(authReq.ApplicationID, authReq.Scopes).TakeAuthnDecision(Authenticate, r, string(serialCredential), "", input)
+	if err != nil {
+		auditEvent(r, "sso_session_error", "session", session.ID, "client_id", authReq.ApplicationID, "error", err.Error())
+		return nil, nil, err
+	}
+	if !decision.Allow {
+		auditEvent(r, "sso_session_denied", "session", session.ID, "client_id", authReq.ApplicationID, "reasons", decision.Reasons)
+		return nil, nil, fmt.Errorf("the policy denied the credential of the session: %s", decision.Reason())
+	}
+
+	return decision.Obligations.Claims, decision.Obligations.DropScopes, nil
+}
+
+// setSessionCookie sets the cookie identifying the SSO session in the browser of the user
+func (l *login) setSessionCookie(w http.ResponseWriter, session *storage.SSOSession) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     storage.SessionCookieName,
+		Value:    session.ID,
+		Path:     "/",
+		Expires:  session.Expiration,
+		MaxAge:   int(time.Until(session.Expiration).Seconds()),
+		Secure:   strings.HasPrefix(l.cfg.VerifierURL, "https://"),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// clearSessionCookie removes the SSO session cookie from the browser
+func (l *login) clearSessionCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     storage.SessionCookieName,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		Secure:   strings.HasPrefix(l.cfg.VerifierURL, "https://"),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// displaySession renders a page where the user can see the current SSO session at the Verifier and end it
+func (l *login) displaySession(w http.ResponseWriter, r *http.Request) {
+
+	data := &struct {
+		Active       bool
+		UserID       string
+		Organization string
+		AuthTime     string
+		Expiration   string
+		Clients      []string
+	}{}
+
+	if cookie, err := r.Cookie(storage.SessionCookieName); err == nil {
+		if session, ok := l.authenticate.GetSSOSession(cookie.Value); ok {
+			data.Active = true
+			data.UserID = session.UserID
+			data.AuthTime = session.AuthTime.Format(time.RFC1123)
+			data.Expiration = session.Expiration.Format(time.RFC1123)
+			data.Clients = session.Clients
+			if session.Credential != nil {
+				data.Organization = session.Credential.String("credentialSubject.mandate.mandator.organization")
+			}
+		}
+	}
+
+	err := goview.Render(w, http.StatusOK, "session", data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// endSession terminates the SSO session of the browser, so the next login requires the Wallet again
+func (l *login) endSession(w http.ResponseWriter, r *http.Request) {
+	if cookie, err := r.Cookie(storage.SessionCookieName); err == nil {
+		l.authenticate.EndSSOSession(cookie.Value)
+	}
+	l.clearSessionCookie(w)
+
+	http.Redirect(w, r, "/login/session", http.StatusFound)
+}
@@ -0,0 +1,185 @@
+package verifiernew
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/evidenceledger/vcdemo/types"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/hesusruiz/vcutils/yaml"
+)
+
+// The status lists are cached for a few minutes, so a revocation is effective quickly
+const statusListCacheTTL = 5 * time.Minute
+
+// The maximum size of a status list credential, to protect against misbehaving servers
+const maxStatusListSize = 1 << 20
+
+// The status lists are retrieved only from the origins configured for their issuer, so redirects are not followed
+var statusListHTTPClient = &http.Client{
+	Timeout: 10 * time.Second,
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// statusListOrigins are the origins (scheme and host) where each issuer publishes its status lists, by the DID
+// of the issuer. The status lists of other issuers, or in other origins, are not retrieved.
+var statusListOrigins map[string][]string
+
+// statusList is a status list retrieved from an Issuer
+type statusList struct {
+	issuer    string
+	purpose   string
+	bitstring []byte
+	expires   time.Time
+}
+
+var statusListCache = struct {
+	mu    sync.Mutex
+	lists map[string]*statusList
+}{lists: map[string]*statusList{}}
+
+// credentialStatusEntries returns the entries of the 'credentialStatus' of the credential, which can be a single
+// entry or a list of entries
+func credentialStatusEntries(cred *yaml.YAML) []any {
+	entries := cred.List("credentialStatus")
+	if len(entries) == 0 {
+		if entry := cred.Map("credentialStatus"); len(entry) > 0 {
+			entries = []any{entry}
+		}
+	}
+	return entries
+}
+
+// credentialStatus checks the Bitstring Status List entries of the credential, returning "revoked" or "suspended"
+// if the bit of any of the entries is set, "valid" if none is set, "unknown" if the credential does not
+// have a status, and "unavailable" if it has a status which could not be checked
+func credentialStatus(cred *yaml.YAML, issuerDID string) string {
+
+	entries := credentialStatusEntries(cred)
+	if len(entries) == 0 {
+		return statusUnknown
+	}
+
+	status := statusValid
+	for _, e := range entries {
+		entry := yaml.New(e)
+		if entry.String("type") != "BitstringStatusListEntry" {
+			return statusUnavailable
+		}
+
+		purpose := entry.String("statusPurpose")
+		index, err := strconv.Atoi(entry.String("statusListIndex"))
+		if err != nil {
+			log.Println("invalid statusListIndex:", err)
+			return statusUnavailable
+		}
+
+		listURL := entry.String("statusListCredential")
+		if !statusListAllowed(issuerDID, listURL) {
+			log.Printf("status list %s is not in a known origin of %s", listURL, issuerDID)
+			return statusUnavailable
+		}
+
+		list, err := getStatusList(listURL)
+		if err != nil {
+			log.Println("retrieving status list:", err)
+			return statusUnavailable
+		}
+		if list.issuer != issuerDID || list.purpose != purpose {
+			log.Println("the status list is not of the issuer of the credential or has another purpose")
+			return statusUnavailable
+		}
+
+		set, err := types.StatusListBit(list.bitstring, index)
+		if err != nil {
+			log.Println(err)
+			return statusUnavailable
+		}
+		if set {
+			switch purpose {
+			case types.StatusPurposeRevocation:
+				return statusRevoked
+			case types.StatusPurposeSuspension:
+				status = statusSuspended
+			default:
+				return statusUnavailable
+			}
+		}
+	}
+
+	return status
+}
+
+// statusListAllowed reports if the status list is in one of the origins configured for the issuer
+func statusListAllowed(issuerDID string, listURL string) bool {
+	u, err := url.Parse(listURL)
+	if err != nil || u.User != nil || (u.Scheme != "https" && u.Scheme != "http") {
+		return false
+	}
+	return slices.Contains(statusListOrigins[issuerDID], u.Scheme+"://"+u.Host)
+}
+
+// getStatusList returns the status list in the URL, from the cache if it was retrieved recently.
+// The status list credential must be sealed in the same way as the credentials.
+func getStatusList(listURL string) (*statusList, error) {
+	statusListCache.mu.Lock()
+	list := statusListCache.lists[listURL]
+	statusListCache.mu.Unlock()
+	if list != nil && time.Now().Before(list.expires) {
+		return list, nil
+	}
+
+	resp, err := statusListHTTPClient.Get(listURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("retrieving %s: %s", listURL, resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxStatusListSize))
+	if err != nil {
+		return nil, err
+	}
+
+	// Check the seal, and then get the claims which have already been verified
+	_, issuerDID, err := sealCertificate(string(body))
+	if err != nil {
+		return nil, fmt.Errorf("status list %s: %w", listURL, err)
+	}
+	claims := jwt.MapClaims{}
+	if _, _, err := jwt.NewParser().ParseUnverified(string(body), claims); err != nil {
+		return nil, err
+	}
+	slc := yaml.New(map[string]any(claims))
+
+	if slc.String("id") != listURL {
+		return nil, fmt.Errorf("status list %s has a different id: %s", listURL, slc.String("id"))
+	}
+	bitstring, err := types.DecodeStatusList(slc.String("credentialSubject.encodedList"))
+	if err != nil {
+		return nil, err
+	}
+
+	list = &statusList{
+		issuer:    issuerDID,
+		purpose:   slc.String("credentialSubject.statusPurpose"),
+		bitstring: bitstring,
+		expires:   time.Now().Add(statusListCacheTTL),
+	}
+
+	statusListCache.mu.Lock()
+	statusListCache.lists[listURL] = list
+	statusListCache.mu.Unlock()
+
+	return list, nil
+}
@@ -0,0 +1,105 @@
+package storage
+
+import (
+	"slices"
+)
+
+// ACRProfile defines the requirements that the credential presented by the Wallet must satisfy to achieve
+// a given Authentication Context Class Reference. The Client selects the profile with the 'acr_values' parameter
+// of the authentication request, and the achieved one is set in the 'acr' claim of the ID token.
+type ACRProfile struct {
+	// Name is the value used in 'acr_values' and in the 'acr' claim
+	Name string `json:"name,omitempty"`
+
+	// Level orders the profiles, so a session authenticated with a higher level satisfies requests for lower ones
+	Level int `json:"level,omitempty"`
+
+	// CredentialTypes is the list of accepted credential types. The credential must include at least one of them.
+	CredentialTypes []string `json:"credentialTypes,omitempty"`
+
+	// QualifiedSeal requires the credential to be signed with a qualified eIDAS certificate included in the 'x5c' header,
+	// issued by one of the trust anchors of the Verifier
+	QualifiedSeal bool `json:"qualifiedSeal,omitempty"`
+
+	// HolderBinding requires the presentation to be signed by the key of the DID of the mandatee in the credential
+	HolderBinding bool `json:"holderBinding,omitempty"`
+}
+
+// DefaultACRProfiles are used when the configuration does not specify any
+var DefaultACRProfiles = []ACRProfile{
+	{
+		Name:            "basic",
+		Level:           1,
+		CredentialTypes: []string{"LEARCredentialEmployee"},
+	},
+	{
+		Name:            "qualified",
+		Level:           2,
+		CredentialTypes: []string{"LEARCredentialEmployee"},
+		QualifiedSeal:   true,
+		HolderBinding:   true,
+	},
+}
+
+// SetACRProfiles sets the profiles that Clients can request with 'acr_values'.
+// The first profile is used when the Client does not request any known profile.
+func (s *Storage) SetACRProfiles(profiles []ACRProfile) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if len(profiles) == 0 {
+		profiles = DefaultACRProfiles
+	}
+	s.acrProfiles = profiles
+}
+
+// ACRProfile returns the profile with the given name, if configured
+func (s *Storage) ACRProfile(name string) (*ACRProfile, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.findACRProfile(name)
+}
+
+// ACRValuesSupported returns the names of the configured profiles, in order of preference
+func (s *Storage) ACRValuesSupported() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var names []string
+	for _, p := range s.acrProfiles {
+		names = append(names, p.Name)
+	}
+	return names
+}
+
+// findACRProfile must be called with the lock held
+func (s *Storage) findACRProfile(name string) (*ACRProfile, bool) {
+	for i := range s.acrProfiles {
+		if s.acrProfiles[i].Name == name {
+			return &s.acrProfiles[i], true
+		}
+	}
+	return nil, false
+}
+
+// selectACRProfile returns the first profile in the 'acr_values' of the Client that is configured,
+// or the default one if none is. It must be called with the lock held.
+func (s *Storage) selectACRProfile(acrValues []string) *ACRProfile {
+	for _, acr := range acrValues {
+		if p, ok := s.findACRProfile(acr); ok {
+			return p
+		}
+	}
+	return &s.acrProfiles[0]
+}
+
+// Accepts returns true if the list of credential types includes one accepted by the profile
+func (p *ACRProfile) Accepts(credentialTypes []string) bool {
+	if len(p.CredentialTypes) == 0 {
+		return true
+	}
+	for _, t := range credentialTypes {
+		if slices.Contains(p.CredentialTypes, t) {
+			return true
+		}
+	}
+	return false
+}
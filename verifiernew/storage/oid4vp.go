@@ -7,11 +7,16 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"io"
+	"strings"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 )
 
+// WalletAuthRequestLifetime is the time the Wallet has to send the Authentication Response.
+// It also determines how long the values used in a presentation are remembered to detect replays.
+const WalletAuthRequestLifetime = 10 * time.Minute
+
 type OID4VPAuthRequest struct {
 	jwt.RegisteredClaims
 	Scope          string `json:"scope,omitempty"`
@@ -31,30 +36,35 @@ func (o *OID4VPAuthRequest) String() string {
 
 // createJWTSecuredAuthenticationRequest creates an Authorization Request Object according to:
 // "IETF RFC 9101: The OAuth 2.0 Authorization Framework: JWT-Secured Authorization Request (JAR)""
-func createJWTSecuredAuthenticationRequest(response_uri string, state string) (string, error) {
+// It returns the signed request and the nonce that the Wallet must include in the presentation.
+func createJWTSecuredAuthenticationRequest(response_uri string, state string, credentialTypes []string) (string, string, error) {
 
-	// This specifies the type of credential that the Verifier will accept
-	// TODO: In this use case it is hardcoded, which is enough if the Verifier is simple and uses
-	// only one type of credential for authenticating its users.
+	// This specifies the type of credential that the Verifier will accept, as required by the ACR profile
+	scope := "LEARCredentialEmployee"
+	if len(credentialTypes) > 0 {
+		scope = strings.Join(credentialTypes, " ")
+	}
 
 	verifierDID := "did:elsi:VATES:55555555"
 
 	// Prepare some fields of the LEARCredential
 	now := time.Now()
 
+	nonce := GenerateNonce()
+
 	// Create claims with multiple fields populated
 	claims := OID4VPAuthRequest{
-		Scope:          "LEARCredentialEmployee",
+		Scope:          scope,
 		ResponseType:   "vp_token",
 		ResponseMode:   "direct_post",
 		ClientId:       verifierDID,
 		ClientIdScheme: "did",
 		ResponseUri:    response_uri,
 		State:          state,
-		Nonce:          GenerateNonce(),
+		Nonce:          nonce,
 	}
 
-	claims.ExpiresAt = jwt.NewNumericDate(now.Add(24 * 365 * time.Hour))
+	claims.ExpiresAt = jwt.NewNumericDate(now.Add(WalletAuthRequestLifetime))
 	claims.IssuedAt = jwt.NewNumericDate(now)
 	claims.NotBefore = jwt.NewNumericDate(now)
 	claims.Issuer = verifierDID
@@ -65,11 +75,15 @@ func createJWTSecuredAuthenticationRequest(response_uri string, state string) (s
 	// Generate a raw EC key with the P-256 curve
 	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
 	if err != nil {
-		return "", err
+		return "", "", err
 	}
 
 	token := jwt.NewWithClaims(jwt.SigningMethodES256, claims)
-	return token.SignedString(privateKey)
+	signed, err := token.SignedString(privateKey)
+	if err != nil {
+		return "", "", err
+	}
+	return signed, nonce, nil
 
 }
 
@@ -6,6 +6,7 @@ import (
 
 	"golang.org/x/text/language"
 
+	"github.com/hesusruiz/vcutils/yaml"
 	"github.com/zitadel/oidc/v3/pkg/oidc"
 	"github.com/zitadel/oidc/v3/pkg/op"
 )
@@ -39,9 +40,24 @@ type InternalAuthRequest struct {
 	Nonce             string
 	CodeChallenge     *OIDCCodeChallenge
 	WalletAuthRequest string
+	WalletNonce       string
+	SameDevice        bool
+	ResponseCode      string
+	SessionID         string
+	ACRValues         []string
+	RequestedACR      string
+	PolicyClaims      map[string]any
+	DeniedReasons     []string
 
 	done     bool
+	denied   bool
 	authTime time.Time
+	acr      string
+	amr      []string
+
+	// credential is the credential presented by the Wallet, or the one of the SSO session reused
+	credential    *yaml.YAML
+	credentialJWT string
 }
 
 // LogValue allows you to define which fields will be logged.
@@ -55,21 +71,28 @@ func (a *InternalAuthRequest) LogValue() slog.Value {
 		slog.String("app_id", a.ApplicationID),
 		slog.String("callback_uri", a.CallbackURI),
 		slog.String("wallet_authrequest", a.WalletAuthRequest),
+		slog.String("requested_acr", a.RequestedACR),
 	)
 }
 
+// WalletRequestExpiration returns the time after which the Wallet can not answer the request anymore
+func (a *InternalAuthRequest) WalletRequestExpiration() time.Time {
+	return a.CreationDate.Add(WalletAuthRequestLifetime)
+}
+
 func (a *InternalAuthRequest) GetID() string {
 	return a.ID
 }
 
+// GetACR returns the Authentication Context Class Reference achieved with the credential presented
 func (a *InternalAuthRequest) GetACR() string {
-	return "" // we won't handle acr in this example
+	return a.acr
 }
 
+// GetAMR returns the authentication methods used, depending on the checks performed on the presentation
 func (a *InternalAuthRequest) GetAMR() []string {
-	// We use proof of possesion of a key, embedded in the LEARCredential
 	if a.done {
-		return []string{"vc", "pop"}
+		return a.amr
 	}
 	return nil
 }
@@ -126,8 +149,18 @@ func (a *InternalAuthRequest) Done() bool {
 	return a.done
 }
 
+// HasPrompt returns true if the Client specified the given value in the 'prompt' parameter
+func (a *InternalAuthRequest) HasPrompt(prompt string) bool {
+	for _, p := range a.Prompt {
+		if p == prompt {
+			return true
+		}
+	}
+	return false
+}
+
 func PromptToInternal(oidcPrompt oidc.SpaceDelimitedArray) []string {
-	prompts := make([]string, len(oidcPrompt))
+	prompts := make([]string, 0, len(oidcPrompt))
 	for _, oidcPrompt := range oidcPrompt {
 		switch oidcPrompt {
 		case oidc.PromptNone,
@@ -163,6 +196,7 @@ func authRequestToInternal(authReq *oidc.AuthRequest, userID string) *InternalAu
 		ResponseType:  authReq.ResponseType,
 		ResponseMode:  authReq.ResponseMode,
 		Nonce:         authReq.Nonce,
+		ACRValues:     authReq.ACRValues,
 		CodeChallenge: &OIDCCodeChallenge{
 			Challenge: authReq.CodeChallenge,
 			Method:    string(authReq.CodeChallengeMethod),
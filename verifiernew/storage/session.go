@@ -0,0 +1,190 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/hesusruiz/vcutils/yaml"
+	"github.com/zitadel/oidc/v3/pkg/oidc"
+)
+
+const (
+	// SessionCookieName is the name of the cookie set in the browser of the user when an SSO session is created
+	SessionCookieName = "vcverifier_session"
+
+	// DefaultSessionMaxAge is the lifetime of an SSO session if not configured otherwise
+	DefaultSessionMaxAge = 8 * time.Hour
+)
+
+// SSOSession is a browser session at the Verifier, created after a successful presentation of a LEARCredential.
+// Later authentication requests coming from the same browser (possibly from other clients) can reuse it
+// instead of asking the Wallet for a new presentation.
+type SSOSession struct {
+	ID         string
+	UserID     string
+	Credential *yaml.YAML
+	AuthTime   time.Time
+	ACR        string
+	AMR        []string
+	Expiration time.Time
+	Clients    []string
+
+	// CredentialJWT is the credential as presented by the Wallet, so the seal and status of the Issuer
+	// can be checked again when the session is reused
+	CredentialJWT string
+}
+
+func (s *SSOSession) Expired() bool {
+	return time.Now().After(s.Expiration)
+}
+
+type sessionIDKey struct{}
+
+// ContextWithSessionID returns a copy of the context carrying the SSO session id received in the browser cookie.
+// It is used by the HTTP middleware so that CreateAuthRequest can find the session of the caller.
+func ContextWithSessionID(ctx context.Context, sessionID string) context.Context {
+	return context.WithValue(ctx, sessionIDKey{}, sessionID)
+}
+
+func sessionIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(sessionIDKey{}).(string)
+	return id
+}
+
+// SessionPolicy decides if the credential of an SSO session is acceptable for a new AuthRequest, possibly from
+// another client or with other scopes. It returns an error if the request can not be satisfied with the session,
+// or the obligations of the decision to apply to the request, as in ApplyPolicyObligations.
+type SessionPolicy func(ctx context.Context, authReq *InternalAuthRequest, session *SSOSession) (claims map[string]any, dropScopes []string, err error)
+
+// SetSessionPolicy sets the policy evaluated before reusing an SSO session. Without a policy, sessions are not reused.
+func (s *Storage) SetSessionPolicy(policy SessionPolicy) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.sessionPolicy = policy
+}
+
+// SetSessionMaxAge sets the lifetime of the SSO sessions created from now on
+func (s *Storage) SetSessionMaxAge(maxAge time.Duration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.sessionMaxAge = maxAge
+}
+
+// SessionMaxAge returns the configured lifetime of SSO sessions
+func (s *Storage) SessionMaxAge() time.Duration {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.sessionMaxAge
+}
+
+// CreateSSOSession creates a new SSO session from a completed AuthRequest.
+// If the AuthRequest was itself satisfied by an existing session, that session is returned instead.
+func (s *Storage) CreateSSOSession(authReqID string) (*SSOSession, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	request, ok := s.internalAuthRequests[authReqID]
+	if !ok {
+		return nil, fmt.Errorf("request not found")
+	}
+	if !request.done {
+		return nil, fmt.Errorf("request not completed")
+	}
+
+	// The request reused a session, so there is nothing new to create
+	if session, ok := s.sessions[request.SessionID]; ok && !session.Expired() {
+		return session, nil
+	}
+
+	if request.credential == nil {
+		return nil, fmt.Errorf("no credential for the request")
+	}
+
+	session := &SSOSession{
+		ID:         uuid.NewString(),
+		UserID:     request.UserID,
+		Credential: request.credential,
+		AuthTime:   request.authTime,
+		ACR:        request.acr,
+		AMR:        request.amr,
+		Expiration: request.authTime.Add(s.sessionMaxAge),
+		Clients:    []string{request.ApplicationID},
+
+		CredentialJWT: request.credentialJWT,
+	}
+	s.sessions[session.ID] = session
+	request.SessionID = session.ID
+
+	return session, nil
+}
+
+// GetSSOSession returns the session with the given id, if it exists and has not expired
+func (s *Storage) GetSSOSession(id string) (*SSOSession, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.getSession(id)
+}
+
+// EndSSOSession removes the session, so the next authentication requires a new presentation from the Wallet
+func (s *Storage) EndSSOSession(id string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.sessions, id)
+}
+
+// getSession must be called with the lock held
+func (s *Storage) getSession(id string) (*SSOSession, bool) {
+	if len(id) == 0 {
+		return nil, false
+	}
+	session, ok := s.sessions[id]
+	if !ok {
+		return nil, false
+	}
+	if session.Expired() {
+		delete(s.sessions, id)
+		return nil, false
+	}
+	return session, true
+}
+
+// reusableSession returns the SSO session of the browser sending the request, if it can satisfy the AuthRequest
+// according to the 'prompt', 'max_age' and 'acr_values' parameters. It must be called with the lock held.
+func (s *Storage) reusableSession(ctx context.Context, authReq *InternalAuthRequest) *SSOSession {
+
+	// With prompt=login the Client wants the user to present the credential again
+	if authReq.HasPrompt(oidc.PromptLogin) {
+		return nil
+	}
+
+	if s.sessionPolicy == nil {
+		return nil
+	}
+
+	session, ok := s.getSession(sessionIDFromContext(ctx))
+	if !ok {
+		return nil
+	}
+
+	// If an id_token_hint was received, the session must belong to the same user
+	if len(authReq.UserID) > 0 && authReq.UserID != session.UserID {
+		return nil
+	}
+
+	// The Client may require that authentication happened recently
+	if authReq.MaxAuthAge != nil && time.Since(session.AuthTime) > *authReq.MaxAuthAge {
+		return nil
+	}
+
+	// The session must have been established with an assurance level at least as high as the requested one,
+	// otherwise the user has to step up presenting the credential again.
+	requested, _ := s.findACRProfile(authReq.RequestedACR)
+	achieved, ok := s.findACRProfile(session.ACR)
+	if requested != nil && (!ok || achieved.Level < requested.Level) {
+		return nil
+	}
+
+	return session
+}
@@ -4,9 +4,11 @@ import (
 	"context"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/subtle"
 	"errors"
 	"fmt"
 	"math/big"
+	"slices"
 	"strings"
 	"sync"
 	"time"
@@ -52,6 +54,10 @@ type Storage struct {
 	userCodes            map[string]string
 	serviceUsers         map[string]*Client
 	verifierURL          string
+	sessions             map[string]*SSOSession
+	sessionMaxAge        time.Duration
+	sessionPolicy        SessionPolicy
+	acrProfiles          []ACRProfile
 }
 
 type signingKey struct {
@@ -129,22 +135,16 @@ func NewStorageWithClients(verifierUrl string, userStore UserStore, clients map[
 				accessTokenType: op.AccessTokenTypeBearer,
 			},
 		},
-		verifierURL: verifierUrl,
+		verifierURL:   verifierUrl,
+		sessions:      make(map[string]*SSOSession),
+		sessionMaxAge: DefaultSessionMaxAge,
+		acrProfiles:   DefaultACRProfiles,
 	}
 }
 
 // CreateAuthRequest implements the op.Storage interface
 // it will be called after parsing and validation of the authentication request
 func (s *Storage) CreateAuthRequest(ctx context.Context, authReq *oidc.AuthRequest, userID string) (op.AuthRequest, error) {
-	s.lock.Lock()
-	defer s.lock.Unlock()
-
-	if len(authReq.Prompt) == 1 && authReq.Prompt[0] == "none" {
-		// With prompt=none, there is no way for the user to log in
-		// so return error right away.
-		return nil, oidc.ErrLoginRequired()
-	}
-
 	// Convert to our internal model and save it in memory.
 	// AuthRequests are ephemeral and we only have one server for authentication.
 	internalAuthRequest := authRequestToInternal(authReq, userID)
@@ -152,6 +152,65 @@ func (s *Storage) CreateAuthRequest(ctx context.Context, authReq *oidc.AuthReque
 	// Every AuthRequest is assigned a unique ID so they can be referenced later
 	internalAuthRequest.ID = uuid.NewString()
 
+	s.lock.Lock()
+
+	// The Client selects with 'acr_values' the requirements that the credential presented must satisfy
+	acrProfile := s.selectACRProfile(internalAuthRequest.ACRValues)
+	internalAuthRequest.RequestedACR = acrProfile.Name
+
+	session := s.reusableSession(ctx, internalAuthRequest)
+	policy := s.sessionPolicy
+	s.lock.Unlock()
+
+	// If the browser has an SSO session at the Verifier which satisfies the request, we reuse it
+	// and the user does not have to present the credential again with the Wallet.
+	// The policy of the Client must accept the credential of the session, otherwise the user is asked for a new
+	// presentation. It is evaluated without the lock, because it may retrieve the status of the credential.
+	var claims map[string]any
+	var dropScopes []string
+	if session != nil {
+		var err error
+		claims, dropScopes, err = policy(ctx, internalAuthRequest, session)
+		if err != nil {
+			session = nil
+		}
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	// The session may have been ended while the policy was evaluated
+	if session != nil {
+		if _, ok := s.getSession(session.ID); !ok {
+			session = nil
+		}
+	}
+
+	if session != nil {
+		internalAuthRequest.UserID = session.UserID
+		internalAuthRequest.SessionID = session.ID
+		internalAuthRequest.authTime = session.AuthTime
+		internalAuthRequest.acr = session.ACR
+		internalAuthRequest.amr = session.AMR
+		internalAuthRequest.credential = session.Credential
+		internalAuthRequest.credentialJWT = session.CredentialJWT
+		internalAuthRequest.done = true
+		internalAuthRequest.applyPolicyObligations(claims, dropScopes)
+
+		if !slices.Contains(session.Clients, internalAuthRequest.ApplicationID) {
+			session.Clients = append(session.Clients, internalAuthRequest.ApplicationID)
+		}
+
+		s.internalAuthRequests[internalAuthRequest.ID] = internalAuthRequest
+		return internalAuthRequest, nil
+	}
+
+	if internalAuthRequest.HasPrompt(oidc.PromptNone) {
+		// With prompt=none and no valid session, there is no way for the user to log in
+		// so return error right away.
+		return nil, oidc.ErrLoginRequired()
+	}
+
 	// Now, we should request from the Wallet the LEARCredential. We use the OID4VP protocol for that.
 	// We create another related but different AuthRequest for sending the request to the Wallet.
 	// It is important to note that the Verifier is acting as a standard OpenID Provider for the Application/Client,
@@ -164,11 +223,12 @@ func (s *Storage) CreateAuthRequest(ctx context.Context, authReq *oidc.AuthReque
 
 	// The new AuthRequest for the Wallet contains the ID of the AuthRequest received from the Application.
 	// When the Wallet sends the AuthReponse, we will be able to match the Wallet response with the Application request.
-	walletAuthRequest, err := createJWTSecuredAuthenticationRequest(response_uri, internalAuthRequest.ID)
+	walletAuthRequest, walletNonce, err := createJWTSecuredAuthenticationRequest(response_uri, internalAuthRequest.ID, acrProfile.CredentialTypes)
 	if err != nil {
 		return nil, err
 	}
 	internalAuthRequest.WalletAuthRequest = walletAuthRequest
+	internalAuthRequest.WalletNonce = walletNonce
 
 	// And save it in the in-memory database. We do not need to persist this.
 	// There is a single server and if the server fails, all auth requets in flight will need to be restarted.
@@ -201,7 +261,9 @@ func (s *Storage) GetWalletAuthRequestByID(id string) (*InternalAuthRequest, err
 	return request, nil
 }
 
-func (s *Storage) SaveWalletAuthenticationResponse(id string, cred *yaml.YAML) error {
+// SaveWalletAuthenticationResponse updates the AuthRequest with the credential presented by the Wallet and the
+// ACR and AMR achieved, and marks it as completed.
+func (s *Storage) SaveWalletAuthenticationResponse(id string, cred *yaml.YAML, credentialJWT string, acr string, amr []string) error {
 	s.lock.Lock()
 	defer s.lock.Unlock()
 	clientRequest, ok := s.internalAuthRequests[id]
@@ -214,6 +276,11 @@ func (s *Storage) SaveWalletAuthenticationResponse(id string, cred *yaml.YAML) e
 	mandateeEmail := cred.String("credentialSubject.mandate.mandatee.email")
 
 	clientRequest.UserID = mandateeEmail
+	clientRequest.authTime = time.Now()
+	clientRequest.acr = acr
+	clientRequest.amr = amr
+	clientRequest.credential = cred
+	clientRequest.credentialJWT = credentialJWT
 	s.userStore.AddUserFromLEARCredential(cred)
 
 	// Mark the AuthRequest as completed, so the frontend of the Verifier can stop polling and continue the process.
@@ -221,6 +288,53 @@ func (s *Storage) SaveWalletAuthenticationResponse(id string, cred *yaml.YAML) e
 	return nil
 }
 
+// ApplyPolicyObligations records the obligations of the policy decision taken for the AuthRequest:
+// the claims are added to the ID token and the scopes are removed from the ones requested by the Client.
+// The 'openid' scope can not be dropped.
+func (s *Storage) ApplyPolicyObligations(id string, claims map[string]any, dropScopes []string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	request, ok := s.internalAuthRequests[id]
+	if !ok {
+		return fmt.Errorf("request not found")
+	}
+
+	request.applyPolicyObligations(claims, dropScopes)
+	return nil
+}
+
+// applyPolicyObligations sets the claims for the ID token and removes the dropped scopes, except 'openid'
+func (a *InternalAuthRequest) applyPolicyObligations(claims map[string]any, dropScopes []string) {
+	a.PolicyClaims = claims
+	a.Scopes = slices.DeleteFunc(a.Scopes, func(scope string) bool {
+		return scope != oidc.ScopeOpenID && slices.Contains(dropScopes, scope)
+	})
+}
+
+// SaveWalletAuthenticationDenial marks the AuthRequest as denied, so the login page can tell the user why
+func (s *Storage) SaveWalletAuthenticationDenial(id string, reasons []string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	request, ok := s.internalAuthRequests[id]
+	if !ok {
+		return fmt.Errorf("request not found")
+	}
+	request.denied = true
+	request.DeniedReasons = reasons
+	return nil
+}
+
+// CheckLoginDenied returns true and the reasons if the authentication was denied
+func (s *Storage) CheckLoginDenied(id string) ([]string, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	request, ok := s.internalAuthRequests[id]
+	if !ok {
+		return nil, false
+	}
+	return request.DeniedReasons, request.denied
+}
+
 func (s *Storage) CheckLoginDone(id string) bool {
 	s.lock.Lock()
 	defer s.lock.Unlock()
@@ -231,6 +345,47 @@ func (s *Storage) CheckLoginDone(id string) bool {
 	return request.done
 }
 
+// SetSameDevice records that the Wallet retrieved the request from the same device as the browser of the user,
+// so the Authentication Response can redirect the browser instead of waiting for it to poll.
+func (s *Storage) SetSameDevice(id string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	request, ok := s.internalAuthRequests[id]
+	if !ok {
+		return fmt.Errorf("request not found")
+	}
+	request.SameDevice = true
+	return nil
+}
+
+// CreateResponseCode generates the code included in the 'redirect_uri' sent to the Wallet in same-device flows.
+// The browser presents it back to prove that it is the one which received the response from the Wallet.
+func (s *Storage) CreateResponseCode(id string) (string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	request, ok := s.internalAuthRequests[id]
+	if !ok {
+		return "", fmt.Errorf("request not found")
+	}
+	if !request.done {
+		return "", fmt.Errorf("request not completed")
+	}
+	request.ResponseCode = GenerateNonce()
+	return request.ResponseCode, nil
+}
+
+// UseResponseCode checks the response code presented by the browser. The code can be used only once.
+func (s *Storage) UseResponseCode(id string, code string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	request, ok := s.internalAuthRequests[id]
+	if !ok || len(request.ResponseCode) == 0 || subtle.ConstantTimeCompare([]byte(request.ResponseCode), []byte(code)) != 1 {
+		return false
+	}
+	request.ResponseCode = ""
+	return request.done
+}
+
 // AuthRequestByCode implements the op.Storage interface
 // it will be called after parsing and validation of the token request (in an authorization code flow)
 func (s *Storage) AuthRequestByCode(ctx context.Context, code string) (op.AuthRequest, error) {
@@ -280,21 +435,41 @@ func (s *Storage) DeleteAuthRequest(ctx context.Context, id string) error {
 // it will be called for all requests able to return an access token (Authorization Code Flow, Implicit Flow, JWT Profile, ...)
 func (s *Storage) CreateAccessToken(ctx context.Context, request op.TokenRequest) (string, time.Time, error) {
 	var applicationID string
+	var credential *yaml.YAML
+	var credentialJWT string
 	switch req := request.(type) {
 	case *InternalAuthRequest:
 		// if authenticated for an app (auth code / implicit flow) we must save the client_id to the token
 		applicationID = req.ApplicationID
+		credential, credentialJWT = req.credential, req.credentialJWT
 	case op.TokenExchangeRequest:
 		applicationID = req.GetClientID()
+		credential, credentialJWT = s.subjectTokenCredential(req)
 	}
 
-	token, err := s.accessToken(applicationID, "", request.GetSubject(), request.GetAudience(), request.GetScopes())
+	token, err := s.accessToken(applicationID, "", request.GetSubject(), request.GetAudience(), request.GetScopes(), credential, credentialJWT)
 	if err != nil {
 		return "", time.Time{}, err
 	}
 	return token.ID, token.Expiration, nil
 }
 
+// AccessTokenCredential returns the access token with the given ID and the credential presented by its subject
+// when the token was obtained, even if the subject has authenticated later with another one. The JWT of the credential
+// is in the CredentialJWT of the token. The token must belong to the subject and must not be expired.
+func (s *Storage) AccessTokenCredential(tokenID string, subject string) (*Token, *yaml.YAML, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	token, ok := s.tokens[tokenID]
+	if !ok || token.Subject != subject || time.Now().After(token.Expiration) {
+		return nil, nil, fmt.Errorf("token is invalid or has expired")
+	}
+	if token.Credential == nil {
+		return nil, nil, fmt.Errorf("no credential found for the subject of the token")
+	}
+	return token, token.Credential, nil
+}
+
 // CreateAccessAndRefreshTokens implements the op.Storage interface
 // it will be called for all requests able to return an access and refresh token (Authorization Code Flow, Refresh Token Request)
 func (s *Storage) CreateAccessAndRefreshTokens(ctx context.Context, request op.TokenRequest, currentRefreshToken string) (accessTokenID string, newRefreshToken string, expiration time.Time, err error) {
@@ -305,11 +480,12 @@ func (s *Storage) CreateAccessAndRefreshTokens(ctx context.Context, request op.T
 
 	// get the information depending on the request type / implementation
 	applicationID, authTime, amr := getInfoFromRequest(request)
+	credential, credentialJWT := credentialFromRequest(request)
 
 	// if currentRefreshToken is empty (Code Flow) we will have to create a new refresh token
 	if currentRefreshToken == "" {
 		refreshTokenID := uuid.NewString()
-		accessToken, err := s.accessToken(applicationID, refreshTokenID, request.GetSubject(), request.GetAudience(), request.GetScopes())
+		accessToken, err := s.accessToken(applicationID, refreshTokenID, request.GetSubject(), request.GetAudience(), request.GetScopes(), credential, credentialJWT)
 		if err != nil {
 			return "", "", time.Time{}, err
 		}
@@ -326,7 +502,7 @@ func (s *Storage) CreateAccessAndRefreshTokens(ctx context.Context, request op.T
 	if err != nil {
 		return "", "", time.Time{}, err
 	}
-	accessToken, err := s.accessToken(applicationID, refreshTokenID, request.GetSubject(), request.GetAudience(), request.GetScopes())
+	accessToken, err := s.accessToken(applicationID, refreshTokenID, request.GetSubject(), request.GetAudience(), request.GetScopes(), credential, credentialJWT)
 	if err != nil {
 		return "", "", time.Time{}, err
 	}
@@ -337,8 +513,11 @@ func (s *Storage) exchangeRefreshToken(ctx context.Context, request op.TokenExch
 	applicationID := request.GetClientID()
 	authTime := request.GetAuthTime()
 
+	// The new tokens carry the credential presented to obtain the subject token
+	credential, credentialJWT := s.subjectTokenCredential(request)
+
 	refreshTokenID := uuid.NewString()
-	accessToken, err := s.accessToken(applicationID, refreshTokenID, request.GetSubject(), request.GetAudience(), request.GetScopes())
+	accessToken, err := s.accessToken(applicationID, refreshTokenID, request.GetSubject(), request.GetAudience(), request.GetScopes(), credential, credentialJWT)
 	if err != nil {
 		return "", "", time.Time{}, err
 	}
@@ -374,6 +553,13 @@ func (s *Storage) TerminateSession(ctx context.Context, userID string, clientID
 			delete(s.refreshTokens, token.RefreshTokenID)
 		}
 	}
+
+	// Signing out from a Client also ends the SSO sessions of the user at the Verifier
+	for id, session := range s.sessions {
+		if session.UserID == userID {
+			delete(s.sessions, id)
+		}
+	}
 	return nil
 }
 
@@ -488,7 +674,20 @@ func (s *Storage) SetUserinfoFromScopes(ctx context.Context, userinfo *oidc.User
 // It will be called for the creation of an id_token, so we'll just pass it to the private function without any further check
 func (s *Storage) SetUserinfoFromRequest(ctx context.Context, userinfo *oidc.UserInfo, token op.IDTokenRequest, scopes []string) error {
 	fmt.Println("========= SetUserinfoFromRequest", token.GetSubject())
-	return s.setUserinfo(ctx, userinfo, token.GetSubject(), token.GetClientID(), scopes)
+	err := s.setUserinfo(ctx, userinfo, token.GetSubject(), token.GetClientID(), scopes)
+	if err != nil {
+		return err
+	}
+
+	// Add the claims required by the obligations of the policy decision taken during authentication
+	if request, ok := token.(*InternalAuthRequest); ok {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		for name, value := range request.PolicyClaims {
+			userinfo.AppendClaims(name, value)
+		}
+	}
+	return nil
 }
 
 // SetUserinfoFromToken implements the op.Storage interface
@@ -628,6 +827,8 @@ func (s *Storage) createRefreshToken(accessToken *Token, amr []string, authTime
 		Audience:      accessToken.Audience,
 		Expiration:    time.Now().Add(5 * time.Hour),
 		Scopes:        accessToken.Scopes,
+		Credential:    accessToken.Credential,
+		CredentialJWT: accessToken.CredentialJWT,
 	}
 	s.refreshTokens[token.ID] = token
 	return token.Token, nil
@@ -658,7 +859,7 @@ func (s *Storage) renewRefreshToken(currentRefreshToken string) (string, string,
 }
 
 // accessToken will store an access_token in-memory based on the provided information
-func (s *Storage) accessToken(applicationID, refreshTokenID, subject string, audience, scopes []string) (*Token, error) {
+func (s *Storage) accessToken(applicationID, refreshTokenID, subject string, audience, scopes []string, credential *yaml.YAML, credentialJWT string) (*Token, error) {
 	s.lock.Lock()
 	defer s.lock.Unlock()
 	token := &Token{
@@ -669,6 +870,8 @@ func (s *Storage) accessToken(applicationID, refreshTokenID, subject string, aud
 		Audience:       audience,
 		Expiration:     time.Now().Add(5 * time.Minute),
 		Scopes:         scopes,
+		Credential:     credential,
+		CredentialJWT:  credentialJWT,
 	}
 	s.tokens[token.ID] = token
 	return token, nil
@@ -817,6 +1020,36 @@ func getInfoFromRequest(req op.TokenRequest) (clientID string, authTime time.Tim
 	return "", time.Time{}, nil
 }
 
+// credentialFromRequest returns the credential presented to authenticate and its JWT, for the Code Flow and
+// Refresh Token Requests
+func credentialFromRequest(req op.TokenRequest) (*yaml.YAML, string) {
+	switch r := req.(type) {
+	case *InternalAuthRequest:
+		return r.credential, r.credentialJWT
+	case *RefreshTokenRequest:
+		return r.Credential, r.CredentialJWT
+	}
+	return nil, ""
+}
+
+// subjectTokenCredential returns the credential of the access or refresh token exchanged in a Token Exchange Request.
+// The credential of other tokens is not known, and the tokens obtained with them can not be used with the PEP.
+func (s *Storage) subjectTokenCredential(req op.TokenExchangeRequest) (*yaml.YAML, string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	switch req.GetExchangeSubjectTokenType() {
+	case oidc.AccessTokenType:
+		if token, ok := s.tokens[req.GetExchangeSubjectTokenIDOrToken()]; ok && token.Subject == req.GetExchangeSubject() {
+			return token.Credential, token.CredentialJWT
+		}
+	case oidc.RefreshTokenType:
+		if token, ok := s.refreshTokens[req.GetExchangeSubjectTokenIDOrToken()]; ok && token.UserID == req.GetExchangeSubject() {
+			return token.Credential, token.CredentialJWT
+		}
+	}
+	return nil, ""
+}
+
 func appendClaim(claims map[string]any, claim string, value any) map[string]any {
 	if claims == nil {
 		claims = make(map[string]any)
@@ -1,6 +1,10 @@
 package storage
 
-import "time"
+import (
+	"time"
+
+	"github.com/hesusruiz/vcutils/yaml"
+)
 
 type Token struct {
 	ID             string
@@ -10,6 +14,12 @@ type Token struct {
 	Audience       []string
 	Expiration     time.Time
 	Scopes         []string
+
+	// Credential is the credential presented when authenticating, which the user may have replaced since then
+	Credential *yaml.YAML
+
+	// CredentialJWT is the credential as presented, so the seal and status of the Issuer can be checked again
+	CredentialJWT string
 }
 
 type RefreshToken struct {
@@ -22,4 +32,6 @@ type RefreshToken struct {
 	ApplicationID string
 	Expiration    time.Time
 	Scopes        []string
+	Credential    *yaml.YAML
+	CredentialJWT string
 }
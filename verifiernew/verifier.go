@@ -63,6 +63,9 @@ func Start(cfg *yaml.YAML) error {
 	// This is normally used as the layer for accessing a database, but we do not need permanent verifierStorage for users
 	// and it will be handled in-memory because the user data is coming from the Verifiable Credential presented.
 	verifierStorage := storage.NewStorage(ver.Config.VerifierURL, storage.NewUserStore(ver.Config.VerifierURL))
+	verifierStorage.SetSessionMaxAge(time.Duration(ver.Config.SessionMaxAge) * time.Second)
+	verifierStorage.SetACRProfiles(ver.Config.ACRProfiles)
+	verifierStorage.SetSessionPolicy(sessionPolicy)
 
 	logger := slog.New(
 		slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{
@@ -170,19 +173,40 @@ func InspectRuntime() (baseDir string, withGoRun bool) {
 type Storage interface {
 	op.Storage
 	authenticate
+	tokenCredentials
 }
 
 // simple counter for request IDs
 var counter atomic.Int64
 
-var pdp *PDP
+var policies *PolicySet
 
 // SetupServer creates an OIDC server with the configured verifier URL
 func (ver *VerifierServer) SetupServer(storage Storage, logger *slog.Logger, extraOptions ...op.Option) (chi.Router, error) {
 	var err error
 
-	// Start the Policy Decision Point engine for this Verifier
-	pdp, err = NewPDP(ver.Config.AuthnPolicies)
+	// The CAs trusted to issue the certificates sealing the credentials
+	if len(ver.Config.TrustAnchors) > 0 {
+		sealTrustAnchors, err = loadTrustAnchors(ver.Config.TrustAnchors)
+		if err != nil {
+			return nil, fmt.Errorf("loading trust anchors: %w", err)
+		}
+	}
+
+	// The origins where the issuers publish their status lists
+	statusListOrigins = ver.Config.StatusListOrigins
+
+	// Record the decisions of the policies, if configured
+	var audit *AuditLog
+	if len(ver.Config.AuditLog) > 0 {
+		audit, err = OpenAuditLog(ver.Config.AuditLog, ver.Config.AuditMinimise, ver.Config.AuditKey)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Start the Policy Decision Point engine for this Verifier, with the policies of each client and scope
+	policies, err = NewPolicySet(ver.Config, audit)
 	if err != nil {
 		return nil, fmt.Errorf("starting authn policies runtime: %w", err)
 	}
@@ -210,6 +234,9 @@ func (ver *VerifierServer) SetupServer(storage Storage, logger *slog.Logger, ext
 		}),
 	))
 
+	// Make the SSO session of the browser (if any) available to the OpenID Provider and the login UI
+	router.Use(ssoSessionMiddleware)
+
 	fs := http.FileServer(http.Dir("verifiernew/static"))
 	router.Handle("/static/*", http.StripPrefix("/static/", fs))
 
@@ -241,6 +268,23 @@ func (ver *VerifierServer) SetupServer(storage Storage, logger *slog.Logger, ext
 	// so we will direct all calls to /login to the login UI
 	router.Mount("/login/", http.StripPrefix("/login", loginProcess.router))
 
+	// The JSON-RPC endpoint for external Policy Enforcement Points asking for decisions, which are registered Clients
+	router.With(requirePEPClient(ver.Config.AuditAdmins, storage)).Post("/pdp", policies.HttpHandler)
+
+	// Search and export of the audit log, only for the admins
+	if audit != nil && len(ver.Config.AuditAdmins) > 0 {
+		router.Mount("/audit", auditRouter(audit, ver.Config.AuditAdmins, storage))
+	}
+
+	// The optional reverse proxy Policy Enforcement Point, authorizing with the access tokens of the Verifier
+	if len(ver.Config.ProxyRoutes) > 0 {
+		pepRouter, err := newPEPRouter(ver.Config.ProxyRoutes, verifierProvider.Crypto(), storage)
+		if err != nil {
+			return nil, err
+		}
+		router.Mount("/pep", pepRouter)
+	}
+
 	handler := http.Handler(verifierProvider)
 
 	// We register the http handler of the OP on the root, so that the discovery endpoint (/.well-known/openid-configuration)
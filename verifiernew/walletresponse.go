@@ -0,0 +1,116 @@
+package verifiernew
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/foolin/goview"
+)
+
+// Error codes that the Verifier uses when replying to the Wallet, as defined in OID4VP (section 6.4)
+// and RFC 6749 (section 4.1.2.1)
+const (
+	errInvalidRequest        = "invalid_request"
+	errAccessDenied          = "access_denied"
+	errVPFormatsNotSupported = "vp_formats_not_supported"
+	errServerError           = "server_error"
+)
+
+// walletError sends to the Wallet an error response with one of the OID4VP error codes
+func walletError(w http.ResponseWriter, status int, code string, description string) {
+	resp := map[string]string{
+		"error":             code,
+		"error_description": description,
+	}
+	out, _ := json.Marshal(resp)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	w.Write(out)
+}
+
+// walletSuccess replies to the Wallet after accepting the Authentication Response.
+// In same-device flows the reply includes a 'redirect_uri' with a response code, so the Wallet sends the browser of
+// the user back to the Verifier and the login continues without waiting for the login page to poll.
+// In cross-device flows the browser is in another device, and the reply is empty.
+func (l *login) walletSuccess(w http.ResponseWriter, authReqId string, sameDevice bool) {
+
+	var resp any = map[string]string{}
+
+	if l.cfg.LegacyWalletResponse {
+		// Existing Wallets expect this body, and do not understand the OID4VP response
+		resp = map[string]string{
+			"authenticatorRequired": "no",
+			"type":                  "login",
+			"email":                 "email",
+		}
+	} else if sameDevice {
+		code, err := l.authenticate.CreateResponseCode(authReqId)
+		if err != nil {
+			walletError(w, http.StatusInternalServerError, errServerError, err.Error())
+			return
+		}
+		redirectURI := l.cfg.VerifierURL + "/login/samedevice?" + url.Values{
+			"state":         {authReqId},
+			"response_code": {code},
+		}.Encode()
+		resp = map[string]string{
+			"redirect_uri": redirectURI,
+		}
+	}
+
+	out, _ := json.Marshal(resp)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(out)
+}
+
+// sameDeviceCallback is where the Wallet redirects the browser of the user in same-device flows.
+// The response code proves that the browser is the one that started the flow with the Wallet.
+func (l *login) sameDeviceCallback(w http.ResponseWriter, r *http.Request) {
+	authReqId := r.URL.Query().Get("state")
+	code := r.URL.Query().Get("response_code")
+
+	if !l.authenticate.UseResponseCode(authReqId, code) {
+		http.Error(w, "invalid or expired response code", http.StatusBadRequest)
+		return
+	}
+
+	l.completeLogin(w, r, authReqId)
+}
+
+// denyAuthentication records that the authentication was denied, so the login page can show the reasons to the user,
+// and tells the Wallet with an 'access_denied' error.
+func (l *login) denyAuthentication(w http.ResponseWriter, authReqId string, reasons []string) {
+	l.authenticate.SaveWalletAuthenticationDenial(authReqId, reasons)
+
+	description := "authentication failed"
+	if len(reasons) > 0 {
+		description = strings.Join(reasons, "; ")
+	}
+	walletError(w, http.StatusForbidden, errAccessDenied, description)
+}
+
+// displayDenied renders the page telling the user why the authentication was denied
+func (l *login) displayDenied(w http.ResponseWriter, r *http.Request) {
+	reasons, denied := l.authenticate.CheckLoginDenied(r.URL.Query().Get("state"))
+	if !denied {
+		http.Error(w, "authentication request not denied", http.StatusBadRequest)
+		return
+	}
+
+	data := &struct {
+		Reasons []string
+	}{
+		Reasons: reasons,
+	}
+
+	err := goview.Render(w, http.StatusForbidden, "denied", data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -595,3 +595,37 @@ func GetConfigPrivateKey() (privateKey any, certificate *x509.Certificate, caCer
 
 	return ReadPKCS12File(certFilePath, password)
 }
+
+var (
+	// Extension with the Qualified Certificate statements (RFC 3739)
+	oidQCStatements = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 3}
+	// Statement claiming that the certificate is an EU qualified certificate (ETSI EN 319 412-5)
+	oidQcCompliance = asn1.ObjectIdentifier{0, 4, 0, 1862, 1, 1}
+)
+
+type qcStatement struct {
+	StatementId   asn1.ObjectIdentifier
+	StatementInfo asn1.RawValue `asn1:"optional"`
+}
+
+// IsQualifiedCertificate returns true if the certificate declares in its QCStatements extension
+// that it is an EU qualified certificate, as required for eIDAS qualified seals and signatures.
+// This does not check the chain of trust up to a Trusted List.
+func IsQualifiedCertificate(cert *x509.Certificate) bool {
+	for _, ext := range cert.Extensions {
+		if !ext.Id.Equal(oidQCStatements) {
+			continue
+		}
+
+		var statements []qcStatement
+		if _, err := asn1.Unmarshal(ext.Value, &statements); err != nil {
+			return false
+		}
+		for _, st := range statements {
+			if st.StatementId.Equal(oidQcCompliance) {
+				return true
+			}
+		}
+	}
+	return false
+}